@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/knakk/kbp/onix"
+)
+
+// Policies for block updates of records which are not stored.
+const (
+	unknownRefSkip   = "skip"   // ignore the update
+	unknownRefStore  = "store"  // store the update as a new, partial record
+	unknownRefReject = "reject" // treat the update as failed, and retry it later
+)
+
+var errUnknownRef = errors.New("block update of unknown record")
+
+// validUnknownRefPolicy returns an error if policy is not a known policy.
+func validUnknownRefPolicy(policy string) error {
+	switch policy {
+	case unknownRefSkip, unknownRefStore, unknownRefReject:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q for block updates of unknown records (want skip, store or reject)", policy)
+}
+
+// mergeBlocks merges a block update into the stored product. Each block
+// present in the update replaces the corresponding block of the stored product,
+// while blocks not present are left untouched. The NotificationType of the
+// stored product is kept.
+func mergeBlocks(stored, update *onix.Product) {
+	if len(update.ProductIdentifier) > 0 {
+		stored.ProductIdentifier = update.ProductIdentifier
+	}
+	if len(update.DeletionText) > 0 {
+		stored.DeletionText = update.DeletionText
+	}
+	if update.RecordSourceType != nil {
+		stored.RecordSourceType = update.RecordSourceType
+	}
+	if update.RecordSourceName != nil {
+		stored.RecordSourceName = update.RecordSourceName
+	}
+
+	// Block 1: Product description
+	if update.DescriptiveDetail != nil {
+		stored.DescriptiveDetail = update.DescriptiveDetail
+	}
+	// Block 2: Marketing collateral detail
+	if update.CollateralDetail != nil {
+		stored.CollateralDetail = update.CollateralDetail
+	}
+	// Block 3: Content detail
+	if update.ContentDetail != nil {
+		stored.ContentDetail = update.ContentDetail
+	}
+	// Block 4: Publishing detail
+	if update.PublishingDetail != nil {
+		stored.PublishingDetail = update.PublishingDetail
+	}
+	// Block 5: Related material
+	if update.RelatedMaterial != nil {
+		stored.RelatedMaterial = update.RelatedMaterial
+	}
+	// Block 6: Product supply, which is repeatable and replaced as a whole
+	if len(update.ProductSupply) > 0 {
+		stored.ProductSupply = update.ProductSupply
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list1"
+)
+
+// mustDecode decodes the XML of an ONIX 3.0 product.
+func mustDecode(t *testing.T, s string) *onix.Product {
+	t.Helper()
+	p, err := decodeProduct(rawProduct{XML: []byte(s)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMergeBlocks(t *testing.T) {
+	const stored = `<Product>
+		<RecordReference>ref</RecordReference>
+		<NotificationType>` + list1.NotificationConfirmedOnPublication + `</NotificationType>
+		<ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9788203360000</IDValue></ProductIdentifier>
+		<DescriptiveDetail><ProductForm>BB</ProductForm></DescriptiveDetail>
+		<CollateralDetail><TextContent><TextType>03</TextType><Text>Old text</Text></TextContent></CollateralDetail>
+		<ContentDetail><ContentItem><LevelSequenceNumber>1</LevelSequenceNumber></ContentItem></ContentDetail>
+		<PublishingDetail><PublishingStatus>04</PublishingStatus></PublishingDetail>
+		<RelatedMaterial><RelatedProduct><ProductRelationCode>06</ProductRelationCode></RelatedProduct></RelatedMaterial>
+		<ProductSupply><SupplyDetail><ProductAvailability>21</ProductAvailability></SupplyDetail></ProductSupply>
+	</Product>`
+	blocks := map[string]func(p *onix.Product) interface{}{
+		"ProductIdentifier": func(p *onix.Product) interface{} { return p.ProductIdentifier },
+		"DescriptiveDetail": func(p *onix.Product) interface{} { return p.DescriptiveDetail },
+		"CollateralDetail":  func(p *onix.Product) interface{} { return p.CollateralDetail },
+		"ContentDetail":     func(p *onix.Product) interface{} { return p.ContentDetail },
+		"PublishingDetail":  func(p *onix.Product) interface{} { return p.PublishingDetail },
+		"RelatedMaterial":   func(p *onix.Product) interface{} { return p.RelatedMaterial },
+		"ProductSupply":     func(p *onix.Product) interface{} { return p.ProductSupply },
+	}
+
+	tests := []struct {
+		blocks   string // of the update
+		replaced []string
+	}{
+		{``, nil},
+		{`<DescriptiveDetail><ProductForm>BC</ProductForm></DescriptiveDetail>`, []string{"DescriptiveDetail"}},
+		{`<CollateralDetail><TextContent><TextType>03</TextType><Text>New text</Text></TextContent></CollateralDetail>`, []string{"CollateralDetail"}},
+		{`<ContentDetail><ContentItem><LevelSequenceNumber>2</LevelSequenceNumber></ContentItem></ContentDetail>`, []string{"ContentDetail"}},
+		{`<PublishingDetail><PublishingStatus>07</PublishingStatus></PublishingDetail>`, []string{"PublishingDetail"}},
+		{`<RelatedMaterial><RelatedProduct><ProductRelationCode>13</ProductRelationCode></RelatedProduct></RelatedMaterial>`, []string{"RelatedMaterial"}},
+		{`<ProductSupply><SupplyDetail><ProductAvailability>40</ProductAvailability></SupplyDetail></ProductSupply>
+		  <ProductSupply><SupplyDetail><ProductAvailability>21</ProductAvailability></SupplyDetail></ProductSupply>`, []string{"ProductSupply"}},
+		{`<ProductIdentifier><ProductIDType>03</ProductIDType><IDValue>9788203360000</IDValue></ProductIdentifier>
+		  <PublishingDetail><PublishingStatus>07</PublishingStatus></PublishingDetail>
+		  <ProductSupply><SupplyDetail><ProductAvailability>40</ProductAvailability></SupplyDetail></ProductSupply>`, []string{"ProductIdentifier", "PublishingDetail", "ProductSupply"}},
+	}
+	for _, test := range tests {
+		before, got := mustDecode(t, stored), mustDecode(t, stored)
+		update := mustDecode(t, `<Product><RecordReference>ref</RecordReference><NotificationType>`+
+			list1.UpdatePartial+`</NotificationType>`+test.blocks+`</Product>`)
+		mergeBlocks(got, update)
+
+		replaced := make(map[string]bool)
+		for _, b := range test.replaced {
+			replaced[b] = true
+		}
+		for name, block := range blocks {
+			want := block(before)
+			if replaced[name] {
+				want = block(update)
+			}
+			if !reflect.DeepEqual(block(got), want) {
+				t.Errorf("mergeBlocks(%s): %s => %+v; want %+v", test.blocks, name, block(got), want)
+			}
+		}
+		if got.NotificationType != before.NotificationType {
+			t.Errorf("mergeBlocks(%s): NotificationType => %q; want it kept", test.blocks, got.NotificationType.Value)
+		}
+	}
+}
+
+func TestBlockUpdates(t *testing.T) {
+	h, done := testHarvester(t, nil)
+	defer done()
+	process := func(source, xml string) (action, error) {
+		raw := rawProduct{XML: []byte(xml), Source: source}
+		p, err := decodeProduct(raw)
+		return h.process(p, raw, err)
+	}
+	const newForm = `<DescriptiveDetail><ProductForm>BB</ProductForm><TitleDetail><TitleType>01</TitleType>` +
+		`<TitleElement><TitleText>Title</TitleText></TitleElement></TitleDetail></DescriptiveDetail>`
+
+	// Block updates are merged, and attributed to their source
+	if _, err := process("a", testProduct("A", list1.NotificationConfirmedOnPublication, validBlocks)); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := process("b", testProduct("A", list1.UpdatePartial, newForm)); a != actionStored || err != nil {
+		t.Fatalf("block update => %v, %v; want stored", a, err)
+	}
+	id := h.db.Ref("A")
+	p, err := h.db.Get(id)
+	if err != nil || p.DescriptiveDetail.ProductForm.Value != "BB" || p.PublishingDetail == nil {
+		t.Errorf("updated product => %+v, %v; want new form, publishing detail kept", p, err)
+	}
+	if src, _ := h.db.SourceOf(id); src != "b" {
+		t.Errorf("db.SourceOf(%d) => %q; want b", id, src)
+	}
+
+	// Merged products are validated
+	if a, err := process("b", testProduct("A", list1.UpdatePartial, `<DescriptiveDetail></DescriptiveDetail>`)); a != actionQuarantined || err != nil {
+		t.Errorf("invalid block update => %v, %v; want quarantined", a, err)
+	}
+
+	// Block updates of unknown records are handled by policy
+	tests := []struct {
+		policy string
+		blocks string
+		want   action
+		err    bool
+	}{
+		{unknownRefSkip, newForm, actionSkipped, false},
+		{unknownRefReject, newForm, actionSkipped, true},
+		{unknownRefStore, validBlocks, actionStored, false},
+		{unknownRefStore, newForm, actionQuarantined, false},
+	}
+	for i, test := range tests {
+		h.unknownRef = test.policy
+		ref := fmt.Sprintf("U%d", i)
+		a, err := process("b", testProduct(ref, list1.UpdatePartial, test.blocks))
+		if _, retryable := err.(retryableError); a != test.want || (err != nil) != test.err || (err != nil && !retryable) {
+			t.Errorf("block update of unknown record with policy %s => %v, %v; want %v", test.policy, a, err, test.want)
+		}
+		if stored := h.db.Ref(ref) != 0; stored != (test.want == actionStored) {
+			t.Errorf("block update of unknown record with policy %s stored: %v", test.policy, stored)
+		}
+	}
+}
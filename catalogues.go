@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/knakk/otra/storage"
+)
+
+// indexFns are the indexing functions which can be selected per catalogue.
+var indexFns = map[string]checkedIndexFn{
+	"default": indexFn,
+}
+
+// catalogueConfig is the configuration of a named catalogue, as read from
+// the file given by the -catalogues flag.
+type catalogueConfig struct {
+	Name    string        `json:"name"`
+	DB      string        `json:"db"`
+	Index   string        `json:"index"`
+	Images  string        `json:"images"`
+	Harvest harvestConfig `json:"harvest"`
+
+	// ImageWorkers is the number of images downloaded in parallel.
+	ImageWorkers int `json:"imageWorkers"`
+
+	// Policy is a file with rules deciding how records are stored, flagged
+	// or hidden. If empty, defaultPolicy is used.
+	Policy string `json:"policy"`
+
+	// Validate are the validation rules products must satisfy to be stored.
+	// Failing products are quarantined. If nil, defaultValidation is used.
+	Validate []string `json:"validate"`
+
+	// ReplicaOf is the base URL of a primary catalogue to follow. If set,
+	// the catalogue is read-only and the harvester is not started.
+	ReplicaOf string `json:"replicaOf"`
+
+	// ReplicationSecret is shared by a primary catalogue and its replicas,
+	// which send it to follow the primary. Replicas can not follow a
+	// catalogue without one.
+	ReplicationSecret string `json:"replicationSecret"`
+}
+
+type harvestConfig struct {
+	// The source to harvest, if Sources is empty. Otherwise its poll
+	// interval, batch size, before, retries and timeouts are defaults for
+	// the sources.
+	sourceConfig
+
+	// Sources are harvested concurrently, each with its own cursor.
+	Sources []sourceConfig `json:"sources"`
+
+	IgnoreCursor bool `json:"ignoreCursor"`
+
+	// UnknownRef is the policy for block updates of records which are
+	// not stored: skip (default), store or reject.
+	UnknownRef string `json:"unknownRef"`
+}
+
+// sources returns the configurations of the sources to harvest, with
+// defaults filled in from the harvest configuration.
+func (c harvestConfig) sources() []sourceConfig {
+	if len(c.Sources) == 0 {
+		sc := c.sourceConfig
+		sc.Name = defaultSource
+		return []sourceConfig{sc}
+	}
+	res := make([]sourceConfig, len(c.Sources))
+	for i, sc := range c.Sources {
+		if sc.PollInterval.Duration == 0 {
+			sc.PollInterval = c.PollInterval
+		}
+		if sc.Before.Duration == 0 {
+			sc.Before = c.Before
+		}
+		if sc.BatchSize == 0 {
+			sc.BatchSize = c.BatchSize
+		}
+		if sc.Retries == 0 {
+			sc.Retries = c.Retries
+		}
+		sc.Spool = sc.Spool || c.Spool
+		for _, d := range []struct{ v, def *duration }{
+			{&sc.Cooldown, &c.Cooldown},
+			{&sc.ConnectTimeout, &c.ConnectTimeout},
+			{&sc.ReadTimeout, &c.ReadTimeout},
+			{&sc.TokenTTL, &c.TokenTTL},
+		} {
+			if d.v.Duration == 0 {
+				*d.v = *d.def
+			}
+		}
+		res[i] = sc
+	}
+	return res
+}
+
+// duration is a time.Duration which is encoded in JSON as a string, ie "12h".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// loadCatalogues reads the catalogue configurations from a JSON file,
+// filling in defaults for missing values.
+func loadCatalogues(path string) ([]catalogueConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfgs []catalogueConfig
+	if err := json.NewDecoder(f).Decode(&cfgs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("%s: no catalogues configured", path)
+	}
+	for i, c := range cfgs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s: catalogue #%d is missing a name", path, i+1)
+		}
+		if c.DB == "" {
+			cfgs[i].DB = c.Name + ".db"
+		}
+		if c.Index == "" {
+			cfgs[i].Index = "default"
+		}
+		if _, ok := indexFns[cfgs[i].Index]; !ok {
+			return nil, fmt.Errorf("%s: catalogue %q: unknown index function %q", path, c.Name, c.Index)
+		}
+		if c.Images == "" {
+			cfgs[i].Images = "img-" + c.Name
+		}
+		if c.Harvest.BatchSize == 0 {
+			cfgs[i].Harvest.BatchSize = 100
+		}
+		if c.Harvest.PollInterval.Duration == 0 {
+			cfgs[i].Harvest.PollInterval.Duration = time.Hour * 12
+		}
+		if c.Harvest.Before.Duration == 0 {
+			cfgs[i].Harvest.Before.Duration = harvestStart
+		}
+		if c.Validate == nil {
+			cfgs[i].Validate = defaultValidation
+		}
+		if _, err := newValidator(cfgs[i].Validate); err != nil {
+			return nil, fmt.Errorf("%s: catalogue %q: %v", path, c.Name, err)
+		}
+		if err := validSourceType(c.Harvest.Type); err != nil {
+			return nil, fmt.Errorf("%s: catalogue %q: %v", path, c.Name, err)
+		}
+		seen := make(map[string]bool)
+		for j, sc := range c.Harvest.Sources {
+			if sc.Name == "" {
+				return nil, fmt.Errorf("%s: catalogue %q: source #%d is missing a name", path, c.Name, j+1)
+			}
+			if seen[sc.Name] {
+				return nil, fmt.Errorf("%s: catalogue %q: duplicate source %q", path, c.Name, sc.Name)
+			}
+			if reservedSourceNames[sc.Name] || strings.Contains(sc.Name, "/") {
+				return nil, fmt.Errorf("%s: catalogue %q: source name %q is reserved or contains a slash", path, c.Name, sc.Name)
+			}
+			seen[sc.Name] = true
+			if err := validSourceType(sc.Type); err != nil {
+				return nil, fmt.Errorf("%s: catalogue %q: source %q: %v", path, c.Name, sc.Name, err)
+			}
+		}
+		if c.Harvest.UnknownRef == "" {
+			cfgs[i].Harvest.UnknownRef = unknownRefSkip
+		}
+		if err := validUnknownRefPolicy(cfgs[i].Harvest.UnknownRef); err != nil {
+			return nil, fmt.Errorf("%s: catalogue %q: %v", path, c.Name, err)
+		}
+	}
+	return cfgs, nil
+}
+
+// catalogueMux returns a handler serving the given catalogue. The base is the
+// path prefix the handler is mounted at, and is used to construct links.
+// The harvester h is nil for replicas. The admin pages and the quarantine
+// require the admin password, and are disabled if it is empty.
+func catalogueMux(db *storage.DB, h *harvester, c catalogueConfig, base, adminPass string) *http.ServeMux {
+	imgDir := c.Images
+	mux := http.NewServeMux()
+	mux.Handle("/autocomplete/", scanHandler(db))
+	mux.Handle("/record/", recordHandler(db))
+	mux.Handle("/deleted", deletedHandler(db))
+	mux.Handle("/work/", workHandler(db, base))
+	mux.Handle("/indexes", indexHandler(db))
+	mux.Handle("/stats", statsHandler(db, h))
+	mux.Handle("/health", healthHandler(h))
+	mux.Handle("/stats/index/", indexStatsHandler(db))
+	mux.Handle("/replication/changes", requireReplicationSecret(c.ReplicationSecret, changesHandler(db)))
+	mux.Handle("/replication/images", requireReplicationSecret(c.ReplicationSecret, imageSetHandler(db)))
+	mux.Handle("/quarantine", requireAdmin(adminPass, quarantineHandler(db, h)))
+	mux.Handle("/quarantine/", requireAdmin(adminPass, quarantineHandler(db, h)))
+	mux.Handle("/admin/harvest", requireAdmin(adminPass, harvestAdminHandler(h, base)))
+	mux.Handle("/admin/harvest/", requireAdmin(adminPass, harvestAdminHandler(h, base)))
+	if c.ReplicaOf != "" {
+		// Images are not replicated, so they are served by the primary
+		mux.Handle("/img/", primaryRedirect(c.ReplicaOf))
+		mux.Handle("/resource/", primaryRedirect(c.ReplicaOf))
+		mux.Handle("/imgbyisbn/", primaryRedirect(c.ReplicaOf))
+		mux.Handle("/imgbyean/", primaryRedirect(c.ReplicaOf))
+		mux.Handle("/stats/images", primaryRedirect(c.ReplicaOf))
+	} else {
+		mux.Handle("/img/", http.StripPrefix("/img/", imageHandler(imgDir)))
+		mux.Handle("/resource/", http.StripPrefix("/resource/", resourceHandler(db, imgDir)))
+		mux.Handle("/stats/images", imageUsageHandler(imgDir))
+		mux.Handle("/imgbyisbn/", imgByIsbnHandler(db, imgDir))
+		mux.Handle("/imgbyean/", imgByEANHandler(db, imgDir))
+	}
+	mux.Handle("/favicon.ico", http.NotFoundHandler())
+	mux.Handle("/xmlquery", xmlQueryHandler(db))
+	mux.Handle("/", queryHandler(db, base))
+	return mux
+}
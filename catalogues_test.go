@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCataloguesSourceNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, want := range map[string]string{
+		"boknett": "",
+		"":        "missing a name",
+		"runs":    "reserved",
+		"status":  "reserved",
+		"a/b":     "slash",
+	} {
+		path := filepath.Join(dir, "catalogues.json")
+		cfg := `[{"name": "c", "harvest": {"sources": [{"name": "` + name + `", "url": "http://example.org"}]}}]`
+		if err := ioutil.WriteFile(path, []byte(cfg), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadCatalogues(path)
+		if (want == "" && err != nil) || (want != "" && (err == nil || !strings.Contains(err.Error(), want))) {
+			t.Errorf("loadCatalogues with source %q => %v; want error %q", name, err, want)
+		}
+	}
+}
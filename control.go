@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	errUnknownSource = errors.New("unknown source")
+	errPaused        = errors.New("source is paused")
+)
+
+// afterCursorer is implemented by sources which can harvest the changes
+// made after a given time.
+type afterCursorer interface {
+	// afterCursor returns the cursor of the changes made after t.
+	afterCursor(t time.Time) string
+}
+
+func (s *boknettSource) afterCursor(t time.Time) string {
+	return "after:" + t.Local().Format(boknettTime)
+}
+
+// afterCursor uses the seconds granularity of OAI-PMH, which repositories
+// with day granularity reject.
+func (s *oaiSource) afterCursor(t time.Time) string {
+	return "from:" + t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// source returns the source with the given name.
+func (h *harvester) source(name string) (*harvestSource, error) {
+	if h != nil {
+		for _, s := range h.sources {
+			if s.name == name {
+				return s, nil
+			}
+		}
+	}
+	return nil, errUnknownSource
+}
+
+// Pause makes the named source stop harvesting once the batch being
+// harvested, if any, is done.
+func (h *harvester) Pause(name string) error {
+	s, err := h.source(name)
+	if err != nil {
+		return err
+	}
+	s.update(func(st *sourceStatus) { st.Paused, st.NextPoll = true, time.Time{} })
+	s.wakeUp()
+	return nil
+}
+
+// Resume makes a paused source harvest again at once.
+func (h *harvester) Resume(name string) error {
+	s, err := h.source(name)
+	if err != nil {
+		return err
+	}
+	s.update(func(st *sourceStatus) { st.Paused = false })
+	s.wakeUp()
+	return nil
+}
+
+// Poll makes the named source harvest at once, rather than waiting for the
+// poll interval or the backoff after a failure.
+func (h *harvester) Poll(name string) error {
+	s, err := h.source(name)
+	if err != nil {
+		return err
+	}
+	if s.paused() {
+		return errPaused
+	}
+	s.wakeUp()
+	return nil
+}
+
+// SetCursor makes the named source continue from the given cursor, with
+// the next batch it fetches. An empty cursor means the source's starting
+// point.
+func (h *harvester) SetCursor(name, cursor string) error {
+	s, err := h.source(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.newCursor = &cursor
+	s.mu.Unlock()
+	s.wakeUp()
+	return nil
+}
+
+// SetAfter makes the named source harvest the changes made after t, with
+// the next batch it fetches. Not all types of sources support it.
+func (h *harvester) SetAfter(name string, t time.Time) error {
+	s, err := h.source(name)
+	if err != nil {
+		return err
+	}
+	a, ok := s.src.(afterCursorer)
+	if !ok {
+		return fmt.Errorf("a %s source can not harvest changes after a time", s.typ)
+	}
+	return h.SetCursor(name, a.afterCursor(t))
+}
+
+func (s *harvestSource) paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status.Paused
+}
+
+// takeCursor returns the cursor set by SetCursor, if any, and clears it.
+func (s *harvestSource) takeCursor() (cursor string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.newCursor == nil {
+		return "", false
+	}
+	cursor = *s.newCursor
+	s.newCursor = nil
+	return cursor, true
+}
+
+// wakeUp interrupts the source's wait for its next attempt.
+func (s *harvestSource) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// sleep waits for d, or until the source is woken up.
+func (s *harvestSource) sleep(d time.Duration) {
+	select {
+	case <-s.wake:
+	case <-time.After(d):
+	}
+}
+
+// waitWhilePaused blocks while the source is paused.
+func (s *harvestSource) waitWhilePaused() {
+	for s.paused() {
+		<-s.wake
+	}
+}
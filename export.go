@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+// onixHeader returns the start of an ONIX 3.0 message, including its Header.
+func onixHeader(sender string, sent time.Time) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<ONIXMessage release="3.0" xmlns="http://ns.editeur.org/onix/3.0/reference">` + "\n")
+	b.WriteString("<Header><Sender><SenderName>")
+	xml.EscapeText(&b, []byte(sender))
+	b.WriteString("</SenderName></Sender><SentDateTime>")
+	b.WriteString(sent.UTC().Format("20060102T1504Z"))
+	b.WriteString("</SentDateTime></Header>\n")
+	return b.String()
+}
+
+// runExport implements the export command, which writes records from the
+// database to ONIX files without starting the server.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		dbFile = fs.String("db", "otra.db", "database file")
+		query  = fs.String("q", "", "only export records matching query (index/term)")
+		since  = fs.String("since", "", "only export records changed since date (YYYY-MM-DD or RFC3339)")
+		out    = fs.String("o", "", "output file (default stdout)")
+		split  = fs.Int("split", 0, "split output into files of this many products")
+		gz     = fs.Bool("gzip", false, "gzip output files")
+		sender = fs.String("sender", "Otra", "sender name in message header")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s export [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *split > 0 && *out == "" {
+		return errors.New("export: -split requires -o")
+	}
+
+	db, err := storage.OpenReadOnly(*dbFile, (*problemLog)(nil).indexFn(indexFn))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Select records, if filtered by query or date
+	var ids []uint32
+	filtered := false
+	if *query != "" {
+		paths := strings.SplitN(*query, "/", 2)
+		if len(paths) != 2 || paths[1] == "" {
+			return errors.New("export: usage: -q index/query")
+		}
+		if _, ids, err = db.Query(paths[0], paths[1], 0, math.MaxInt32); err != nil {
+			return err
+		}
+		filtered = true
+	}
+	if *since != "" {
+		t, err := parseDate(*since)
+		if err != nil {
+			return fmt.Errorf("export: -since: %v", err)
+		}
+		changed, err := db.ChangedSince(t)
+		if err != nil {
+			return err
+		}
+		if filtered {
+			ids = intersect(ids, changed)
+		} else {
+			ids = changed
+		}
+		filtered = true
+	}
+
+	w := &exportWriter{path: *out, split: *split, gzip: *gz, header: onixHeader(*sender, time.Now())}
+	start := time.Now()
+	if filtered {
+		for _, id := range ids {
+			p, err := db.Get(id)
+			if err != nil {
+				return fmt.Errorf("export: record %d: %v", id, err)
+			}
+			if err := w.Write(p); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := db.ForEach(func(id uint32, p *onix.Product) error {
+			return w.Write(p)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	log.Printf("export: wrote %d records to %d file(s) in %v", w.n, w.files, time.Since(start))
+	return nil
+}
+
+// exportWriter writes products to one or more ONIX files.
+type exportWriter struct {
+	path   string // empty for stdout
+	split  int    // max products per file, 0 for no limit
+	gzip   bool
+	header string
+
+	n     int // products written
+	files int // files opened
+	f     *os.File
+	gw    *gzip.Writer
+	bw    *bufio.Writer
+	enc   *xml.Encoder
+}
+
+func (w *exportWriter) Write(p *onix.Product) error {
+	if w.enc == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if err := w.enc.Encode(p); err != nil {
+		return err
+	}
+	w.bw.WriteByte('\n')
+	w.n++
+	if w.split > 0 && w.n%w.split == 0 {
+		return w.closeFile()
+	}
+	return nil
+}
+
+// Close finishes the current file. An empty message is written if no products were written.
+func (w *exportWriter) Close() error {
+	if w.enc == nil && w.n == 0 {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.closeFile()
+}
+
+func (w *exportWriter) open() error {
+	var out io.Writer = os.Stdout
+	if w.path != "" {
+		path := w.path
+		if w.split > 0 {
+			ext := filepath.Ext(path)
+			path = fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(path, ext), w.files+1, ext)
+		}
+		if w.gzip {
+			path += ".gz"
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		w.f = f
+		out = f
+	}
+	if w.gzip {
+		w.gw = gzip.NewWriter(out)
+		out = w.gw
+	}
+	w.files++
+	w.bw = bufio.NewWriter(out)
+	w.enc = xml.NewEncoder(w.bw)
+	_, err := w.bw.WriteString(w.header)
+	return err
+}
+
+func (w *exportWriter) closeFile() error {
+	if w.enc == nil {
+		return nil
+	}
+	w.enc = nil
+	if _, err := w.bw.WriteString("</ONIXMessage>\n"); err != nil {
+		return err
+	}
+	if err := w.bw.Flush(); err != nil {
+		return err
+	}
+	if w.gw != nil {
+		if err := w.gw.Close(); err != nil {
+			return err
+		}
+		w.gw = nil
+	}
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+		w.f = nil
+	}
+	return nil
+}
+
+// parseDate parses a date as either YYYY-MM-DD or RFC3339.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// intersect returns the IDs in a which are also in b, in the order of a.
+func intersect(a, b []uint32) (res []uint32) {
+	inB := make(map[uint32]bool, len(b))
+	for _, id := range b {
+		inB[id] = true
+	}
+	for _, id := range a {
+		if inB[id] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -9,13 +10,14 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/knakk/kbp/onix"
-	"github.com/knakk/kbp/onix/codes"
 	"github.com/knakk/kbp/onix/codes/list15"
 	"github.com/knakk/kbp/onix/codes/list150"
 	"github.com/knakk/kbp/onix/codes/list163"
@@ -23,12 +25,16 @@ import (
 	"github.com/knakk/kbp/onix/codes/list22"
 	"github.com/knakk/kbp/onix/codes/list5"
 	"github.com/knakk/kbp/onix/codes/list74"
+	"github.com/knakk/otra/onix21"
 	"github.com/knakk/otra/storage"
 )
 
 var (
 	xmlHeader = []byte(`<?xml version="1.0" encoding="utf-8"?><ONIXMessage release="3.0"><Header><Sender><SenderName>Otra</SenderName></Sender></Header>`)
 	xmlFooter = []byte(`</ONIXMessage>`)
+
+	xmlHeaderShort = []byte(`<?xml version="1.0" encoding="utf-8"?><ONIXmessage release="3.0"><header><sender><x298>Otra</x298></sender></header>`)
+	xmlFooterShort = []byte(`</ONIXmessage>`)
 )
 
 func recordHandler(db *storage.DB) http.Handler {
@@ -44,18 +50,213 @@ func recordHandler(db *storage.DB) http.Handler {
 			return
 		}
 		rec, err := db.Get(uint32(n))
-		if err == storage.ErrNotFound {
+		switch err {
+		case nil:
+		case storage.ErrNotFound:
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
+		case storage.ErrDeleted:
+			http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
+		if legacyRelease(r) && shortTagsRequested(r) {
+			http.Error(w, "short tags are only supported for ONIX 3.0", http.StatusBadRequest)
+			return
+		}
+		if flags, err := db.TermsOf(flagIndex, uint32(n)); err == nil && len(flags) > 0 {
+			w.Header().Set("X-Record-Flags", strings.Join(flags, ", "))
+		}
 		w.Header().Set("Content-Type", "application/xml")
+		if shortTagsRequested(r) {
+			if err := encodeShort(xml.NewEncoder(w), &rec); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if legacyRelease(r) {
+			p := toONIX21(w, []*onix.Product{rec})[0]
+			if err := xml.NewEncoder(w).Encode(&p); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
 		if err := xml.NewEncoder(w).Encode(&rec); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
 }
 
+func deletedHandler(db *storage.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(w, "since must be a RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be an integer >= 1", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		tombstones, err := db.Tombstones(since, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&tombstones); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// quarantineHandler serves the quarantined products:
+//
+//	GET  /quarantine?after=:id&limit=:n   list quarantined products
+//	GET  /quarantine/:id                  quarantined product with its XML
+//	POST /quarantine/:id/reprocess        process product again with current rules
+//	POST /quarantine/reprocess            process all products again
+//
+// Reprocessing is not available if h is nil.
+func quarantineHandler(db *storage.DB, h *harvester) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(paths) == 1 && r.Method == "GET":
+			var after uint64
+			if a := r.URL.Query().Get("after"); a != "" {
+				var err error
+				if after, err = strconv.ParseUint(a, 10, 64); err != nil {
+					http.Error(w, "after must be a quarantine ID", http.StatusBadRequest)
+					return
+				}
+			}
+			limit := 100
+			if l := r.URL.Query().Get("limit"); l != "" {
+				n, err := strconv.Atoi(l)
+				if err != nil || n < 1 {
+					http.Error(w, "limit must be an integer >= 1", http.StatusBadRequest)
+					return
+				}
+				limit = n
+			}
+			total, products, err := db.QuarantinedProducts(after, limit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res := struct {
+				Total    int
+				Products []storage.Quarantined
+			}{total, products}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&res); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		case len(paths) == 2 && paths[1] == "reprocess" && r.Method == "POST":
+			if h == nil {
+				http.Error(w, "reprocessing not available", http.StatusMethodNotAllowed)
+				return
+			}
+			var results []reprocessResult
+			var after uint64
+			for {
+				_, products, err := db.QuarantinedProducts(after, 100)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if len(products) == 0 {
+					break
+				}
+				for _, q := range products {
+					results = append(results, reprocess(h, q.ID))
+					after = q.ID
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&results); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if len(paths) < 2 || len(paths) > 3 {
+			http.Error(w, "usage: /quarantine/:id", http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseUint(paths[1], 10, 64)
+		if err != nil {
+			http.Error(w, "usage: /quarantine/:id", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case len(paths) == 2 && r.Method == "GET":
+			q, err := db.QuarantinedProduct(id)
+			if err == storage.ErrNotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&q); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		case len(paths) == 3 && paths[2] == "reprocess" && r.Method == "POST":
+			if h == nil {
+				http.Error(w, "reprocessing not available", http.StatusMethodNotAllowed)
+				return
+			}
+			if _, err := db.QuarantinedProduct(id); err == storage.ErrNotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			res := reprocess(h, id)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&res); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// reprocessResult is the outcome of reprocessing a quarantined product.
+type reprocessResult struct {
+	ID     uint64
+	Result string
+	Error  string `json:",omitempty"`
+}
+
+func reprocess(h *harvester, id uint64) reprocessResult {
+	res := reprocessResult{ID: id}
+	a, err := h.reprocess(id)
+	if err != nil {
+		res.Result = "failed"
+		res.Error = err.Error()
+		return res
+	}
+	res.Result = a.String()
+	return res
+}
+
 func indexHandler(db *storage.DB) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		indexes := db.Indexes()
@@ -67,24 +268,119 @@ func indexHandler(db *storage.DB) http.Handler {
 	})
 }
 
-func queryHandler(db *storage.DB) http.Handler {
+func queryHandler(db *storage.DB, base string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		hasImages := roaring.New()
-		b, err := db.MetaGet([]byte("hasImage"))
+		results := searchResults{Base: base, Action: base + "/"}
+		if q := r.URL.Query().Get("q"); q != "" {
+			paths := strings.Split(q, "/")
+			if len(paths) != 2 || paths[1] == "" {
+				http.Error(w, "usage: q=index/query", http.StatusBadRequest)
+				return
+			}
+
+			pageNum := 1
+			if pageP := r.URL.Query().Get("page"); pageP != "" {
+				n, err := strconv.Atoi(pageP)
+				if err != nil || n < 1 {
+					http.Error(w, "page must be an integer >= 1", http.StatusBadRequest)
+					return
+				}
+				pageNum = n
+			}
+
+			collapse := r.URL.Query().Get("collapse") == storage.WorkIndex
+			var err error
+			results, err = search(db, base, paths[0], paths[1], pageNum, collapse, searchFilters(r.URL.Query()))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		if err := indexTmpl.Execute(w, results); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func workHandler(db *storage.DB, base string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths := strings.Split(r.URL.Path, "/")
+		if len(paths) != 3 || paths[2] == "" {
+			http.Error(w, "usage: /work/:id", http.StatusBadRequest)
+			return
+		}
+
+		results, err := search(db, base, storage.WorkIndex, paths[2], 1, false, searchFilters(r.URL.Query()))
 		if err != nil {
-			log.Printf("failed to load image set: %v", err)
-		} else if _, err := hasImages.ReadFrom(bytes.NewReader(b)); err != nil {
-			log.Printf("failed to load image set %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		var results searchResults
+		if results.Total == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		if err := indexTmpl.Execute(w, results); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// search queries the given index and returns the given page of hits. If collapse
+// is true, only the most recent manifestation of each work is included.
+func search(db *storage.DB, base, index, query string, pageNum int, collapse bool, filters []storage.Filter) (searchResults, error) {
+	hasImages := loadImageSet(db)
+
+	offset := (pageNum - 1) * 10
+	start := time.Now()
+	var (
+		total int
+		ids   []uint32
+		err   error
+	)
+	if collapse {
+		total, ids, err = db.QueryWorks(index, query, offset, 10, filters...)
+	} else {
+		total, ids, err = db.Query(index, query, offset, 10, filters...)
+	}
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	results := searchResults{
+		Total:    total,
+		Query:    fmt.Sprintf("%s/%s", index, query),
+		Collapse: collapse,
+		Base:     base,
+		Action:   base + "/",
+	}
+	results.setFilters(filters)
+	for _, id := range ids {
+		hit, err := getHit(db, base, hasImages, id, filters)
+		if err != nil {
+			return results, err
+		}
+		results.Hits = append(results.Hits, hit)
+	}
+	results.Took = strconv.FormatFloat(time.Since(start).Seconds()*1000, 'f', 1, 64)
+	results.paginate(pageNum)
+	return results, nil
+}
+
+func multiQueryHandler(cats *storage.Catalogues) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names := r.URL.Query()["c"]
+		results := searchResults{Action: "/search", Catalogues: names}
 		if q := r.URL.Query().Get("q"); q != "" {
 			paths := strings.Split(q, "/")
 			if len(paths) != 2 || paths[1] == "" {
-				http.Error(w, "usage: q=index/query", http.StatusBadRequest)
+				http.Error(w, "usage: q=index/query&c=catalogue", http.StatusBadRequest)
 				return
 			}
 
-			offset := 0
 			pageNum := 1
 			if pageP := r.URL.Query().Get("page"); pageP != "" {
 				n, err := strconv.Atoi(pageP)
@@ -93,40 +389,35 @@ func queryHandler(db *storage.DB) http.Handler {
 					return
 				}
 				pageNum = n
-				offset = (pageNum - 1) * 10
 			}
 
 			start := time.Now()
-			total, ids, err := db.Query(paths[0], paths[1], offset, 10)
+			filters := searchFilters(r.URL.Query())
+			results.setFilters(filters)
+			total, hits, err := cats.Query(names, paths[0], paths[1], (pageNum-1)*10, 10, filters...)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			results.Total = total
+			results.Query = q
 
-			results = searchResults{Total: total, Query: fmt.Sprintf("%s/%s", paths[0], paths[1])}
-			for _, id := range ids {
-				p, err := db.Get(id)
+			imageSets := make(map[string]*roaring.Bitmap)
+			for _, h := range hits {
+				db, _ := cats.Get(h.Catalogue)
+				if imageSets[h.Catalogue] == nil {
+					imageSets[h.Catalogue] = loadImageSet(db)
+				}
+				hit, err := getHit(db, "/c/"+h.Catalogue, imageSets[h.Catalogue], h.ID, filters)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
-				hit := extractRes(p, id)
-				hit.HasImage = hasImages.Contains(id)
+				hit.Catalogue = h.Catalogue
 				results.Hits = append(results.Hits, hit)
 			}
 			results.Took = strconv.FormatFloat(time.Since(start).Seconds()*1000, 'f', 1, 64)
-			for i := 0; total > 10 && float64(i) < math.Ceil(float64(total)/10); i++ {
-				if len(results.Pages) == 10 {
-					break
-				}
-				results.Pages = append(results.Pages, page{Page: strconv.Itoa(i + 1), Active: i+1 == pageNum})
-				if i == 0 && pageNum >= 10 {
-					i += (pageNum - 9)
-				}
-			}
-			if pageNum >= 10 {
-				results.Pages = append(results.Pages[:1], append([]page{page{Page: "...", Active: true}}, results.Pages[1:]...)...)
-			}
+			results.paginate(pageNum)
 		}
 
 		w.Header().Set("Content-Type", "text/html")
@@ -136,6 +427,81 @@ func queryHandler(db *storage.DB) http.Handler {
 	})
 }
 
+// loadImageSet returns the set of records in the database which have images.
+func loadImageSet(db *storage.DB) *roaring.Bitmap {
+	hasImages := roaring.New()
+	b, err := db.MetaGet([]byte("hasImage"))
+	if err != nil {
+		log.Printf("failed to load image set: %v", err)
+	} else if _, err := hasImages.ReadFrom(bytes.NewReader(b)); err != nil {
+		log.Printf("failed to load image set %v", err)
+	}
+	return hasImages
+}
+
+// getHit retrieves the record with the given ID and extracts it as a search hit.
+// Only manifestations of its work which pass the filters are counted.
+func getHit(db *storage.DB, base string, hasImages *roaring.Bitmap, id uint32, filters []storage.Filter) (Hit, error) {
+	p, err := db.Get(id)
+	if err != nil {
+		return Hit{}, err
+	}
+	hit, errs := extractRes(p, id)
+	problemsOf(db).report(p.RecordReference.Value, stageDisplay, errs)
+	hit.Base = base
+	hit.HasImage = hasImages.Contains(id)
+	if imgs, err := db.Images(id); err == nil {
+		for _, img := range imgs {
+			if img.Resource != "" {
+				hit.Resources = append(hit.Resources, hitResource{Type: img.Resource, Name: img.Name, Kind: resourceKind(img.Type)})
+			}
+		}
+	}
+	switch work, err := db.WorkOf(id); err {
+	case nil:
+		hit.Work = work
+		if hit.Manifestations, _, err = db.Query(storage.WorkIndex, work, 0, 0, filters...); err != nil {
+			return hit, err
+		}
+	case storage.ErrNotFound:
+	default:
+		return hit, err
+	}
+	hit.Source, _ = db.SourceOf(id)
+	hit.Flags, err = db.TermsOf(flagIndex, id)
+	return hit, err
+}
+
+// setFilters records the flag filters given by the user, so that they can be
+// kept when paginating. The implicit exclusion of hidden records is left out.
+func (results *searchResults) setFilters(filters []storage.Filter) {
+	for _, f := range filters {
+		switch {
+		case !f.Exclude:
+			results.Flags = append(results.Flags, f.Term)
+		case f.Term != flagHidden:
+			results.NoFlags = append(results.NoFlags, f.Term)
+		}
+	}
+}
+
+// paginate sets up the links to the pages surrounding the given page.
+func (results *searchResults) paginate(pageNum int) {
+	total := results.Total
+	for i := 0; total > 10 && float64(i) < math.Ceil(float64(total)/10); i++ {
+		if len(results.Pages) == 10 {
+			break
+		}
+		results.Pages = append(results.Pages, page{Page: strconv.Itoa(i + 1), Active: i+1 == pageNum})
+		if i == 0 && pageNum >= 10 {
+			i += (pageNum - 9)
+		}
+	}
+	if pageNum >= 10 {
+		results.Pages = append(results.Pages[:1], append([]page{page{Page: "...", Active: true}}, results.Pages[1:]...)...)
+	}
+}
+
 func xmlQueryHandler(db *storage.DB) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		element := r.PostFormValue("element")
@@ -145,6 +511,11 @@ func xmlQueryHandler(db *storage.DB) http.Handler {
 			return
 		}
 
+		if legacyRelease(r) && shortTagsRequested(r) {
+			http.Error(w, "short tags are only supported for ONIX 3.0", http.StatusBadRequest)
+			return
+		}
+
 		_, ids, err := db.Query(element, query, 0, 10)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -152,7 +523,34 @@ func xmlQueryHandler(db *storage.DB) http.Handler {
 		}
 
 		w.Header().Set("Content-Type", "application/xml")
-		if _, err := w.Write(xmlHeader); err != nil {
+		if legacyRelease(r) {
+			recs := make([]*onix.Product, 0, len(ids))
+			for _, id := range ids {
+				rec, err := db.Get(id)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				recs = append(recs, rec)
+			}
+			msg := onix21.Message{
+				Release: "2.1",
+				Header:  onix21.Header{FromCompany: "Otra", SentDate: time.Now().Format("20060102")},
+				Product: toONIX21(w, recs),
+			}
+			w.Write([]byte(xml.Header))
+			if err := xml.NewEncoder(w).Encode(&msg); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		header, footer := xmlHeader, xmlFooter
+		encode := (*xml.Encoder).Encode
+		if shortTagsRequested(r) {
+			header, footer = xmlHeaderShort, xmlFooterShort
+			encode = encodeShort
+		}
+		if _, err := w.Write(header); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -163,12 +561,16 @@ func xmlQueryHandler(db *storage.DB) http.Handler {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			if err := enc.Encode(&rec); err != nil {
+			if err := encode(enc, &rec); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
-		if _, err := w.Write(xmlFooter); err != nil {
+		if err := enc.Flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := w.Write(footer); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -195,10 +597,466 @@ func scanHandler(db *storage.DB) http.Handler {
 	})
 }
 
-func statsHandler(db *storage.DB) http.Handler {
+// healthHandler responds with 503 Service Unavailable if any source of the
+// harvester h is persistently failing.
+func healthHandler(h *harvester) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if h.Healthy() {
+			fmt.Fprintln(w, "ok")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, st := range h.Status() {
+			if st.Unhealthy {
+				fmt.Fprintf(w, "source %s: %d failures: %s\n", st.Name, st.Failures, st.LastError)
+			}
+		}
+	})
+}
+
+// statsHandler shows statistics of the database, and the status of the
+// harvester h, which is nil for replicas.
+func statsHandler(db *storage.DB, h *harvester) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
-		if err := statsTmpl.Execute(w, db.Stats()); err != nil {
+		data := struct {
+			storage.Stats
+			Problems []problem
+			Sources  []sourceStatus
+			Images   int // queued to be downloaded
+		}{Stats: db.Stats(), Problems: problemsOf(db).list(), Sources: h.Status()}
+		data.Images, _, _ = db.ImageJobs(time.Time{}, 1)
+		if err := statsTmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// requireAdmin restricts the handler to requests authenticated as the user
+// admin with the given password, using basic authentication. Requests
+// changing anything are refused from other origins, as browsers send the
+// credentials along. Without a password, the handler is disabled.
+func requireAdmin(password string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if password == "" {
+			http.Error(w, "admin is disabled, as no -admin-pass is set", http.StatusNotFound)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "admin" || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="otra admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			if origin := r.Header.Get("Origin"); origin != "" {
+				if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+					http.Error(w, "cross-origin request refused", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireReplicationSecret only lets requests authorized by the secret
+// shared with replicas, as a bearer token, through to h. Replication is
+// disabled if no secret is set.
+func requireReplicationSecret(secret string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			http.Error(w, "replication is disabled, as no -replication-secret is set", http.StatusNotFound)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="otra replication"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// harvestAdminHandler controls the harvester h, which is nil for replicas:
+//
+//	GET  /admin/harvest                 state of the sources, with controls
+//	GET  /admin/harvest/status          state of the sources, as JSON
+//	GET  /admin/harvest/runs?source=:name&before=:id&limit=:n
+//	                                    journal of harvest runs, newest first
+//	GET  /admin/harvest/runs/:id        journal of a run, with its pages
+//	POST /admin/harvest/:source/pause   stop harvesting after the current batch
+//	POST /admin/harvest/:source/resume  harvest again
+//	POST /admin/harvest/:source/poll    harvest at once
+//	POST /admin/harvest/:source/reset   harvest from the source's starting point
+//	POST /admin/harvest/:source/after   harvest changes after the time given by
+//	                                    the after parameter, ie 2006-01-02T15:04:05Z
+//
+// Commands answer with the state of the source as JSON, or redirect to the
+// state of the sources if the html parameter is set.
+func harvestAdminHandler(h *harvester, base string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h == nil {
+			http.Error(w, "no harvester; this is a replica", http.StatusNotFound)
+			return
+		}
+		paths := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(paths) == 2 && r.Method == "GET":
+			w.Header().Set("Content-Type", "text/html")
+			data := struct {
+				Base    string
+				Sources []sourceStatus
+			}{base, h.Status()}
+			if err := harvestAdminTmpl.Execute(w, data); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		case len(paths) == 3 && paths[2] == "status" && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(h.Status()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		case len(paths) == 3 && paths[2] == "runs" && r.Method == "GET":
+			serveHarvestRuns(w, r, h.db)
+			return
+		case len(paths) == 4 && paths[2] == "runs" && r.Method == "GET":
+			id, err := strconv.ParseUint(paths[3], 10, 64)
+			if err != nil {
+				http.Error(w, "usage: /admin/harvest/runs/:id", http.StatusBadRequest)
+				return
+			}
+			run, pages, err := h.db.HarvestRun(id)
+			if err == storage.ErrNotFound {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res := struct {
+				storage.HarvestRun
+				Journal []storage.HarvestPage
+			}{run, pages}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&res); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		case len(paths) != 4 || r.Method != "POST":
+			http.Error(w, "usage: POST /admin/harvest/:source/(pause|resume|poll|reset|after)", http.StatusBadRequest)
+			return
+		}
+
+		name := paths[2]
+		var err error
+		switch paths[3] {
+		case "pause":
+			err = h.Pause(name)
+		case "resume":
+			err = h.Resume(name)
+		case "poll":
+			err = h.Poll(name)
+		case "reset":
+			err = h.SetCursor(name, "")
+		case "after":
+			t, perr := parseTime(r.FormValue("after"))
+			if perr != nil {
+				http.Error(w, "after must be a time, ie 2006-01-02T15:04:05Z or 2006-01-02", http.StatusBadRequest)
+				return
+			}
+			err = h.SetAfter(name, t)
+		default:
+			http.Error(w, "unknown command "+paths[3], http.StatusBadRequest)
+			return
+		}
+		switch {
+		case err == errPaused:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err == errUnknownSource:
+			http.Error(w, fmt.Sprintf("%v: %q", err, name), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("harvester %s: %s requested by %s", name, paths[3], r.RemoteAddr)
+
+		if r.FormValue("html") != "" {
+			http.Redirect(w, r, base+"/admin/harvest", http.StatusSeeOther)
+			return
+		}
+		for _, st := range h.Status() {
+			if st.Name == name {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(&st); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+			}
+		}
+	})
+}
+
+// serveHarvestRuns serves the journal of harvest runs, newest first.
+func serveHarvestRuns(w http.ResponseWriter, r *http.Request, db *storage.DB) {
+	var before uint64
+	if b := r.URL.Query().Get("before"); b != "" {
+		var err error
+		if before, err = strconv.ParseUint(b, 10, 64); err != nil {
+			http.Error(w, "before must be a run ID", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be an integer >= 1", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	total, runs, err := db.HarvestRuns(r.URL.Query().Get("source"), before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Total int
+		Runs  []storage.HarvestRun
+	}{total, runs}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// parseTime parses a time as RFC 3339, or a date.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func indexStatsHandler(db *storage.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths := strings.Split(r.URL.Path, "/")
+		if len(paths) != 4 || paths[3] == "" {
+			http.Error(w, "usage: /stats/index/:name", http.StatusBadRequest)
+			return
+		}
+		top, limit := 20, 100
+		for param, v := range map[string]*int{"top": &top, "limit": &limit} {
+			if s := r.URL.Query().Get(param); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < 0 {
+					http.Error(w, param+" must be an integer >= 0", http.StatusBadRequest)
+					return
+				}
+				*v = n
+			}
+		}
+
+		stats, err := db.IndexStats(paths[3], top, limit)
+		if err == storage.ErrNotFound {
+			http.Error(w, "index not found: "+paths[3], http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&stats); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// imageHandler serves product images, at paths relative to /img/:
+//
+//	:id              the source image, or resized with ?w=&h=&fmt=
+//	:id/:derivative  thumbnail, medium or large, with ?fmt=
+//	:id/:file        an image file as downloaded
+func imageHandler(imgDir string) http.Handler {
+	files := http.FileServer(http.Dir(imgDir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		paths := strings.Split(r.URL.Path, "/")
+		if _, err := strconv.ParseUint(paths[0], 10, 32); err != nil {
+			http.Error(w, "usage: /img/:id[/:size]", http.StatusBadRequest)
+			return
+		}
+		dir := filepath.Join(imgDir, paths[0])
+		if len(paths) == 1 || len(paths) == 2 && paths[1] == "" {
+			serveImage(w, r, dir)
+			return
+		}
+		if d, ok := derivativeNamed(paths[1]); ok && len(paths) == 2 {
+			serveResized(w, r, dir, d.name, d.w, d.h)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// serveImage serves the source image of the product with the given image
+// directory, resized if any of the parameters w, h or fmt are given.
+// The requested width and height are rounded up to one of imageSizes.
+func serveImage(w http.ResponseWriter, r *http.Request, dir string) {
+	q := r.URL.Query()
+	if q.Get("w") == "" && q.Get("h") == "" && q.Get("fmt") == "" {
+		path, err := sourceImage(dir)
+		if err == errNoImage {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	var size [2]int
+	for i, param := range []string{"w", "h"} {
+		s := q.Get(param)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, param+" must be an integer > 0", http.StatusBadRequest)
+			return
+		}
+		size[i] = imageSize(n)
+	}
+	serveResized(w, r, dir, fmt.Sprintf("%dx%d", size[0], size[1]), size[0], size[1])
+}
+
+// serveResized serves the source image resized to fit within width×height,
+// in the format given by the fmt parameter, and kept under the given name.
+// If the image can not be resized, it is served as it is.
+func serveResized(w http.ResponseWriter, r *http.Request, dir, name string, width, height int) {
+	f, err := imageFormatNamed(r.URL.Query().Get("fmt"))
+	if err == errUnavailableFormat {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path, err := resizedImage(dir, name, width, height, f)
+	if err == errNoImage {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("resizing image in %s: %v", dir, err)
+		if path, err = sourceImage(dir); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.ServeFile(w, r, path)
+}
+
+// resourceHandler serves the images and other supporting resources of
+// products, at paths relative to /resource/:
+//
+//	:id              the downloaded resources, as JSON
+//	:id/:type        the resource of a type, such as frontcover or sample;
+//	                 images may be resized with ?w=&h=&fmt=
+//	:id/:type/:file  a file of the type as downloaded
+func resourceHandler(db *storage.DB, imgDir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		paths := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+		id, err := strconv.ParseUint(paths[0], 10, 32)
+		if err != nil || len(paths) > 3 {
+			http.Error(w, "usage: /resource/:id[/:type[/:file]]", http.StatusBadRequest)
+			return
+		}
+		if len(paths) == 1 {
+			serveResources(w, db, uint32(id))
+			return
+		}
+
+		dir := filepath.Join(imgDir, paths[0])
+		if typ := paths[1]; typ != "frontcover" {
+			if !validResourceType(typ) {
+				http.NotFound(w, r)
+				return
+			}
+			dir = filepath.Join(dir, typ)
+		}
+		if len(paths) == 2 {
+			serveImage(w, r, dir)
+			return
+		}
+		name := paths[2]
+		if name == "" || name[0] == '.' || name == sizesDir {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, name))
+	})
+}
+
+// serveResources serves the records of the downloaded resources of the
+// product, with the paths they are served at.
+func serveResources(w http.ResponseWriter, db *storage.DB, id uint32) {
+	imgs, err := db.Images(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type resource struct {
+		storage.Image
+		Path string // relative to /resource/
+	}
+	res := make([]resource, 0, len(imgs))
+	for _, img := range imgs {
+		typ := img.Resource
+		if typ == "" {
+			typ = "frontcover"
+		}
+		res = append(res, resource{Image: img, Path: fmt.Sprintf("%d/%s/%s", id, typ, img.Name)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// imageUsageHandler serves a report of the disk usage of images by type.
+func imageUsageHandler(imgDir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if imgDir == "" {
+			http.Error(w, "images are not downloaded", http.StatusNotFound)
+			return
+		}
+		products, usage, err := imageDiskUsage(imgDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := struct {
+			Products int // with an image directory
+			Files    int
+			Bytes    int64
+			Types    []imageUsage
+		}{Products: products, Types: usage}
+		for _, u := range usage {
+			res.Files += u.Files
+			res.Bytes += u.Bytes
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(&res); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 	})
@@ -222,8 +1080,7 @@ func imgByIsbnHandler(db *storage.DB, imgdir string) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		imgPath := fmt.Sprintf("%s/%d/org.jpg", imgdir, ids[0])
-		http.ServeFile(w, r, imgPath)
+		serveImage(w, r, filepath.Join(imgdir, strconv.Itoa(int(ids[0]))))
 	})
 }
 
@@ -245,8 +1102,7 @@ func imgByEANHandler(db *storage.DB, imgdir string) http.Handler {
 			http.NotFound(w, r)
 			return
 		}
-		imgPath := fmt.Sprintf("%s/%d/org.jpg", imgdir, ids[0])
-		http.ServeFile(w, r, imgPath)
+		serveImage(w, r, filepath.Join(imgdir, strconv.Itoa(int(ids[0]))))
 	})
 }
 
@@ -256,11 +1112,17 @@ type page struct {
 }
 
 type searchResults struct {
-	Hits  []Hit
-	Total int
-	Query string
-	Took  string
-	Pages []page
+	Hits       []Hit
+	Total      int
+	Query      string
+	Took       string
+	Pages      []page
+	Collapse   bool
+	Base       string   // path prefix of the catalogue
+	Action     string   // path to submit searches to
+	Catalogues []string // catalogues to search when spanning several
+	Flags      []string // only include records with these flags
+	NoFlags    []string // exclude records with these flags
 }
 
 type Hit struct {
@@ -279,104 +1141,145 @@ type Hit struct {
 	PublishedYear    string
 	Desc             []string
 	HasImage         bool
+	Resources        []hitResource // downloaded, other than front covers
+	Work             string
+	Manifestations   int
+	Catalogue        string
+	Base             string
+	Flags            []string
+	Source           string
+}
+
+// hitResource is a downloaded supporting resource of a search hit.
+type hitResource struct {
+	Type string // as given by resourceType
+	Name string
+	Kind string // image, audio, video or document
 }
 
-func extractRes(p *onix.Product, id uint32) (hit Hit) {
+// extractRes extracts a search hit from the record. Fields which cannot be
+// extracted are left empty and returned as errors.
+func extractRes(p *onix.Product, id uint32) (hit Hit, errs []fieldError) {
+	var fe fieldErrors
 	hit.ID = strconv.Itoa(int(id))
-	for _, id := range p.ProductIdentifier {
-		if id.ProductIDType.Value == list5.ISBN13 {
-			hit.ISBN = id.IDValue.Value
-		}
-	}
-	hit.Format = list150.MustItem(p.DescriptiveDetail.ProductForm.Value, codes.Norwegian).Label
-	for _, c := range p.DescriptiveDetail.Collection {
-		for _, t := range c.TitleDetail {
-			for _, tt := range t.TitleElement {
-				if tt.TitleText != nil {
-					hit.Collection = append(hit.Collection, tt.TitleText.Value)
-				}
+	hit.Contributors = make(map[string][]string)
+	fe.do("ProductIdentifier", func() {
+		for _, id := range p.ProductIdentifier {
+			if id.ProductIDType.Value == list5.ISBN13 {
+				hit.ISBN = id.IDValue.Value
 			}
 		}
-	}
+	})
 
-	for _, t := range p.DescriptiveDetail.TitleDetail {
-		if t.TitleType.Value == list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource {
-			hit.Title = t.TitleElement[0].TitleText.Value
-			if t.TitleElement[0].Subtitle != nil {
-				hit.Subtitles = append(hit.Subtitles, t.TitleElement[0].Subtitle.Value)
+	if d := p.DescriptiveDetail; d != nil {
+		fe.do("ProductForm", func() {
+			hit.Format = fe.label("ProductForm", list150.Item, d.ProductForm.Value)
+		})
+		fe.do("Collection", func() {
+			for _, c := range d.Collection {
+				for _, t := range c.TitleDetail {
+					for _, tt := range t.TitleElement {
+						if tt.TitleText != nil {
+							hit.Collection = append(hit.Collection, tt.TitleText.Value)
+						}
+					}
+				}
 			}
-		}
-		if t.TitleType.Value == list15.TitleInOriginalLanguage {
-			hit.OriginalTitle = t.TitleElement[0].TitleText.Value
-			if t.TitleElement[0].Subtitle != nil {
-				hit.OriginalTitle = fmt.Sprintf("%s : %s", hit.OriginalTitle, t.TitleElement[0].Subtitle.Value)
+		})
+
+		fe.do("TitleDetail", func() {
+			for _, t := range d.TitleDetail {
+				if t.TitleType.Value == list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource {
+					hit.Title = t.TitleElement[0].TitleText.Value
+					if t.TitleElement[0].Subtitle != nil {
+						hit.Subtitles = append(hit.Subtitles, t.TitleElement[0].Subtitle.Value)
+					}
+				}
+				if t.TitleType.Value == list15.TitleInOriginalLanguage {
+					hit.OriginalTitle = t.TitleElement[0].TitleText.Value
+					if t.TitleElement[0].Subtitle != nil {
+						hit.OriginalTitle = fmt.Sprintf("%s : %s", hit.OriginalTitle, t.TitleElement[0].Subtitle.Value)
+					}
+				}
 			}
-		}
-	}
+		})
 
-	for _, l := range p.DescriptiveDetail.Language {
-		if l.LanguageRole.Value == list22.LanguageOfText {
-			hit.Language = list74.MustItem(l.LanguageCode.Value, codes.Norwegian).Label
-		} else if l.LanguageRole.Value == list22.OriginalLanguageOfATranslatedText {
-			hit.OriginalLanguage = list74.MustItem(l.LanguageCode.Value, codes.Norwegian).Label
-		}
-	}
+		fe.do("Language", func() {
+			for _, l := range d.Language {
+				if l.LanguageRole.Value == list22.LanguageOfText {
+					hit.Language = fe.label("Language", list74.Item, l.LanguageCode.Value)
+				} else if l.LanguageRole.Value == list22.OriginalLanguageOfATranslatedText {
+					hit.OriginalLanguage = fe.label("Language", list74.Item, l.LanguageCode.Value)
+				}
+			}
+		})
 
-	for _, p := range p.PublishingDetail.Publisher {
-		hit.Publisher = p.PublisherName.Value
-		break
-	}
-	for _, d := range p.PublishingDetail.PublishingDate {
-		if d.PublishingDateRole.Value == list163.LastReprintDate {
-			// TODO research other date roles
-			hit.PublishedYear = d.Date.Value
-			break
-		}
-		// TODO list163.DateOfFirstPublication ?
-	}
+		fe.do("Subject", func() {
+			subjects := make(map[string]bool)
+			for _, s := range d.Subject {
+				for _, st := range s.SubjectHeadingText {
+					if subjects[st.Value] {
+						// We don't want to display duplicate subjects
+						continue
+					}
+					hit.Subjects = append(hit.Subjects, st.Value)
+					subjects[st.Value] = true
+				}
+			}
+		})
 
-	subjects := make(map[string]bool)
-	for _, s := range p.DescriptiveDetail.Subject {
-		for _, st := range s.SubjectHeadingText {
-			if subjects[st.Value] {
-				// We don't want to display duplicate subjects
-				continue
+		fe.do("Contributor", func() {
+			for _, c := range d.Contributor {
+				for _, role := range c.ContributorRole {
+					roleLabel := fe.label("ContributorRole", list17.Item, role.Value)
+					agentName := ""
+					if c.PersonNameInverted != nil {
+						agentName = c.PersonNameInverted.Value
+					} else if c.PersonName != nil {
+						agentName = c.PersonName.Value
+					} else if c.CorporateName != nil {
+						agentName = c.CorporateName.Value
+					} else if c.CorporateNameInverted != nil {
+						agentName = c.CorporateNameInverted.Value
+					}
+					hit.Contributors[roleLabel] = append(hit.Contributors[roleLabel], agentName)
+				}
 			}
-			hit.Subjects = append(hit.Subjects, st.Value)
-			subjects[st.Value] = true
-		}
+		})
 	}
 
-	hit.Contributors = make(map[string][]string)
-	for _, c := range p.DescriptiveDetail.Contributor {
-		for _, role := range c.ContributorRole {
-			roleLabel := list17.MustItem(role.Value, codes.Norwegian).Label
-			agentName := ""
-			if c.PersonNameInverted != nil {
-				agentName = c.PersonNameInverted.Value
-			} else if c.PersonName != nil {
-				agentName = c.PersonName.Value
-			} else if c.CorporateName != nil {
-				agentName = c.CorporateName.Value
-			} else if c.CorporateNameInverted != nil {
-				agentName = c.CorporateNameInverted.Value
-			}
-			hit.Contributors[roleLabel] = append(hit.Contributors[roleLabel], agentName)
-		}
-
+	if d := p.PublishingDetail; d != nil {
+		fe.do("Publisher", func() {
+			for _, p := range d.Publisher {
+				hit.Publisher = p.PublisherName.Value
+				break
+			}
+		})
+		fe.do("PublishingDate", func() {
+			for _, d := range d.PublishingDate {
+				if d.PublishingDateRole.Value == list163.LastReprintDate {
+					// TODO research other date roles
+					hit.PublishedYear = d.Date.Value
+					break
+				}
+				// TODO list163.DateOfFirstPublication ?
+			}
+		})
 	}
 
 	if p.CollateralDetail != nil {
-		for _, tc := range p.CollateralDetail.TextContent {
-			for _, t := range tc.Text {
-				hit.Desc = append(hit.Desc, html.UnescapeString(t.Value))
+		fe.do("TextContent", func() {
+			for _, tc := range p.CollateralDetail.TextContent {
+				for _, t := range tc.Text {
+					hit.Desc = append(hit.Desc, html.UnescapeString(t.Value))
+				}
 			}
-		}
+		})
 	}
 
 	// Unescape escaped xml characters in selected fields:
 	hit.Title = html.UnescapeString(hit.Title)
 	hit.Publisher = html.UnescapeString(hit.Publisher) // aschehoug &amp; co
 
-	return hit
+	return hit, fe
 }
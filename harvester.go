@@ -2,16 +2,12 @@ package main
 
 import (
 	"bytes"
-	"encoding/xml"
 	"errors"
-	"io"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
-	"path/filepath"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
@@ -22,244 +18,508 @@ import (
 
 type harvester struct {
 	db           *storage.DB
-	endpoint     string
-	authEndpoint string
-	username     string
-	password     string
+	sources      []*harvestSource
 	imageDir     string
-	next         string
-	token        string
 	ignoreCursor bool
-	batchSize    int
-	start        time.Time
+	unknownRef   string        // policy for block updates of unknown records
+	policy       policy        // nil for defaultPolicy
+	validator    validator     // rules products must satisfy to be stored
+	imageWorkers int           // images downloaded in parallel; defaultImageWorkers if 0
+	imageWake    chan struct{} // signals runImages that images are queued
+
+	mu sync.Mutex // serializes processing of products
+}
+
+// defaultSource is the name of the source when only one is configured.
+const defaultSource = "default"
+
+// reservedSourceNames are the words of the harvest admin paths, which would
+// shadow a source of the same name.
+var reservedSourceNames = map[string]bool{"runs": true, "status": true}
+
+// harvestSource is a named source being harvested.
+type harvestSource struct {
+	name         string
+	typ          string
+	src          Source
+	client       *http.Client // also used to download images
 	pollInterval time.Duration
-	hasImage     *roaring.Bitmap
+	spool        bool // copy batches to a temporary file before decoding
+	breaker      breaker
+	wake         chan struct{}        // interrupts the wait for the next attempt
+	run          *storage.HarvestRun  // journal of the current run; used by runSource only
+	failed       *storage.HarvestPage // journal of the last page, if it failed; used by runSource only
+
+	mu        sync.Mutex
+	status    sourceStatus
+	newCursor *string // set by SetCursor, to be used with the next fetch
 }
 
-func (h *harvester) Run() {
-	if h.endpoint == "" || h.authEndpoint == "" || h.username == "" || h.password == "" {
-		log.Printf("harvester: missing parameters, will not start")
-		return
+// sourceStatus is the state of harvesting a source, as shown on /stats and
+// /admin/harvest.
+type sourceStatus struct {
+	Name          string
+	Type          string
+	Cursor        string
+	Started       time.Time // start of the current or last fetch
+	Harvested     int       // products handled since startup
+	LastSuccess   time.Time // end of the last successful fetch
+	LastError     string    // of the last failed fetch, kept after recovering
+	LastErrorTime time.Time
+	Failures      int       // consecutive failed fetches
+	Retries       int       // products in the retry queue
+	Unhealthy     bool      // persistently failing; the circuit is open
+	NextPoll      time.Time // zero unless waiting for the next attempt
+	Paused        bool
+
+	// Products handled in the current run, which lasts until there are no
+	// more batches to fetch at once, and in the last completed run.
+	RunRecords     int
+	LastRunRecords int
+}
+
+// newHarvestSource creates the source described by the configuration,
+// using defaults for unset retries, timeouts and token TTL.
+func newHarvestSource(c sourceConfig) (*harvestSource, error) {
+	for _, d := range []struct {
+		v   *time.Duration
+		def time.Duration
+	}{
+		{&c.Cooldown.Duration, defaultCooldown},
+		{&c.ConnectTimeout.Duration, defaultConnectTimeout},
+		{&c.ReadTimeout.Duration, defaultReadTimeout},
+		{&c.TokenTTL.Duration, defaultTokenTTL},
+	} {
+		if *d.v == 0 {
+			*d.v = d.def
+		}
+	}
+	if c.Retries == 0 {
+		c.Retries = defaultRetries
+	}
+	client := newHTTPClient(c.ConnectTimeout.Duration, c.ReadTimeout.Duration)
+	src, err := newSource(c, client)
+	if err != nil {
+		return nil, err
 	}
+	typ := c.Type
+	if typ == "" {
+		typ = sourceBoknett
+	}
+	return &harvestSource{
+		name:         c.Name,
+		typ:          typ,
+		src:          src,
+		client:       client,
+		pollInterval: c.PollInterval.Duration,
+		spool:        c.Spool,
+		breaker:      breaker{retries: c.Retries, cooldown: c.Cooldown.Duration},
+		wake:         make(chan struct{}, 1),
+		status:       sourceStatus{Name: c.Name, Type: typ},
+	}, nil
+}
+
+// cursorKey is the meta key of the source's cursor. The default source uses
+// the key of the single cursor kept before there were several sources.
+func (s *harvestSource) cursorKey() []byte {
+	if s.name == defaultSource {
+		return []byte("next")
+	}
+	return []byte("source." + s.name + ".cursor")
+}
+
+func (s *harvestSource) startKey() []byte {
+	return []byte("source." + s.name + ".started")
+}
 
+func (s *harvestSource) update(fn func(*sourceStatus)) {
+	s.mu.Lock()
+	fn(&s.status)
+	s.mu.Unlock()
+}
+
+// Healthy reports whether no source is persistently failing.
+func (h *harvester) Healthy() bool {
+	for _, st := range h.Status() {
+		if st.Unhealthy {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the state of harvesting each source.
+func (h *harvester) Status() []sourceStatus {
+	if h == nil {
+		return nil
+	}
+	res := make([]sourceStatus, 0, len(h.sources))
+	for _, s := range h.sources {
+		s.mu.Lock()
+		st := s.status
+		s.mu.Unlock()
+		st.Retries, _, _ = h.db.Retries(s.name, 1)
+		res = append(res, st)
+	}
+	return res
+}
+
+// Run harvests all sources concurrently, and downloads their images.
+func (h *harvester) Run() {
 	// Create image directory if it doesn't already exist
 	if _, err := os.Stat(h.imageDir); os.IsNotExist(err) {
 		os.Mkdir(h.imageDir, 0777)
 	}
+	go h.runImages()
+	go h.sweepImages()
+
+	if len(h.sources) == 0 {
+		log.Printf("harvester: no source configured, will not start")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range h.sources {
+		wg.Add(1)
+		go func(s *harvestSource) {
+			defer wg.Done()
+			h.runSource(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (h *harvester) runSource(s *harvestSource) {
+	logf := func(format string, v ...interface{}) {
+		log.Printf("harvester %s: "+format, append([]interface{}{s.name}, v...)...)
+	}
 
 	if h.ignoreCursor {
-		log.Println("harvester: ignoring stored cursor")
-		h.db.MetaSet([]byte("next"), []byte(""))
+		logf("ignoring stored cursor")
+		h.db.MetaSet(s.cursorKey(), []byte(""))
 	}
 	// Load stored next cursor
-	b, err := h.db.MetaGet([]byte("next"))
-	if err != nil {
-		log.Printf("harvester: failed to read stored next cursor: %v", err)
-	} else {
-		if next := string(b); next != "" {
-			log.Printf("harvester: continuing using next cursor: %q", next)
-			h.next = string(b)
-		}
+	var cursor string
+	b, err := h.db.MetaGet(s.cursorKey())
+	if err != nil && err != storage.ErrNotFound {
+		logf("failed to read stored next cursor: %v", err)
+	} else if cursor = string(b); cursor != "" {
+		logf("continuing using next cursor: %q", cursor)
 	}
-
-	// Reset image map
-	h.hasImage = roaring.New()
+	s.update(func(st *sourceStatus) { st.Cursor = cursor })
 
 	for {
-		res, err := h.getRecords()
-		if err != nil {
-			log.Printf("harvester: failed to get records: %v", err)
-			log.Println("trying again in 10 seconds")
-			time.Sleep(10 * time.Second)
-			continue
+		s.waitWhilePaused()
+		if c, ok := s.takeCursor(); ok {
+			logf("cursor set to %q", c)
+			if err := h.db.MetaSet(s.cursorKey(), []byte(c)); err != nil {
+				logf("failed to save cursor: %v", err)
+			}
+			cursor = c
+			s.update(func(st *sourceStatus) { st.Cursor = cursor })
 		}
 
-		if res.StatusCode != http.StatusOK {
-			log.Printf("harvester: request failed: %v", res.Status)
-			b, _ := ioutil.ReadAll(res.Body)
-			log.Println(string(b))
-			h.token = ""                            // to obtain a new token in next loop iteration
-			time.Sleep(30 * time.Second)            // as not to bomb server on repeating failure
-			h.start = time.Now().Add(-harvestStart) // to fix potential date daylight transition errro
-			continue
+		start := time.Now()
+		s.update(func(st *sourceStatus) { st.Started, st.NextPoll = start, time.Time{} })
+		if err := h.db.MetaSet(s.startKey(), []byte(start.UTC().Format(time.RFC3339))); err != nil {
+			logf("failed to save start time: %v", err)
 		}
 
-		h.next = res.Header.Get("Next")
-
-		// Prosessing the response can take quite some time, so we are copying the
-		// whole response as not to risk the connection beeing reset by peer.
-		var body bytes.Buffer
-		io.Copy(&body, res.Body)
-		res.Body.Close()
-
-		dec := xml.NewDecoder(&body)
-		n := 0
-		for {
-			t, _ := dec.Token()
-			if t == nil {
-				break
-			}
-			switch se := t.(type) {
-			case xml.StartElement:
-				if se.Name.Local == "Product" {
-					var p *onix.Product
-					if err := dec.DecodeElement(&p, &se); err != nil {
-						log.Printf("harvester: xml parsing error: %v", err)
-						continue
-					}
-
-					if err := h.handleProduct(p); err != nil {
-						log.Printf("harvester: error storing product: %v", err)
-					} else {
-						n++
-					}
-				}
+		page := storage.HarvestPage{Start: start, CursorBefore: cursor}
+		bat, err := s.src.Fetch(cursor)
+		if err == nil {
+			var res storage.HarvestPage
+			if res, err = h.harvestBatch(s, cursor, bat); err == nil {
+				n := res.Stored + res.Deleted + res.Skipped
+				cursor = bat.Cursor
+				logf("done processing %d records", n)
+				s.update(func(st *sourceStatus) {
+					st.Cursor = cursor
+					st.Harvested += n
+					st.RunRecords += n
+				})
+				page.CursorAfter, page.HarvestCounts, page.Errors = cursor, res.HarvestCounts, res.Errors
 			}
 		}
-
-		if res.Header.Get("Link") == "" {
-			// No more records
-			h.next = ""
-		}
-		// Store which products have images
-		hasImages := roaring.New()
-		b, err := h.db.MetaGet([]byte("hasImage"))
-		if err != nil && err != storage.ErrNotFound {
-			log.Printf("harvester: failed to read image set: %v\nharvester: stopping", err)
-			return
-		}
-		if b != nil {
-			if _, err := hasImages.ReadFrom(bytes.NewReader(b)); err != nil {
-				log.Printf("harvester: failed to read image set: %v\nharvester: stopping", err)
-				return
-			}
+		if jerr := h.journal(s, page, err, err == nil && !bat.More); jerr != nil {
+			logf("failed to journal harvested page: %v", jerr)
 		}
-		hasImages = roaring.Or(hasImages, h.hasImage)
-		ib, err := hasImages.MarshalBinary()
 		if err != nil {
-			log.Printf("harvester: failed to save image set: %v\nharvester: stopping", err)
-			return
-		}
-
-		if err := h.db.MetaSet([]byte("hasImage"), ib); err != nil {
-			log.Printf("harvester: failed to save image set: %v\nharvester: stopping", err)
-			return
+			wait := s.breaker.failure()
+			if s.breaker.open() {
+				logf("failed to harvest records %d times in a row, marking as unhealthy: %v", s.breaker.failures, err)
+			} else {
+				logf("failed to harvest records: %v", err)
+			}
+			logf("trying again in %v", wait.Round(time.Second))
+			s.update(func(st *sourceStatus) {
+				st.LastError = err.Error()
+				st.LastErrorTime = time.Now()
+				st.Failures = s.breaker.failures
+				st.Unhealthy = s.breaker.open()
+				st.NextPoll = time.Now().Add(wait)
+			})
+			s.sleep(wait)
+			continue
 		}
-
-		// Store next cursor
-		if err := h.db.MetaSet([]byte("next"), []byte(h.next)); err != nil {
-			log.Printf("harvester: failed to save next cursor: %v\nharvester: stopping", err)
-			return
+		if s.breaker.open() {
+			logf("recovered after %d failures", s.breaker.failures)
 		}
+		s.breaker.success()
+		s.update(func(st *sourceStatus) {
+			st.LastSuccess = time.Now()
+			st.Failures = 0
+			st.Unhealthy = false
+		})
 
-		log.Printf("harvester: done processing %d records", n)
-
-		if h.next != "" {
+		if bat.More {
 			continue
 		}
-		h.start = time.Now()
 
-		log.Printf("harvester: sleeping %v before attempting to harvest again", h.pollInterval)
-		time.Sleep(h.pollInterval)
+		logf("sleeping %v before attempting to harvest again", s.pollInterval)
+		s.update(func(st *sourceStatus) {
+			st.LastRunRecords, st.RunRecords = st.RunRecords, 0
+			st.NextPoll = time.Now().Add(s.pollInterval)
+		})
+		s.sleep(s.pollInterval)
 	}
-
 }
 
-func (h *harvester) getRecords() (*http.Response, error) {
-	if h.token == "" {
-		if err := h.getToken(); err != nil {
-			return nil, err
-		}
+// journal records a harvested page in the source's current run, starting a
+// run if there is none, and ending it if done. The products of a page which
+// failed were not committed, so only its error is recorded. Failed attempts
+// in a row at the same batch are recorded as one page.
+func (h *harvester) journal(s *harvestSource, page storage.HarvestPage, err error, done bool) error {
+	page.Start, page.End = page.Start.UTC(), time.Now().UTC()
+	if s.run == nil {
+		s.run = &storage.HarvestRun{Source: s.name, Start: page.Start, CursorBefore: page.CursorBefore}
 	}
-	req, err := http.NewRequest("GET", h.endpoint, nil)
+	run := s.run
 	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	req.Header.Set("Authorization", "Boknett "+h.token)
-
-	q := req.URL.Query()
-	if h.next != "" {
-		q.Add("next", h.next)
+		page.Error, run.Error = err.Error(), err.Error()
+		page.Attempts = 1
+		if prev := s.failed; prev != nil && prev.CursorBefore == page.CursorBefore {
+			page.Start, page.Attempts = prev.Start, prev.Attempts+1
+			run.Pages--
+		}
+		s.failed = &page
 	} else {
-		q.Add("after", h.start.Format("20060102150405")) // yyyyMMddHHmmss
+		s.failed = nil
+		run.CursorAfter = page.CursorAfter
+		run.HarvestCounts.Add(page.HarvestCounts)
+		run.Errors = sampleErrors(run.Errors, page.Errors...)
 	}
-	q.Add("subscription", "extended")
-	q.Add("pagesize", strconv.Itoa(h.batchSize))
-	req.URL.RawQuery = q.Encode()
-
-	return http.DefaultClient.Do(req)
+	run.Pages++
+	if done {
+		run.End = page.End
+		s.run = nil
+	}
+	return h.db.Journal(run, page)
 }
 
-func (h *harvester) getToken() error {
-	res, err := http.PostForm(h.authEndpoint,
-		url.Values{"username": {h.username}, "password": {h.password}})
+// updateImageSet changes the stored set of products which have images.
+func updateImageSet(tx *storage.Tx, fn func(hasImages *roaring.Bitmap)) error {
+	hasImages := roaring.New()
+	b, err := tx.MetaGet([]byte("hasImage"))
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if b != nil {
+		if _, err := hasImages.ReadFrom(bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	fn(hasImages)
+	ib, err := hasImages.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	res.Body.Close()
-	if res.StatusCode != http.StatusCreated {
-		return errors.New(res.Status)
+	return tx.MetaSet([]byte("hasImage"), ib)
+}
+
+// process validates and handles a product decoded from raw, in a transaction
+// of its own. Products which could not be decoded, or which fail
+// validation, are quarantined.
+func (h *harvester) process(p *onix.Product, raw rawProduct, decodeErr error) (a action, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err = h.db.Batch(func(tx *storage.Tx) error {
+		var err error
+		a, _, err = h.processTx(tx, p, raw, decodeErr)
+		return err
+	})
+	if err == nil && a == actionStored {
+		h.wakeImages()
 	}
-	h.token = res.Header.Get("Boknett-TGT")
-	return nil
+	return a, err
 }
 
-func (h *harvester) handleProduct(p *onix.Product) error {
-	switch p.NotificationType.Value {
-	case list1.AdvanceNotificationConfirmed, list1.NotificationConfirmedOnPublication:
-		// OK store and index
-	case list1.Delete:
-		if err := h.db.DeleteByRef(p.RecordReference.Value); err != nil && err != storage.ErrNotFound {
-			log.Printf("delete record with ref %q failed: %v", p.RecordReference.Value, err)
+// processTx is like process, within the transaction tx. The images of
+// stored products are queued to be downloaded. For quarantined products,
+// the reason is also returned.
+func (h *harvester) processTx(tx *storage.Tx, p *onix.Product, raw rawProduct, err error) (action, string, error) {
+	if err == nil {
+		switch p.NotificationType.Value {
+		case list1.Delete:
+			// Deletions only need a RecordReference
+		case list1.UpdatePartial:
+			// Validated after merging with the stored product, or as it is
+			// if stored as a new record; see handleNotification
+		default:
+			err = h.validator.Validate(p)
 		}
-		return nil
-	default:
-		log.Printf("TODO handle notification: %v", p.NotificationType.Value)
-		return nil
 	}
-	id, err := h.db.Store(p)
+	if err == nil {
+		var (
+			id uint32
+			a  action
+		)
+		id, a, err = h.handleNotification(tx, p, raw.Source)
+		if err == nil && a == actionStored {
+			err = h.queueImages(tx, raw.Source, id, p)
+		}
+		if _, ok := err.(validationError); !ok {
+			return a, "", err
+		}
+	}
+
+	q := storage.Quarantined{Release: raw.Release, Source: raw.Source, Error: err.Error(), Raw: string(raw.XML)}
+	if p != nil {
+		q.Ref = p.RecordReference.Value
+	}
+	id, err := tx.Quarantine(q)
 	if err != nil {
-		return err
+		return actionSkipped, "", err
+	}
+	tx.OnCommit(func() { log.Printf("harvester: quarantined product %q as %d: %v", q.Ref, id, q.Error) })
+	return actionQuarantined, q.Error, nil
+}
+
+// reprocess processes a quarantined product again, using the current rules.
+func (h *harvester) reprocess(id uint64) (action, error) {
+	q, err := h.db.QuarantinedProduct(id)
+	if err != nil {
+		return actionSkipped, err
 	}
+	raw := rawProduct{XML: []byte(q.Raw), Release: q.Release, Source: q.Source}
+	p, decodeErr := decodeProduct(raw)
 
-	imgDir := filepath.Join(h.imageDir, strconv.Itoa(int(id)))
-	if _, err := os.Stat(imgDir); os.IsNotExist(err) {
-		if err2 := os.Mkdir(imgDir, 0777); err2 != nil {
-			return err2
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var a action
+	err = h.db.Batch(func(tx *storage.Tx) error {
+		if err := tx.Unquarantine(id); err != nil {
+			return err
 		}
+		var err error
+		a, _, err = h.processTx(tx, p, raw, decodeErr)
+		return err
+	})
+	if err == nil && a == actionStored {
+		h.wakeImages()
 	}
+	return a, err
+}
 
-	for _, link := range extractLinks(p) {
-		if err := h.download(filepath.Join(imgDir, link[0]), link[1]); err != nil {
-			log.Printf("err downloading file %q: %v", link[1], err)
-			continue
-		}
-		h.hasImage.Add(id)
+// action is the outcome of handling a product notification.
+type action int
+
+func (a action) String() string {
+	switch a {
+	case actionStored:
+		return "stored"
+	case actionDeleted:
+		return "deleted"
+	case actionQuarantined:
+		return "quarantined"
 	}
-	return nil
+	return "skipped"
 }
 
-func (h *harvester) download(path, url string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
+const (
+	actionSkipped action = iota
+	actionStored
+	actionDeleted
+	actionQuarantined
+)
+
+// handleNotification stores or deletes the product according to its
+// NotificationType and the harvester's policy, returning the ID of the
+// product and what was done. Stored products are attributed to the named
+// source. Block updates of records which are not stored are handled
+// according to the unknownRef policy.
+func (h *harvester) handleNotification(tx *storage.Tx, p *onix.Product, source string) (uint32, action, error) {
+	pol := h.policy
+	if pol == nil {
+		pol = defaultPolicy
 	}
-	defer f.Close()
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
+	switch p.NotificationType.Value {
+	case list1.EarlyNotification, list1.AdvanceNotificationConfirmed, list1.NotificationConfirmedOnPublication,
+		list1.NoticeOfSale, list1.NoticeOfAcquisition:
+		// Stored according to policy below
+	case list1.Delete:
+		return h.delete(tx, p.RecordReference.Value)
+	case list1.UpdatePartial:
+		var decision string
+		id, err := tx.UpdateFrom(source, p.RecordReference.Value, func(stored *onix.Product) error {
+			mergeBlocks(stored, p)
+			if err := h.validator.Validate(stored); err != nil {
+				return err
+			}
+			if decision, _ = pol.decide(stored); decision == policyDelete {
+				return errDeleteRecord
+			}
+			return nil
+		})
+		switch err {
+		case nil:
+			return id, actionStored, nil
+		case errDeleteRecord:
+			return h.delete(tx, p.RecordReference.Value)
+		case storage.ErrNotFound:
+			// handled below
+		default:
+			return 0, actionSkipped, err
+		}
+		switch h.unknownRef {
+		case unknownRefStore:
+			// Store the partial record, which has not been validated yet
+			if err := h.validator.Validate(p); err != nil {
+				return 0, actionSkipped, err
+			}
+		case unknownRefReject:
+			return 0, actionSkipped, retryableError{fmt.Errorf("%v: %q", errUnknownRef, p.RecordReference.Value)}
+		default:
+			log.Printf("skipping block update of unknown record %q", p.RecordReference.Value)
+			return 0, actionSkipped, nil
+		}
+	default:
+		log.Printf("skipping record %q with unknown notification type: %q", p.RecordReference.Value, p.NotificationType.Value)
+		return 0, actionSkipped, nil
 	}
-	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
-	req.Header.Set("Authorization", "Boknett "+h.token)
-	resp, err := http.DefaultClient.Do(req)
+
+	if decision, _ := pol.decide(p); decision == policyDelete {
+		return h.delete(tx, p.RecordReference.Value)
+	}
+	id, err := tx.StoreFrom(source, p)
 	if err != nil {
-		return err
+		return 0, actionSkipped, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+	return id, actionStored, nil
+}
+
+// errDeleteRecord aborts an update of a record which is to be deleted.
+var errDeleteRecord = errors.New("record to be deleted")
+
+func (h *harvester) delete(tx *storage.Tx, ref string) (uint32, action, error) {
+	id := tx.Ref(ref)
+	if err := tx.DeleteByRef(ref); err != nil && err != storage.ErrNotFound {
+		return 0, actionSkipped, fmt.Errorf("delete record with ref %q failed: %v", ref, err)
+	}
+	if id != 0 {
+		if err := h.removeImages(tx, id); err != nil {
+			return 0, actionSkipped, err
+		}
 	}
-	_, err = io.Copy(f, resp.Body)
-	return err
+	return 0, actionDeleted, nil
 }
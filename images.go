@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list159"
+	"github.com/knakk/otra/storage"
+)
+
+const (
+	// defaultImageWorkers is the number of images downloaded in parallel.
+	defaultImageWorkers = 4
+
+	// maxImageAttempts is the number of times an image is tried downloaded
+	// before it is given up.
+	maxImageAttempts = 10
+
+	// imagePollInterval is how often the image queue is checked for
+	// downloads which are due to be retried.
+	imagePollInterval = time.Minute
+
+	// maxImageBytes is the size of the largest image which is downloaded.
+	maxImageBytes = 20 << 20
+
+	// maxResourceBytes is the size of the largest audio, video or text
+	// resource which is downloaded.
+	maxResourceBytes = 200 << 20
+
+	// maxImageName is the length of the longest image, or other resource,
+	// file name.
+	maxImageName = 100
+
+	// imageSweepInterval is how often images of products which are no
+	// longer stored are looked for.
+	imageSweepInterval = 24 * time.Hour
+)
+
+// imageTypes are the accepted types of images, as detected from their
+// content, and their file extensions.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// rejectedError is the error of a downloaded file which is not accepted
+// as an image, or a resource of its mode.
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return "rejected file: " + e.reason
+}
+
+// queueImages queues the images and other supporting resources of a
+// stored product, harvested from the named source, to be downloaded.
+// Queueing a resource again replaces the queued job, so a product stored
+// twice has its resources downloaded once.
+func (h *harvester) queueImages(tx *storage.Tx, source string, id uint32, p *onix.Product) error {
+	if h.imageDir == "" {
+		return nil
+	}
+	for _, r := range extractResources(p) {
+		j := storage.ImageJob{
+			Product:  id,
+			Resource: r.typ,
+			Mode:     r.mode,
+			Name:     resourceName(r.name, r.url, r.mode),
+			URL:      r.url,
+			Source:   source,
+		}
+		if err := tx.QueueImage(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wakeImages makes runImages look for queued images at once.
+func (h *harvester) wakeImages() {
+	select {
+	case h.imageWake <- struct{}{}:
+	default:
+	}
+}
+
+// runImages downloads queued images as they become due.
+func (h *harvester) runImages() {
+	if h.imageDir == "" {
+		return
+	}
+	for {
+		if n, err := h.fetchQueuedImages(); err != nil {
+			log.Printf("harvester: downloading images failed: %v", err)
+		} else if n > 0 {
+			log.Printf("harvester: downloaded %d images", n)
+		}
+		select {
+		case <-h.imageWake:
+		case <-time.After(imagePollInterval):
+		}
+	}
+}
+
+// fetchQueuedImages downloads the queued images which are due, using the
+// configured number of workers, and returns the number downloaded. Failed
+// downloads stay in the queue, to be tried again after a backoff.
+func (h *harvester) fetchQueuedImages() (n int, err error) {
+	_, jobs, err := h.db.ImageJobs(time.Now(), 0)
+	if err != nil || len(jobs) == 0 {
+		return 0, err
+	}
+	workers := h.imageWorkers
+	if workers <= 0 {
+		workers = defaultImageWorkers
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		hasImage = roaring.New()
+		queue    = make(chan storage.ImageJob)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if h.fetchImage(j) {
+					mu.Lock()
+					if j.Resource == "" {
+						hasImage.Add(j.Product)
+					}
+					n++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	if hasImage.IsEmpty() {
+		return n, nil
+	}
+	return n, h.db.Batch(func(tx *storage.Tx) error {
+		return updateImageSet(tx, func(s *roaring.Bitmap) { s.Or(hasImage) })
+	})
+}
+
+// fetchImage downloads a queued image, and removes it from the queue, or
+// reschedules it if the download failed. It reports whether the image was
+// downloaded.
+func (h *harvester) fetchImage(j storage.ImageJob) bool {
+	err := h.downloadImage(j)
+	if err == nil {
+		if err := h.db.RemoveImageJob(j); err != nil {
+			log.Printf("harvester: removing image %q of product %d from queue: %v", j.Name, j.Product, err)
+		}
+		return true
+	}
+
+	j.Attempts++
+	j.Error = err.Error()
+	if j.Attempts >= maxImageAttempts || permanent(err) {
+		log.Printf("harvester: giving up image %q of product %d after %d attempts: %v", j.URL, j.Product, j.Attempts, err)
+		err = h.db.RemoveImageJob(j)
+	} else {
+		wait := backoff(j.Attempts)
+		log.Printf("harvester: downloading image %q of product %d failed, retrying in %v: %v", j.URL, j.Product, wait, err)
+		j.Next = time.Now().Add(wait).UTC()
+		err = h.db.RescheduleImage(j)
+	}
+	if err != nil {
+		log.Printf("harvester: updating image queue: %v", err)
+	}
+	return false
+}
+
+// permanent reports whether a failed download is not worth retrying.
+func permanent(err error) bool {
+	switch err := err.(type) {
+	case *rejectedError:
+		return true
+	case *statusError:
+		switch err.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return false
+		case http.StatusUnauthorized, http.StatusForbidden:
+			// The source's credentials may be expired or not yet valid
+			return false
+		}
+		return err.Code >= 400 && err.Code < 500
+	}
+	return false
+}
+
+// downloadImage downloads a queued image, or other resource, to the
+// product's image directory, and records it. If the file has been
+// downloaded from the same URL before, the request is conditional, and an
+// unchanged file is not downloaded again. Files which are too large, or not
+// of a type accepted for the resource's mode, are rejected.
+func (h *harvester) downloadImage(j storage.ImageJob) error {
+	if j.Name != resourceName(j.Name, j.URL, j.Mode) {
+		return &rejectedError{fmt.Sprintf("unsafe file name %q", j.Name)}
+	}
+	if j.Resource != "" && !validResourceType(j.Resource) {
+		return &rejectedError{fmt.Sprintf("unsafe resource type %q", j.Resource)}
+	}
+	dir := filepath.Join(h.imageDir, strconv.Itoa(int(j.Product)))
+	path := filepath.Join(dir, filepath.FromSlash(j.Path()))
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", j.URL, nil)
+	if err != nil {
+		return err
+	}
+	prev, err := h.db.Image(j.Product, j.Path())
+	switch err {
+	case nil:
+		if _, err := os.Stat(path); err != nil || prev.URL != j.URL {
+			break
+		}
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	case storage.ErrNotFound:
+	default:
+		return err
+	}
+
+	var res *http.Response
+	for retried := false; ; retried = true {
+		client, err := h.authorize(j.Source, req)
+		if err != nil {
+			return err
+		}
+		if res, err = client.Do(req); err != nil {
+			return err
+		}
+		if res.StatusCode == http.StatusUnauthorized && !retried && h.expireToken(j.Source) {
+			res.Body.Close()
+			continue
+		}
+		break
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if etag := res.Header.Get("ETag"); etag != "" {
+			prev.ETag = etag
+		}
+		if lm := res.Header.Get("Last-Modified"); lm != "" {
+			prev.LastModified = lm
+		}
+		prev.Time = time.Now().UTC()
+		return h.db.SetImage(prev)
+	default:
+		return &statusError{Code: res.StatusCode, Status: res.Status}
+	}
+	if res.ContentLength > maxBytes(j.Mode) {
+		return &rejectedError{fmt.Sprintf("%d bytes", res.ContentLength)}
+	}
+
+	// Write to a temporary file first, so a failed or rejected download
+	// does not replace a previous version of the file.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".download")
+	if err != nil {
+		return err
+	}
+	img, err := writeResource(f, res.Body, j.Mode, res.Header.Get("Content-Type"), j.Name)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	img.Product, img.Resource, img.Name, img.URL = j.Product, j.Resource, j.Name, j.URL
+	img.ETag, img.LastModified = res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	img.Time = time.Now().UTC()
+	if j.Resource == "" {
+		if err := makeDerivatives(dir); err != nil {
+			// Served unresized, or resized on request, instead
+			log.Printf("harvester: making derivatives of images of product %d: %v", j.Product, err)
+		}
+	}
+	return h.db.SetImage(img)
+}
+
+// maxBytes returns the size of the largest resource of the given
+// ResourceMode which is downloaded.
+func maxBytes(mode string) int64 {
+	if _, ok := resourceExts[mode]; !ok || mode == list159.Image {
+		return maxImageBytes
+	}
+	return maxResourceBytes
+}
+
+// writeResource copies a resource of the given ResourceMode from r to f,
+// checking its type and size, and the dimensions of images, and returns
+// what was found. The file's name and the Content-Type declared for it
+// are used for audio whose type can not be detected from its content.
+func writeResource(f *os.File, r io.Reader, mode, declared, name string) (img storage.Image, err error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return img, err
+	}
+	head = head[:n]
+	img.Type = http.DetectContentType(head)
+	if mode == list159.Audio {
+		img.Type = audioType(img.Type, declared, name)
+	}
+	if !acceptedType(mode, img.Type) {
+		return img, &rejectedError{"content type " + img.Type}
+	}
+	max := maxBytes(mode)
+
+	sum := sha256.New()
+	w := io.MultiWriter(f, sum)
+	if _, err := w.Write(head); err != nil {
+		return img, err
+	}
+	rest, err := io.Copy(w, io.LimitReader(r, max-int64(n)+1))
+	if err != nil {
+		return img, err
+	}
+	if img.Size = int64(n) + rest; img.Size > max {
+		return img, &rejectedError{fmt.Sprintf("larger than %d bytes", max)}
+	}
+	img.Checksum = hex.EncodeToString(sum.Sum(nil))
+	if _, ok := imageTypes[img.Type]; !ok {
+		return img, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return img, err
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	switch {
+	case err == nil:
+		img.Width, img.Height = cfg.Width, cfg.Height
+		if img.Width*img.Height > maxImagePixels {
+			return img, &rejectedError{fmt.Sprintf("%dx%d pixels", img.Width, img.Height)}
+		}
+	case img.Type == "image/webp":
+		// Not decodable unless built with the webp tag
+	default:
+		return img, &rejectedError{err.Error()}
+	}
+	return img, nil
+}
+
+// removeImages removes the images of a deleted product from the image set,
+// and its image directory once the deletion is committed.
+func (h *harvester) removeImages(tx *storage.Tx, id uint32) error {
+	if err := updateImageSet(tx, func(s *roaring.Bitmap) { s.Remove(id) }); err != nil {
+		return err
+	}
+	if h.imageDir == "" {
+		return nil
+	}
+	tx.OnCommit(func() {
+		if err := os.RemoveAll(filepath.Join(h.imageDir, strconv.Itoa(int(id)))); err != nil {
+			log.Printf("harvester: removing images of product %d: %v", id, err)
+		}
+	})
+	return nil
+}
+
+// sweepImages periodically removes the images of products which are no
+// longer stored, such as products deleted while their images were being
+// downloaded.
+func (h *harvester) sweepImages() {
+	if h.imageDir == "" {
+		return
+	}
+	for {
+		n, err := h.sweepImagesOnce()
+		if err != nil {
+			log.Printf("harvester: sweeping images failed: %v", err)
+		} else if n > 0 {
+			log.Printf("harvester: removed images of %d products which are no longer stored", n)
+		}
+		time.Sleep(imageSweepInterval)
+	}
+}
+
+// sweepImagesOnce removes the image directories, image records and image
+// set entries of products which are not stored, returning the number of
+// directories removed.
+func (h *harvester) sweepImagesOnce() (n int, err error) {
+	gone := func(id uint32) bool {
+		_, err := h.db.Get(id)
+		return err == storage.ErrNotFound || err == storage.ErrDeleted
+	}
+
+	files, err := ioutil.ReadDir(h.imageDir)
+	if err != nil {
+		return 0, err
+	}
+	for _, fi := range files {
+		id, err := strconv.ParseUint(fi.Name(), 10, 32)
+		if err != nil || !fi.IsDir() || !gone(uint32(id)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(h.imageDir, fi.Name())); err != nil {
+			return n, err
+		}
+		if err := h.db.RemoveImagesOf(uint32(id)); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	orphans := roaring.New()
+	it := loadImageSet(h.db).Iterator()
+	for it.HasNext() {
+		if id := it.Next(); gone(id) {
+			orphans.Add(id)
+		}
+	}
+	if orphans.IsEmpty() {
+		return n, nil
+	}
+	return n, h.db.Batch(func(tx *storage.Tx) error {
+		return updateImageSet(tx, func(s *roaring.Bitmap) { s.AndNot(orphans) })
+	})
+}
+
+// imageUsage is the disk usage of images, or other resources, of a type.
+type imageUsage struct {
+	Type    string
+	Derived bool `json:",omitempty"` // derivatives and resized images
+	Files   int
+	Bytes   int64
+}
+
+// imageDiskUsage returns the disk usage of the files in dir by type, the
+// largest first, along with the number of products with an image directory.
+func imageDiskUsage(dir string) (products int, usage []imageUsage, err error) {
+	types := make(map[imageUsage]*imageUsage)
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if filepath.Dir(path) == dir {
+				products++
+			}
+			return nil
+		}
+		key := imageUsage{Type: "other", Derived: filepath.Base(filepath.Dir(path)) == sizesDir}
+		if typ := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); typ != "" {
+			key.Type, _, _ = mime.ParseMediaType(typ)
+		}
+		u, ok := types[key]
+		if !ok {
+			u = &imageUsage{Type: key.Type, Derived: key.Derived}
+			types[key] = u
+		}
+		u.Files++
+		u.Bytes += fi.Size()
+		return nil
+	})
+	for _, u := range types {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Bytes > usage[j].Bytes })
+	return products, usage, err
+}
+
+// authorize authorizes the request as required by the named source,
+// returning the client to send it with.
+func (h *harvester) authorize(source string, req *http.Request) (*http.Client, error) {
+	for _, s := range h.sources {
+		if s.name != source {
+			continue
+		}
+		if a, ok := s.src.(requestAuthorizer); ok {
+			if err := a.authorize(req); err != nil {
+				return nil, err
+			}
+		}
+		return s.client, nil
+	}
+	return http.DefaultClient, nil
+}
+
+// expireToken makes the named source obtain a new token for its next
+// request, reporting whether it authorizes requests.
+func (h *harvester) expireToken(source string) bool {
+	for _, s := range h.sources {
+		if a, ok := s.src.(requestAuthorizer); ok && s.name == source {
+			a.expireToken()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+// importStats counts the outcome of importing products.
+type importStats struct {
+	stored, deleted, skipped, quarantined, failed int
+}
+
+func (s importStats) String() string {
+	return fmt.Sprintf("%d stored, %d deleted, %d skipped, %d quarantined, %d failed",
+		s.stored, s.deleted, s.skipped, s.quarantined, s.failed)
+}
+
+// importer loads products from local ONIX files, handling them like the harvester.
+type importer struct {
+	h        *harvester
+	progress int // log progress every n products
+	stats    importStats
+}
+
+// runImport implements the import command, which loads products from ONIX files
+// given as files, directories or glob patterns, without starting the server.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		dbFile     = fs.String("db", "otra.db", "database file")
+		imgDir     = fs.String("img", "", "download images to this directory (default no images)")
+		imgWorkers = fs.Int("img-workers", defaultImageWorkers, "number of images downloaded in parallel")
+		progress   = fs.Int("progress", 1000, "report progress every n products")
+		unknownRef = fs.String("unknown-ref", unknownRefSkip, "policy for block updates of unknown records: skip, store or reject")
+		policyFile = fs.String("policy", "", "file with rules for storing, flagging or hiding records (default built-in rules)")
+		validate   = fs.String("validate", strings.Join(defaultValidation, ","), "comma-separated validation rules products must satisfy")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s import [flags] <files|dirs|globs>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("import: no files given")
+	}
+	if err := validUnknownRefPolicy(*unknownRef); err != nil {
+		return fmt.Errorf("import: %v", err)
+	}
+
+	files, err := importFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	pol := defaultPolicy
+	if *policyFile != "" {
+		if pol, err = loadPolicy(*policyFile); err != nil {
+			return fmt.Errorf("import: %v", err)
+		}
+	}
+
+	v, err := newValidator(splitList(*validate))
+	if err != nil {
+		return fmt.Errorf("import: %v", err)
+	}
+
+	db, err := storage.Open(*dbFile, pol.indexFn((*problemLog)(nil).indexFn(indexFn)))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetWorkFn(workFn)
+
+	if *imgDir != "" {
+		if _, err := os.Stat(*imgDir); os.IsNotExist(err) {
+			if err := os.Mkdir(*imgDir, 0777); err != nil {
+				return err
+			}
+		}
+	}
+
+	imp := &importer{
+		h:        &harvester{db: db, imageDir: *imgDir, imageWorkers: *imgWorkers, unknownRef: *unknownRef, policy: pol, validator: v},
+		progress: *progress,
+	}
+	start := time.Now()
+	for _, f := range files {
+		if err := imp.importFile(f); err != nil {
+			log.Printf("import: %s: %v", f, err)
+		}
+	}
+	if n, err := imp.h.fetchQueuedImages(); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("import: downloaded %d images", n)
+	}
+	log.Printf("import: done importing %d file(s) in %v: %v", len(files), time.Since(start), imp.stats)
+	return nil
+}
+
+// importFiles expands the given arguments into a list of files. Directories
+// are walked recursively for .xml, .gz and .zip files.
+func importFiles(args []string) (files []string, err error) {
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("import: no such file: %s", arg)
+		}
+		for _, m := range matches {
+			err := filepath.Walk(m, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				if path == m || isImportable(path) {
+					files = append(files, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+func isImportable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xml", ".onx", ".gz", ".zip":
+		return true
+	}
+	return false
+}
+
+// importFile imports the products in a file, which may be gzipped or a zip archive.
+func (imp *importer) importFile(path string) error {
+	if strings.ToLower(filepath.Ext(path)) == ".zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() || !isImportable(zf.Name) {
+				continue
+			}
+			if err := imp.importZipEntry(path, zf); err != nil {
+				log.Printf("import: %s: %s: %v", path, zf.Name, err)
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return imp.importReader(path, f, strings.ToLower(filepath.Ext(path)) == ".gz")
+}
+
+func (imp *importer) importZipEntry(path string, zf *zip.File) error {
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return imp.importReader(path+":"+zf.Name, r, strings.ToLower(filepath.Ext(zf.Name)) == ".gz")
+}
+
+func (imp *importer) importReader(name string, r io.Reader, gzipped bool) error {
+	if gzipped {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	before := imp.stats
+	n := 0
+	err := decodeProducts(r, func(p *onix.Product, raw rawProduct, err error) error {
+		n++
+		switch action, err := imp.h.process(p, raw, err); {
+		case err != nil:
+			imp.stats.failed++
+			log.Printf("import: %s: product #%d: %v", name, n, err)
+		case action == actionStored:
+			imp.stats.stored++
+		case action == actionDeleted:
+			imp.stats.deleted++
+		case action == actionQuarantined:
+			imp.stats.quarantined++
+		default:
+			imp.stats.skipped++
+		}
+		if imp.progress > 0 && n%imp.progress == 0 {
+			log.Printf("import: %s: processed %d products", name, n)
+		}
+		return nil
+	})
+	done := importStats{
+		stored:      imp.stats.stored - before.stored,
+		deleted:     imp.stats.deleted - before.deleted,
+		skipped:     imp.stats.skipped - before.skipped,
+		quarantined: imp.stats.quarantined - before.quarantined,
+		failed:      imp.stats.failed - before.failed,
+	}
+	log.Printf("import: %s: %v", name, done)
+	return err
+}
@@ -0,0 +1,515 @@
+package onix21
+
+import (
+	"path"
+	"sort"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list159"
+	"github.com/knakk/kbp/onix/codes/list162"
+)
+
+// textTypes maps ONIX 2.1 text type codes (list 33) to ONIX 3.0 (list 153).
+var textTypes = map[string]string{
+	"01": "03", // Main description => Description
+	"02": "02", // Short description/annotation
+	"03": "03", // Long description => Description
+	"04": "04", // Table of contents
+	"08": "06", // Review quote
+	"13": "12", // Biographical note
+	"23": "14", // Excerpt from book
+}
+
+// textTypes30 maps ONIX 3.0 text type codes to ONIX 2.1.
+var textTypes30 = map[string]string{
+	"02": "02",
+	"03": "01",
+	"04": "04",
+	"06": "08",
+	"12": "13",
+	"14": "23",
+}
+
+// ToProduct converts an ONIX 2.1 product to ONIX 3.0. It returns the names
+// of the elements which could not be converted.
+func ToProduct(p *Product) (*onix.Product, []string) {
+	var r report
+	for _, e := range p.Other {
+		r.add(e.XMLName.Local)
+	}
+
+	res := &onix.Product{
+		RecordReference:  onix.RecordReference{Value: p.RecordReference},
+		NotificationType: onix.NotificationType{Value: p.NotificationType},
+	}
+	for _, id := range p.ProductIdentifier {
+		res.ProductIdentifier = append(res.ProductIdentifier, toProductIdentifier(id))
+	}
+
+	dd := &onix.DescriptiveDetail{
+		ProductComposition: onix.ProductComposition{Value: "00"}, // Single-item retail product
+		ProductForm:        onix.ProductForm{Value: p.ProductForm},
+	}
+	for _, f := range p.ProductFormDetail {
+		dd.ProductFormDetail = append(dd.ProductFormDetail, onix.ProductFormDetail{Value: f})
+	}
+	for _, s := range p.Series {
+		if s.TitleOfSeries == "" {
+			r.add("Series")
+			continue
+		}
+		te := onix.TitleElement{
+			TitleElementLevel: onix.TitleElementLevel{Value: "02"}, // Collection level
+			TitleText:         &onix.TitleText{Value: s.TitleOfSeries},
+		}
+		if s.NumberWithinSeries != "" {
+			te.PartNumber = &onix.PartNumber{Value: s.NumberWithinSeries}
+		}
+		dd.Collection = append(dd.Collection, onix.Collection{
+			CollectionType: onix.CollectionType{Value: "10"}, // Publisher collection
+			TitleDetail: []onix.TitleDetail{
+				{
+					TitleType:    onix.TitleType{Value: "01"},
+					TitleElement: []onix.TitleElement{te},
+				},
+			},
+		})
+	}
+	if p.DistinctiveTitle != "" {
+		dd.TitleDetail = append(dd.TitleDetail, toTitleDetail(Title{TitleType: "01", TitleText: p.DistinctiveTitle}))
+	}
+	for _, t := range p.Title {
+		dd.TitleDetail = append(dd.TitleDetail, toTitleDetail(t))
+	}
+	for _, c := range p.Contributor {
+		dd.Contributor = append(dd.Contributor, toContributor(c))
+	}
+	if p.EditionNumber != "" {
+		dd.EditionNumber = &onix.EditionNumber{Value: p.EditionNumber}
+	}
+	for _, l := range p.Language {
+		dd.Language = append(dd.Language, onix.Language{
+			LanguageRole: onix.LanguageRole{Value: l.LanguageRole},
+			LanguageCode: onix.LanguageCode{Value: l.LanguageCode},
+		})
+	}
+	for _, s := range p.MainSubject {
+		s.SubjectSchemeIdentifier = s.MainSubjectSchemeIdentifier
+		dd.Subject = append(dd.Subject, toSubject(s))
+	}
+	for _, s := range p.Subject {
+		dd.Subject = append(dd.Subject, toSubject(s))
+	}
+	res.DescriptiveDetail = dd
+
+	var cd onix.CollateralDetail
+	for _, t := range p.OtherText {
+		tt, ok := textTypes[t.TextTypeCode]
+		if !ok {
+			r.add("OtherText/TextTypeCode=" + t.TextTypeCode)
+			continue
+		}
+		cd.TextContent = append(cd.TextContent, onix.TextContent{
+			TextType:        onix.TextType{Value: tt},
+			ContentAudience: []onix.ContentAudience{{Value: "00"}}, // Unrestricted
+			Text:            []onix.Text{{Value: t.Text}},
+		})
+	}
+	for _, m := range p.MediaFile {
+		// Only front cover images linked by URL are supported
+		if (m.MediaFileTypeCode != "04" && m.MediaFileTypeCode != "06") || m.MediaFileLinkTypeCode != "01" {
+			r.add("MediaFile/MediaFileTypeCode=" + m.MediaFileTypeCode)
+			continue
+		}
+		cd.SupportingResource = append(cd.SupportingResource, onix.SupportingResource{
+			ResourceContentType: onix.ResourceContentType{Value: "01"}, // Front cover
+			ContentAudience:     []onix.ContentAudience{{Value: "00"}},
+			ResourceMode:        onix.ResourceMode{Value: list159.Image},
+			ResourceVersion: []onix.ResourceVersion{
+				{
+					ResourceForm: onix.ResourceForm{Value: "02"}, // Downloadable file
+					ResourceVersionFeature: []onix.ResourceVersionFeature{
+						{
+							ResourceVersionFeatureType: onix.ResourceVersionFeatureType{Value: list162.Filename},
+							FeatureNote:                []onix.FeatureNote{{Value: path.Base(m.MediaFileLink)}},
+						},
+					},
+					ResourceLink: []onix.ResourceLink{{Value: m.MediaFileLink}},
+				},
+			},
+		})
+	}
+	if len(cd.TextContent) > 0 || len(cd.SupportingResource) > 0 {
+		res.CollateralDetail = &cd
+	}
+
+	pd := &onix.PublishingDetail{}
+	for _, imp := range p.Imprint {
+		pd.Imprint = append(pd.Imprint, onix.Imprint{ImprintName: &onix.ImprintName{Value: imp.ImprintName}})
+	}
+	for _, pub := range p.Publisher {
+		role := pub.PublishingRole
+		if role == "" {
+			role = "01" // Publisher
+		}
+		pd.Publisher = append(pd.Publisher, onix.Publisher{
+			PublishingRole: onix.PublishingRole{Value: role},
+			PublisherName:  &onix.PublisherName{Value: pub.PublisherName},
+		})
+	}
+	for _, c := range p.CityOfPublication {
+		pd.CityOfPublication = append(pd.CityOfPublication, onix.CityOfPublication{Value: c})
+	}
+	if p.CountryOfPublication != "" {
+		pd.CountryOfPublication = &onix.CountryOfPublication{Value: p.CountryOfPublication}
+	}
+	if p.PublishingStatus != "" {
+		pd.PublishingStatus = &onix.PublishingStatus{Value: p.PublishingStatus}
+	}
+	if p.PublicationDate != "" {
+		pd.PublishingDate = append(pd.PublishingDate, onix.PublishingDate{
+			PublishingDateRole: onix.PublishingDateRole{Value: "01"}, // Publication date
+			Date:               onix.Date{Value: p.PublicationDate},
+		})
+	}
+	res.PublishingDetail = pd
+
+	if len(p.RelatedProduct) > 0 {
+		rm := &onix.RelatedMaterial{}
+		for _, rp := range p.RelatedProduct {
+			orp := onix.RelatedProduct{
+				ProductRelationCode: []onix.ProductRelationCode{{Value: rp.RelationCode}},
+			}
+			for _, id := range rp.ProductIdentifier {
+				orp.ProductIdentifier = append(orp.ProductIdentifier, toProductIdentifier(id))
+			}
+			rm.RelatedProduct = append(rm.RelatedProduct, orp)
+		}
+		res.RelatedMaterial = rm
+	}
+
+	for _, sd := range p.SupplyDetail {
+		if sd.ProductAvailability == "" {
+			// ProductAvailability is mandatory in ONIX 3.0
+			r.add("SupplyDetail")
+			continue
+		}
+		res.ProductSupply = append(res.ProductSupply, onix.ProductSupply{
+			SupplyDetail: []onix.SupplyDetail{
+				{
+					Supplier: onix.Supplier{
+						SupplierRole: onix.SupplierRole{Value: "00"}, // Unspecified
+						SupplierName: &onix.SupplierName{Value: sd.SupplierName},
+					},
+					ProductAvailability: onix.ProductAvailability{Value: sd.ProductAvailability},
+				},
+			},
+		})
+	}
+
+	return res, r.list()
+}
+
+func toProductIdentifier(id ProductIdentifier) onix.ProductIdentifier {
+	res := onix.ProductIdentifier{
+		ProductIDType: onix.ProductIDType{Value: id.ProductIDType},
+		IDValue:       onix.IDValue{Value: id.IDValue},
+	}
+	if id.IDTypeName != "" {
+		res.IDTypeName = &onix.IDTypeName{Value: id.IDTypeName}
+	}
+	return res
+}
+
+func toTitleDetail(t Title) onix.TitleDetail {
+	te := onix.TitleElement{
+		TitleElementLevel: onix.TitleElementLevel{Value: "01"}, // Product level
+	}
+	switch {
+	case t.TitleWithoutPrefix != "":
+		if t.TitlePrefix != "" {
+			te.TitlePrefix = &onix.TitlePrefix{Value: t.TitlePrefix}
+		} else {
+			te.NoPrefix = &onix.NoPrefix{}
+		}
+		te.TitleWithoutPrefix = &onix.TitleWithoutPrefix{Value: t.TitleWithoutPrefix}
+	default:
+		te.TitleText = &onix.TitleText{Value: t.TitleText}
+	}
+	if t.Subtitle != "" {
+		te.Subtitle = &onix.Subtitle{Value: t.Subtitle}
+	}
+	return onix.TitleDetail{
+		TitleType:    onix.TitleType{Value: t.TitleType},
+		TitleElement: []onix.TitleElement{te},
+	}
+}
+
+func toContributor(c Contributor) onix.Contributor {
+	var res onix.Contributor
+	if c.SequenceNumber != "" {
+		res.SequenceNumber = &onix.SequenceNumber{Value: c.SequenceNumber}
+	}
+	for _, role := range c.ContributorRole {
+		res.ContributorRole = append(res.ContributorRole, onix.ContributorRole{Value: role})
+	}
+	if c.PersonName != "" {
+		res.PersonName = &onix.PersonName{Value: c.PersonName}
+	}
+	if c.PersonNameInverted != "" {
+		res.PersonNameInverted = &onix.PersonNameInverted{Value: c.PersonNameInverted}
+	}
+	if c.NamesBeforeKey != "" {
+		res.NamesBeforeKey = &onix.NamesBeforeKey{Value: c.NamesBeforeKey}
+	}
+	if c.KeyNames != "" {
+		res.KeyNames = &onix.KeyNames{Value: c.KeyNames}
+	}
+	if c.CorporateName != "" {
+		res.CorporateName = &onix.CorporateName{Value: c.CorporateName}
+	}
+	if c.CorporateNameInverted != "" {
+		res.CorporateNameInverted = &onix.CorporateNameInverted{Value: c.CorporateNameInverted}
+	}
+	return res
+}
+
+func toSubject(s Subject) onix.Subject {
+	res := onix.Subject{
+		SubjectSchemeIdentifier: onix.SubjectSchemeIdentifier{Value: s.SubjectSchemeIdentifier},
+	}
+	if s.SubjectCode != "" {
+		res.SubjectCode = &onix.SubjectCode{Value: s.SubjectCode}
+	}
+	if s.SubjectHeadingText != "" {
+		res.SubjectHeadingText = []onix.SubjectHeadingText{{Value: s.SubjectHeadingText}}
+	}
+	return res
+}
+
+// FromProduct converts an ONIX 3.0 product to ONIX 2.1. It returns the names
+// of the elements which could not be converted.
+func FromProduct(p *onix.Product) (*Product, []string) {
+	var r report
+	res := &Product{
+		RecordReference:  p.RecordReference.Value,
+		NotificationType: p.NotificationType.Value,
+	}
+	for _, id := range p.ProductIdentifier {
+		res.ProductIdentifier = append(res.ProductIdentifier, fromProductIdentifier(id))
+	}
+
+	if dd := p.DescriptiveDetail; dd != nil {
+		res.ProductForm = dd.ProductForm.Value
+		for _, f := range dd.ProductFormDetail {
+			res.ProductFormDetail = append(res.ProductFormDetail, f.Value)
+		}
+		for _, c := range dd.Collection {
+			for _, td := range c.TitleDetail {
+				for _, te := range td.TitleElement {
+					s := Series{TitleOfSeries: titleText(te)}
+					if te.PartNumber != nil {
+						s.NumberWithinSeries = te.PartNumber.Value
+					}
+					res.Series = append(res.Series, s)
+				}
+			}
+		}
+		for _, td := range dd.TitleDetail {
+			for i, te := range td.TitleElement {
+				if i > 0 {
+					// ONIX 2.1 titles have no separate title elements
+					r.add("TitleDetail/TitleElement")
+					break
+				}
+				t := Title{TitleType: td.TitleType.Value}
+				if te.TitleWithoutPrefix != nil {
+					t.TitleWithoutPrefix = te.TitleWithoutPrefix.Value
+					if te.TitlePrefix != nil {
+						t.TitlePrefix = te.TitlePrefix.Value
+					}
+				} else if te.TitleText != nil {
+					t.TitleText = te.TitleText.Value
+				}
+				if te.Subtitle != nil {
+					t.Subtitle = te.Subtitle.Value
+				}
+				res.Title = append(res.Title, t)
+			}
+		}
+		for _, c := range dd.Contributor {
+			res.Contributor = append(res.Contributor, fromContributor(c))
+		}
+		if dd.EditionNumber != nil {
+			res.EditionNumber = dd.EditionNumber.Value
+		}
+		for _, l := range dd.Language {
+			res.Language = append(res.Language, Language{LanguageRole: l.LanguageRole.Value, LanguageCode: l.LanguageCode.Value})
+		}
+		for _, s := range dd.Subject {
+			rs := Subject{SubjectSchemeIdentifier: s.SubjectSchemeIdentifier.Value}
+			if s.SubjectCode != nil {
+				rs.SubjectCode = s.SubjectCode.Value
+			}
+			for i, st := range s.SubjectHeadingText {
+				if i > 0 {
+					r.add("Subject/SubjectHeadingText")
+					break
+				}
+				rs.SubjectHeadingText = st.Value
+			}
+			res.Subject = append(res.Subject, rs)
+		}
+	}
+
+	if cd := p.CollateralDetail; cd != nil {
+		for _, tc := range cd.TextContent {
+			tt, ok := textTypes30[tc.TextType.Value]
+			if !ok {
+				r.add("TextContent/TextType=" + tc.TextType.Value)
+				continue
+			}
+			for _, t := range tc.Text {
+				res.OtherText = append(res.OtherText, OtherText{TextTypeCode: tt, Text: t.Value})
+			}
+		}
+		for _, sr := range cd.SupportingResource {
+			if sr.ResourceContentType.Value != "01" || sr.ResourceMode.Value != list159.Image {
+				r.add("SupportingResource/ResourceContentType=" + sr.ResourceContentType.Value)
+				continue
+			}
+			for _, v := range sr.ResourceVersion {
+				for _, l := range v.ResourceLink {
+					res.MediaFile = append(res.MediaFile, MediaFile{
+						MediaFileTypeCode:     "04", // Image: front cover
+						MediaFileLinkTypeCode: "01", // URL
+						MediaFileLink:         l.Value,
+					})
+				}
+			}
+		}
+	}
+
+	if pd := p.PublishingDetail; pd != nil {
+		for _, imp := range pd.Imprint {
+			if imp.ImprintName != nil {
+				res.Imprint = append(res.Imprint, Imprint{ImprintName: imp.ImprintName.Value})
+			}
+		}
+		for _, pub := range pd.Publisher {
+			if pub.PublisherName != nil {
+				res.Publisher = append(res.Publisher, Publisher{PublishingRole: pub.PublishingRole.Value, PublisherName: pub.PublisherName.Value})
+			}
+		}
+		for _, c := range pd.CityOfPublication {
+			res.CityOfPublication = append(res.CityOfPublication, c.Value)
+		}
+		if pd.CountryOfPublication != nil {
+			res.CountryOfPublication = pd.CountryOfPublication.Value
+		}
+		if pd.PublishingStatus != nil {
+			res.PublishingStatus = pd.PublishingStatus.Value
+		}
+		for _, d := range pd.PublishingDate {
+			if d.PublishingDateRole.Value == "01" {
+				res.PublicationDate = d.Date.Value
+			} else {
+				r.add("PublishingDate/PublishingDateRole=" + d.PublishingDateRole.Value)
+			}
+		}
+	}
+
+	if rm := p.RelatedMaterial; rm != nil {
+		if len(rm.RelatedWork) > 0 {
+			r.add("RelatedWork")
+		}
+		for _, rp := range rm.RelatedProduct {
+			for _, code := range rp.ProductRelationCode {
+				rrp := RelatedProduct{RelationCode: code.Value}
+				for _, id := range rp.ProductIdentifier {
+					rrp.ProductIdentifier = append(rrp.ProductIdentifier, fromProductIdentifier(id))
+				}
+				res.RelatedProduct = append(res.RelatedProduct, rrp)
+			}
+		}
+	}
+
+	for _, ps := range p.ProductSupply {
+		for _, sd := range ps.SupplyDetail {
+			rsd := SupplyDetail{ProductAvailability: sd.ProductAvailability.Value}
+			if sd.Supplier.SupplierName != nil {
+				rsd.SupplierName = sd.Supplier.SupplierName.Value
+			}
+			res.SupplyDetail = append(res.SupplyDetail, rsd)
+		}
+	}
+
+	return res, r.list()
+}
+
+func fromProductIdentifier(id onix.ProductIdentifier) ProductIdentifier {
+	res := ProductIdentifier{ProductIDType: id.ProductIDType.Value, IDValue: id.IDValue.Value}
+	if id.IDTypeName != nil {
+		res.IDTypeName = id.IDTypeName.Value
+	}
+	return res
+}
+
+func fromContributor(c onix.Contributor) Contributor {
+	var res Contributor
+	if c.SequenceNumber != nil {
+		res.SequenceNumber = c.SequenceNumber.Value
+	}
+	for _, role := range c.ContributorRole {
+		res.ContributorRole = append(res.ContributorRole, role.Value)
+	}
+	if c.PersonName != nil {
+		res.PersonName = c.PersonName.Value
+	}
+	if c.PersonNameInverted != nil {
+		res.PersonNameInverted = c.PersonNameInverted.Value
+	}
+	if c.NamesBeforeKey != nil {
+		res.NamesBeforeKey = c.NamesBeforeKey.Value
+	}
+	if c.KeyNames != nil {
+		res.KeyNames = c.KeyNames.Value
+	}
+	if c.CorporateName != nil {
+		res.CorporateName = c.CorporateName.Value
+	}
+	if c.CorporateNameInverted != nil {
+		res.CorporateNameInverted = c.CorporateNameInverted.Value
+	}
+	return res
+}
+
+func titleText(te onix.TitleElement) string {
+	switch {
+	case te.TitleText != nil:
+		return te.TitleText.Value
+	case te.TitleWithoutPrefix != nil && te.TitlePrefix != nil:
+		return te.TitlePrefix.Value + " " + te.TitleWithoutPrefix.Value
+	case te.TitleWithoutPrefix != nil:
+		return te.TitleWithoutPrefix.Value
+	}
+	return ""
+}
+
+// report collects the distinct names of elements which could not be converted.
+type report map[string]bool
+
+func (r *report) add(name string) {
+	if *r == nil {
+		*r = make(report)
+	}
+	(*r)[name] = true
+}
+
+func (r report) list() (res []string) {
+	for name := range r {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,53 @@
+package onix21
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+const sample = `<Product>
+<RecordReference>ref1</RecordReference>
+<NotificationType>03</NotificationType>
+<ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9788203360000</IDValue></ProductIdentifier>
+<ProductForm>BB</ProductForm>
+<Series><TitleOfSeries>Serien</TitleOfSeries><NumberWithinSeries>2</NumberWithinSeries></Series>
+<Title><TitleType>01</TitleType><TitleText>Tittel</TitleText><Subtitle>undertittel</Subtitle></Title>
+<Contributor><SequenceNumber>1</SequenceNumber><ContributorRole>A01</ContributorRole><PersonNameInverted>Jensen, Hans</PersonNameInverted></Contributor>
+<Language><LanguageRole>01</LanguageRole><LanguageCode>nob</LanguageCode></Language>
+<OtherText><TextTypeCode>02</TextTypeCode><Text>Kort omtale</Text></OtherText>
+<MediaFile><MediaFileTypeCode>04</MediaFileTypeCode><MediaFileLinkTypeCode>01</MediaFileLinkTypeCode><MediaFileLink>http://example.org/cover.jpg</MediaFileLink></MediaFile>
+<Publisher><PublishingRole>01</PublishingRole><PublisherName>Forlaget</PublisherName></Publisher>
+<PublicationDate>20190101</PublicationDate>
+<RelatedProduct><RelationCode>06</RelationCode><ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9788203360001</IDValue></ProductIdentifier></RelatedProduct>
+<SupplyDetail><SupplierName>Sentralforlaget</SupplierName><ProductAvailability>21</ProductAvailability></SupplyDetail>
+<SalesRights><SalesRightsType>01</SalesRightsType></SalesRights>
+</Product>`
+
+func TestRoundTrip(t *testing.T) {
+	var p Product
+	if err := xml.Unmarshal([]byte(sample), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	p30, unmapped := ToProduct(&p)
+	if want := []string{"SalesRights"}; !reflect.DeepEqual(unmapped, want) {
+		t.Errorf("ToProduct unmapped => %v; want %v", unmapped, want)
+	}
+	if got := p30.RecordReference.Value; got != "ref1" {
+		t.Errorf("RecordReference => %q; want %q", got, "ref1")
+	}
+	if got := len(p30.CollateralDetail.SupportingResource); got != 1 {
+		t.Errorf("got %d SupportingResource; want 1", got)
+	}
+
+	back, unmapped := FromProduct(p30)
+	if len(unmapped) != 0 {
+		t.Errorf("FromProduct unmapped => %v; want none", unmapped)
+	}
+	p.XMLName, back.XMLName = xml.Name{}, xml.Name{}
+	p.Other = nil
+	if !reflect.DeepEqual(&p, back) {
+		t.Errorf("round trip =>\n%+v\nwant\n%+v", back, &p)
+	}
+}
@@ -0,0 +1,129 @@
+// Package onix21 defines the ONIX for Books 2.1 Product record, limited to
+// the elements otra makes use of, and converts it to and from the ONIX 3.0
+// onix.Product.
+package onix21
+
+import "encoding/xml"
+
+// Message is an ONIX 2.1 message.
+type Message struct {
+	XMLName xml.Name  `xml:"ONIXMessage"`
+	Release string    `xml:"release,attr,omitempty"`
+	Header  Header    `xml:"Header"`
+	Product []Product `xml:"Product"`
+}
+
+// Header is an ONIX 2.1 message header.
+type Header struct {
+	FromCompany string `xml:"FromCompany"`
+	SentDate    string `xml:"SentDate"`
+}
+
+// Product is an ONIX 2.1 product record.
+type Product struct {
+	XMLName              xml.Name            `xml:"Product"`
+	RecordReference      string              `xml:"RecordReference"`
+	NotificationType     string              `xml:"NotificationType"`
+	ProductIdentifier    []ProductIdentifier `xml:"ProductIdentifier"`
+	ProductForm          string              `xml:"ProductForm,omitempty"`
+	ProductFormDetail    []string            `xml:"ProductFormDetail,omitempty"`
+	Series               []Series            `xml:"Series,omitempty"`
+	DistinctiveTitle     string              `xml:"DistinctiveTitle,omitempty"`
+	Title                []Title             `xml:"Title,omitempty"`
+	Contributor          []Contributor       `xml:"Contributor,omitempty"`
+	EditionNumber        string              `xml:"EditionNumber,omitempty"`
+	Language             []Language          `xml:"Language,omitempty"`
+	MainSubject          []Subject           `xml:"MainSubject,omitempty"`
+	Subject              []Subject           `xml:"Subject,omitempty"`
+	OtherText            []OtherText         `xml:"OtherText,omitempty"`
+	MediaFile            []MediaFile         `xml:"MediaFile,omitempty"`
+	Imprint              []Imprint           `xml:"Imprint,omitempty"`
+	Publisher            []Publisher         `xml:"Publisher,omitempty"`
+	CityOfPublication    []string            `xml:"CityOfPublication,omitempty"`
+	CountryOfPublication string              `xml:"CountryOfPublication,omitempty"`
+	PublishingStatus     string              `xml:"PublishingStatus,omitempty"`
+	PublicationDate      string              `xml:"PublicationDate,omitempty"`
+	RelatedProduct       []RelatedProduct    `xml:"RelatedProduct,omitempty"`
+	SupplyDetail         []SupplyDetail      `xml:"SupplyDetail,omitempty"`
+
+	// Other holds elements which are not supported, so that they can be reported.
+	Other []Element `xml:",any"`
+}
+
+// Element is an unsupported element.
+type Element struct {
+	XMLName xml.Name
+}
+
+type ProductIdentifier struct {
+	ProductIDType string `xml:"ProductIDType"`
+	IDTypeName    string `xml:"IDTypeName,omitempty"`
+	IDValue       string `xml:"IDValue"`
+}
+
+type Series struct {
+	TitleOfSeries      string `xml:"TitleOfSeries,omitempty"`
+	NumberWithinSeries string `xml:"NumberWithinSeries,omitempty"`
+}
+
+type Title struct {
+	TitleType          string `xml:"TitleType"`
+	TitleText          string `xml:"TitleText,omitempty"`
+	TitlePrefix        string `xml:"TitlePrefix,omitempty"`
+	TitleWithoutPrefix string `xml:"TitleWithoutPrefix,omitempty"`
+	Subtitle           string `xml:"Subtitle,omitempty"`
+}
+
+type Contributor struct {
+	SequenceNumber        string   `xml:"SequenceNumber,omitempty"`
+	ContributorRole       []string `xml:"ContributorRole"`
+	PersonName            string   `xml:"PersonName,omitempty"`
+	PersonNameInverted    string   `xml:"PersonNameInverted,omitempty"`
+	NamesBeforeKey        string   `xml:"NamesBeforeKey,omitempty"`
+	KeyNames              string   `xml:"KeyNames,omitempty"`
+	CorporateName         string   `xml:"CorporateName,omitempty"`
+	CorporateNameInverted string   `xml:"CorporateNameInverted,omitempty"`
+}
+
+type Language struct {
+	LanguageRole string `xml:"LanguageRole"`
+	LanguageCode string `xml:"LanguageCode"`
+}
+
+// Subject is used for both MainSubject and Subject composites.
+type Subject struct {
+	MainSubjectSchemeIdentifier string `xml:"MainSubjectSchemeIdentifier,omitempty"`
+	SubjectSchemeIdentifier     string `xml:"SubjectSchemeIdentifier,omitempty"`
+	SubjectCode                 string `xml:"SubjectCode,omitempty"`
+	SubjectHeadingText          string `xml:"SubjectHeadingText,omitempty"`
+}
+
+type OtherText struct {
+	TextTypeCode string `xml:"TextTypeCode"`
+	Text         string `xml:"Text"`
+}
+
+type MediaFile struct {
+	MediaFileTypeCode     string `xml:"MediaFileTypeCode"`
+	MediaFileLinkTypeCode string `xml:"MediaFileLinkTypeCode"`
+	MediaFileLink         string `xml:"MediaFileLink"`
+}
+
+type Imprint struct {
+	ImprintName string `xml:"ImprintName"`
+}
+
+type Publisher struct {
+	PublishingRole string `xml:"PublishingRole,omitempty"`
+	PublisherName  string `xml:"PublisherName"`
+}
+
+type RelatedProduct struct {
+	RelationCode      string              `xml:"RelationCode"`
+	ProductIdentifier []ProductIdentifier `xml:"ProductIdentifier"`
+}
+
+type SupplyDetail struct {
+	SupplierName        string `xml:"SupplierName,omitempty"`
+	ProductAvailability string `xml:"ProductAvailability,omitempty"`
+}
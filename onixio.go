@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/onix21"
+)
+
+// rawProduct is the XML of a single product, as read from a message.
+type rawProduct struct {
+	XML     []byte
+	Release string // "2.1" for ONIX 2.1, empty for ONIX 3.0
+	Source  string // name of the source it was harvested from, if any
+}
+
+// maxMalformedTail is the most of a malformed message kept after the last
+// product read from it.
+const maxMalformedTail = 4 << 20
+
+// malformedError is the error of a message which is not well-formed XML.
+type malformedError struct {
+	err     error
+	release string // of the message
+	tail    []byte // the message from the end of the last product read from it
+}
+
+func (e *malformedError) Error() string {
+	return e.err.Error()
+}
+
+// decodeProducts decodes the Product elements of an ONIX message read from r,
+// calling fn for each of them along with its XML. If a product cannot be
+// decoded, fn is called with the error instead. Decoding stops if fn returns
+// an error, or at the first error reading the XML. If the XML is not
+// well-formed, a *malformedError is returned, with up to maxMalformedTail
+// bytes of the message which could not be read. Both reference names and
+// short tags are recognized.
+//
+// ONIX 2.1 messages, as told by messageRelease, are decoded as ONIX 2.1,
+// and converted to ONIX 3.0. Elements which cannot be converted are logged.
+func decodeProducts(r io.Reader, fn func(*onix.Product, rawProduct, error) error) error {
+	rec := &recorder{r: r}
+	in := xml.NewDecoder(rec)
+	dec := xml.NewTokenDecoder(renamer{tr: in, names: referenceNames})
+	release, dtd21 := "", false
+	malformed := func(err error) error {
+		if _, ok := err.(*xml.SyntaxError); !ok {
+			return err
+		}
+		tail := rec.buf
+		if len(tail) > maxMalformedTail {
+			tail = tail[:maxMalformedTail]
+		}
+		rest, _ := ioutil.ReadAll(io.LimitReader(rec.r, int64(maxMalformedTail-len(tail))))
+		return &malformedError{err: err, release: release, tail: append(tail, rest...)}
+	}
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return malformed(err)
+		}
+		if d, ok := t.(xml.Directive); ok && bytes.Contains(d, []byte("onix-international.dtd")) {
+			dtd21 = true
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local == "ONIXMessage" {
+			release = messageRelease(se, dtd21)
+			continue
+		}
+		if se.Name.Local != "Product" {
+			continue
+		}
+		raw := rawProduct{Release: release}
+		var p *onix.Product
+		raw.XML, err = readElement(dec, se)
+		if _, ok := err.(*xml.SyntaxError); ok {
+			return malformed(err)
+		}
+		if err == nil {
+			p, err = decodeProduct(raw)
+		}
+		if err := fn(p, raw, err); err != nil {
+			return err
+		}
+		rec.discard(in.InputOffset())
+	}
+}
+
+// messageRelease returns the release of the message started by se: "2.1"
+// for ONIX 2.1, or empty for ONIX 3.0. The release attribute is required
+// in ONIX 3.0, but optional in ONIX 2.1, so messages without it are ONIX
+// 2.1, unless they use the ONIX 3.0 namespace and not the ONIX 2.1 DTD.
+func messageRelease(se xml.StartElement, dtd21 bool) string {
+	for _, a := range se.Attr {
+		if a.Name.Local == "release" {
+			if strings.HasPrefix(a.Value, "3") {
+				return ""
+			}
+			return "2.1"
+		}
+	}
+	if strings.HasPrefix(se.Name.Space, "http://ns.editeur.org/onix/3.0/") && !dtd21 {
+		return ""
+	}
+	return "2.1"
+}
+
+// recorder is a reader which keeps what is read from r, from the offset
+// last discarded.
+type recorder struct {
+	r   io.Reader
+	buf []byte
+	off int64 // offset of buf
+}
+
+func (rec *recorder) Read(p []byte) (int, error) {
+	n, err := rec.r.Read(p)
+	rec.buf = append(rec.buf, p[:n]...)
+	return n, err
+}
+
+// discard drops what was read before offset.
+func (rec *recorder) discard(offset int64) {
+	n := copy(rec.buf, rec.buf[offset-rec.off:])
+	rec.buf = rec.buf[:n]
+	rec.off = offset
+}
+
+// readElement reads the element started by se, returning its XML without
+// namespaces. If the XML is malformed, the XML read so far is returned
+// along with the error.
+func readElement(dec *xml.Decoder, se xml.StartElement) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	var t xml.Token = se
+	for depth := 0; ; {
+		switch tok := t.(type) {
+		case xml.StartElement:
+			depth++
+			tok.Name.Space = ""
+			attrs := tok.Attr[:0:0]
+			for _, a := range tok.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+					continue
+				}
+				a.Name.Space = ""
+				attrs = append(attrs, a)
+			}
+			tok.Attr = attrs
+			t = tok
+		case xml.EndElement:
+			depth--
+			tok.Name.Space = ""
+			t = tok
+		case xml.ProcInst, xml.Directive:
+			t = nil
+		}
+		if t != nil {
+			if err := enc.EncodeToken(t); err != nil {
+				return buf.Bytes(), err
+			}
+		}
+		if depth == 0 {
+			break
+		}
+		var err error
+		if t, err = dec.Token(); err != nil {
+			enc.Flush()
+			return buf.Bytes(), err
+		}
+	}
+	err := enc.Flush()
+	return buf.Bytes(), err
+}
+
+// decodeProduct decodes the XML of a product, converting it to ONIX 3.0 if needed.
+func decodeProduct(raw rawProduct) (*onix.Product, error) {
+	if raw.Release == "2.1" {
+		var p21 onix21.Product
+		if err := xml.Unmarshal(raw.XML, &p21); err != nil {
+			return nil, err
+		}
+		p, unmapped := onix21.ToProduct(&p21)
+		if len(unmapped) > 0 {
+			log.Printf("onix 2.1: record %s: elements not converted: %s", p21.RecordReference, strings.Join(unmapped, ", "))
+		}
+		return p, nil
+	}
+	var p *onix.Product
+	if err := xml.Unmarshal(raw.XML, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// legacyRelease reports whether ONIX 2.1 output was requested.
+func legacyRelease(r *http.Request) bool {
+	return r.FormValue("release") == "2.1"
+}
+
+// toONIX21 converts products to ONIX 2.1. The elements which could not be
+// converted are listed in the X-Onix-Unmapped response header.
+func toONIX21(w http.ResponseWriter, recs []*onix.Product) []onix21.Product {
+	res := make([]onix21.Product, 0, len(recs))
+	unmapped := make(map[string]bool)
+	for _, rec := range recs {
+		p, missing := onix21.FromProduct(rec)
+		for _, m := range missing {
+			unmapped[m] = true
+		}
+		res = append(res, *p)
+	}
+	if len(unmapped) > 0 {
+		names := make([]string, 0, len(unmapped))
+		for m := range unmapped {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		w.Header().Set("X-Onix-Unmapped", strings.Join(names, ", "))
+	}
+	return res
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+)
+
+func TestMessageRelease(t *testing.T) {
+	const product = `<Product><RecordReference>r</RecordReference></Product>`
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{`<ONIXMessage release="3.0">` + product + `</ONIXMessage>`, ""},
+		{`<ONIXMessage release="3.1">` + product + `</ONIXMessage>`, ""},
+		{`<ONIXMessage release="2.1">` + product + `</ONIXMessage>`, "2.1"},
+		{`<ONIXMessage>` + product + `</ONIXMessage>`, "2.1"},
+		{`<ONIXMessage xmlns="http://ns.editeur.org/onix/3.0/reference">` + product + `</ONIXMessage>`, ""},
+		{`<ONIXMessage xmlns="http://www.editeur.org/onix/2.1/reference">` + product + `</ONIXMessage>`, "2.1"},
+		{`<?xml version="1.0"?><!DOCTYPE ONIXMessage SYSTEM "http://www.editeur.org/onix/2.1/reference/onix-international.dtd">` +
+			`<ONIXMessage xmlns="http://ns.editeur.org/onix/3.0/reference">` + product + `</ONIXMessage>`, "2.1"},
+		{`<ONIXmessage xmlns="http://ns.editeur.org/onix/3.0/short"><product><a001>r</a001></product></ONIXmessage>`, ""},
+		{`<ONIXmessage><product><a001>r</a001></product></ONIXmessage>`, "2.1"},
+	}
+	for _, test := range tests {
+		var got []string
+		err := decodeProducts(strings.NewReader(test.msg), func(p *onix.Product, raw rawProduct, err error) error {
+			if err != nil {
+				return err
+			}
+			got = append(got, raw.Release)
+			return nil
+		})
+		if err != nil || len(got) != 1 || got[0] != test.want {
+			t.Errorf("release of %s => %q, %v; want %q", test.msg, got, err, test.want)
+		}
+	}
+}
+
+func TestDecodeProducts(t *testing.T) {
+	decode := func(msg string) (refs []string, raws []rawProduct, err error) {
+		err = decodeProducts(strings.NewReader(msg), func(p *onix.Product, raw rawProduct, err error) error {
+			if err != nil {
+				return err
+			}
+			refs = append(refs, p.RecordReference.Value)
+			raws = append(raws, raw)
+			return nil
+		})
+		return refs, raws, err
+	}
+
+	// Reference names and short tags are decoded alike, and the XML kept of
+	// each product decodes to the same product
+	tests := []struct {
+		msg  string
+		refs string
+	}{
+		{`<ONIXMessage release="3.0"><Header/><Product><RecordReference>a</RecordReference></Product>` +
+			`<Product><RecordReference>b</RecordReference></Product></ONIXMessage>`, "a b"},
+		{`<ONIXmessage release="3.0"><header/><product><a001>a</a001></product>` +
+			`<product><a001>b</a001><descriptivedetail><b012>BB</b012></descriptivedetail></product></ONIXmessage>`, "a b"},
+		{`<ONIXMessage><Product><RecordReference>a</RecordReference><ProductForm>BB</ProductForm></Product></ONIXMessage>`, "a"},
+		{`<Envelope><ONIXMessage release="3.0"><Product><RecordReference>a</RecordReference></Product></ONIXMessage></Envelope>`, "a"},
+		{`<ONIXMessage release="3.0"></ONIXMessage>`, ""},
+	}
+	for _, test := range tests {
+		refs, raws, err := decode(test.msg)
+		if err != nil || strings.Join(refs, " ") != test.refs {
+			t.Errorf("decodeProducts(%s) => %q, %v; want %s", test.msg, refs, err, test.refs)
+			continue
+		}
+		for i, raw := range raws {
+			if p, err := decodeProduct(raw); err != nil || p.RecordReference.Value != refs[i] {
+				t.Errorf("decodeProduct(%s) => %v; want product %s", raw.XML, err, refs[i])
+			}
+		}
+	}
+
+	// ONIX 2.1 products are converted
+	if _, raws, err := decode(tests[2].msg); err == nil {
+		p, err := decodeProduct(raws[0])
+		if err != nil || p.DescriptiveDetail == nil || p.DescriptiveDetail.ProductForm.Value != "BB" {
+			t.Errorf("converted ONIX 2.1 product => %+v, %v; want product form BB", p, err)
+		}
+	}
+
+	// Decoding stops at the first error of fn
+	errStop := errors.New("stop")
+	n := 0
+	err := decodeProducts(strings.NewReader(tests[0].msg), func(*onix.Product, rawProduct, error) error {
+		n++
+		return errStop
+	})
+	if err != errStop || n != 1 {
+		t.Errorf("decodeProducts with failing fn => %v after %d products; want %v after 1", err, n, errStop)
+	}
+
+	// Products before a syntax error are decoded, and the rest of the
+	// message is returned with the error
+	refs, _, err := decode(`<ONIXMessage release="2.1"><Product><RecordReference>a</RecordReference></Product>` +
+		`<Product><RecordReference>b</Recor></Product><Product><RecordReference>c</RecordReference></Product>`)
+	me, ok := err.(*malformedError)
+	if !ok || strings.Join(refs, " ") != "a" {
+		t.Fatalf("decodeProducts(malformed) => %q, %v; want a, *malformedError", refs, err)
+	}
+	if want := `<Product><RecordReference>b</Recor></Product><Product><RecordReference>c</RecordReference></Product>`; string(me.tail) != want || me.release != "2.1" {
+		t.Errorf("malformed rest of message => %q of release %q; want %q of 2.1", me.tail, me.release, want)
+	}
+}
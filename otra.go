@@ -1,16 +1,19 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"flag"
 	"html"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/knakk/kbp/onix"
 	"github.com/knakk/kbp/onix/codes/list15"
-	"github.com/knakk/kbp/onix/codes/list159"
-	"github.com/knakk/kbp/onix/codes/list162"
 	"github.com/knakk/kbp/onix/codes/list163"
 	"github.com/knakk/kbp/onix/codes/list5"
 	"github.com/knakk/otra/storage"
@@ -23,125 +26,278 @@ type ONIXMessage struct {
 var harvestStart time.Duration
 
 func main() {
+	if len(os.Args) > 1 {
+		var cmd func([]string) error
+		switch os.Args[1] {
+		case "export":
+			cmd = runExport
+		case "import":
+			cmd = runImport
+		}
+		if cmd != nil {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	var (
 		dbFile              = flag.String("db", "otra.db", "database file")
 		listenAdr           = flag.String("l", ":8765", "listening address")
 		reindex             = flag.Bool("reindex", false, "reindex all records on startup")
+		harvestSource       = flag.String("harvest-source", sourceBoknett, "harvesting source type: boknett, oai-pmh, folder or http")
 		harvestAdr          = flag.String("harvest-adr", "", "harvesting address")
 		harvestAuthAdr      = flag.String("harvest-auth", "", "harvesting auth address")
 		harvestUser         = flag.String("harvest-user", "", "harvesting auth user")
 		harvestPass         = flag.String("harvest-pass", "", "harvesting auth password")
+		harvestDir          = flag.String("harvest-dir", "", "directory of ONIX files to harvest (folder source)")
+		harvestOAIPrefix    = flag.String("harvest-oai-prefix", "", "metadata prefix of ONIX records (oai-pmh source)")
+		harvestOAISet       = flag.String("harvest-oai-set", "", "set to harvest (oai-pmh source)")
 		harvestImgDir       = flag.String("harvest-img", "img", "harvesting images to this directory")
+		harvestImgWorkers   = flag.Int("harvest-img-workers", defaultImageWorkers, "number of images downloaded in parallel")
 		harvestSize         = flag.Int("harvest-size", 100, "haresting batch size")
 		harvestPoll         = flag.Duration("harvest-poll", time.Hour*12, "harvesting polling frquencey")
 		harvestIgnoreCursor = flag.Bool("harvest-ignore-cursor", false, "disregard stored cursor")
+		harvestRetries      = flag.Int("harvest-retries", defaultRetries, "failures retried with backoff before a source is considered unhealthy")
+		harvestConnTimeout  = flag.Duration("harvest-connect-timeout", defaultConnectTimeout, "harvesting connect timeout")
+		harvestReadTimeout  = flag.Duration("harvest-read-timeout", defaultReadTimeout, "harvesting read timeout")
+		harvestSpool        = flag.Bool("harvest-spool", false, "copy harvested batches to a temporary file before decoding them")
+		harvestUnknownRef   = flag.String("harvest-unknown-ref", unknownRefSkip, "policy for block updates of unknown records: skip, store or reject")
+		tombstoneRetention  = flag.Duration("tombstone-retention", time.Hour*24*30, "how long to keep tombstones of deleted records")
+		journalRetention    = flag.Duration("journal-retention", time.Hour*24*30, "how long to keep journals of harvest runs")
+		replicaOf           = flag.String("replica-of", "", "run as read-only replica of the otra instance at this URL")
+		replicaPoll         = flag.Duration("replica-poll", time.Minute, "replica polling frequency")
+		replicationSecret   = flag.String("replication-secret", "", "secret shared by a primary and its replicas, which can not replicate without one")
+		policyFile          = flag.String("policy", "", "file with rules for storing, flagging or hiding records (default built-in rules)")
+		validate            = flag.String("validate", strings.Join(defaultValidation, ","), "comma-separated validation rules products must satisfy")
+		catalogues          = flag.String("catalogues", "", "catalogues configuration file (overrides -db and harvest flags)")
+		adminPass           = flag.String("admin-pass", "", "password of the user admin on /admin and /quarantine pages, which are disabled if empty")
 	)
 	flag.DurationVar(&harvestStart, "harvest-before", time.Hour*1, "harvesting start duration before current time")
 	flag.Parse()
 
-	db, err := storage.Open(*dbFile, indexFn)
-	if err != nil {
+	cfgs := []catalogueConfig{
+		{
+			Name:         "default",
+			DB:           *dbFile,
+			Index:        "default",
+			Images:       *harvestImgDir,
+			ImageWorkers: *harvestImgWorkers,
+			Harvest: harvestConfig{
+				sourceConfig: sourceConfig{
+					Type:           *harvestSource,
+					Endpoint:       *harvestAdr,
+					AuthEndpoint:   *harvestAuthAdr,
+					Username:       *harvestUser,
+					Password:       *harvestPass,
+					BatchSize:      *harvestSize,
+					MetadataPrefix: *harvestOAIPrefix,
+					Set:            *harvestOAISet,
+					Dir:            *harvestDir,
+					PollInterval:   duration{*harvestPoll},
+					Before:         duration{harvestStart},
+					Retries:        *harvestRetries,
+					ConnectTimeout: duration{*harvestConnTimeout},
+					ReadTimeout:    duration{*harvestReadTimeout},
+					Spool:          *harvestSpool,
+				},
+				IgnoreCursor: *harvestIgnoreCursor,
+				UnknownRef:   *harvestUnknownRef,
+			},
+			ReplicaOf:         *replicaOf,
+			ReplicationSecret: *replicationSecret,
+			Policy:            *policyFile,
+			Validate:          splitList(*validate),
+		},
+	}
+	if err := validUnknownRefPolicy(*harvestUnknownRef); err != nil {
+		log.Fatal(err)
+	}
+	if err := validSourceType(*harvestSource); err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	if *catalogues != "" {
+		var err error
+		if cfgs, err = loadCatalogues(*catalogues); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	cats := storage.NewCatalogues()
+	defer cats.Close()
 
-	if *reindex {
-		go func() {
-			log.Println("reindexing all records...")
-			start := time.Now()
-			if err := db.ReindexAll(); err != nil {
-				log.Printf("reindexing failed: %v", err)
+	for i, c := range cfgs {
+		pol := defaultPolicy
+		if c.Policy != "" {
+			var err error
+			if pol, err = loadPolicy(c.Policy); err != nil {
+				log.Fatalf("catalogue %q: %v", c.Name, err)
 			}
-			log.Printf("done reindexing %d records in %v", db.Stats().Records, time.Since(start))
-		}()
-	}
+		}
+		problems := newProblemLog()
+		db, err := cats.Open(c.Name, c.DB, pol.indexFn(problems.indexFn(indexFns[c.Index])))
+		if err != nil {
+			log.Fatalf("catalogue %q: %v", c.Name, err)
+		}
+		setProblemLog(db, problems)
+		db.SetWorkFn(workFn)
 
-	http.Handle("/autocomplete/", scanHandler(db))
-	http.Handle("/record/", recordHandler(db))
-	http.Handle("/indexes", indexHandler(db))
-	http.Handle("/stats", statsHandler(db))
-	http.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(*harvestImgDir))))
-	http.Handle("/imgbyisbn/", imgByIsbnHandler(db, *harvestImgDir))
-	http.Handle("/imgbyean/", imgByEANHandler(db, *harvestImgDir))
-	http.Handle("/favicon.ico", http.NotFoundHandler())
-	http.Handle("/xmlquery", xmlQueryHandler(db))
-	http.Handle("/", queryHandler(db))
+		if *reindex {
+			go func(name string) {
+				log.Printf("reindexing all records in catalogue %q...", name)
+				start := time.Now()
+				if err := db.ReindexAll(); err != nil {
+					log.Printf("reindexing failed: %v", err)
+				}
+				log.Printf("done reindexing %d records in %v", db.Stats().Records, time.Since(start))
+			}(c.Name)
+		}
+
+		go purge(db, *tombstoneRetention, *journalRetention)
+
+		v, err := newValidator(c.Validate)
+		if err != nil {
+			log.Fatalf("catalogue %q: %v", c.Name, err)
+		}
+
+		var h *harvester
+		if c.ReplicaOf != "" {
+			if c.ReplicationSecret == "" {
+				log.Fatalf("catalogue %q: a replica needs the replication secret of its primary", c.Name)
+			}
+			db.SetReadOnly(true)
+			r := &replicator{
+				db:           db,
+				primary:      strings.TrimSuffix(c.ReplicaOf, "/"),
+				batchSize:    c.Harvest.BatchSize,
+				pollInterval: *replicaPoll,
+				secret:       c.ReplicationSecret,
+				client:       &http.Client{Timeout: time.Minute},
+			}
+			go r.Run()
+		} else {
+			h = &harvester{
+				db:           db,
+				imageDir:     c.Images,
+				ignoreCursor: c.Harvest.IgnoreCursor,
+				unknownRef:   c.Harvest.UnknownRef,
+				policy:       pol,
+				validator:    v,
+				imageWorkers: c.ImageWorkers,
+				imageWake:    make(chan struct{}, 1),
+			}
+			for _, sc := range c.Harvest.sources() {
+				s, err := newHarvestSource(sc)
+				if err != nil {
+					log.Printf("catalogue %q: source %q: %v", c.Name, sc.Name, err)
+					continue
+				}
+				h.sources = append(h.sources, s)
+			}
+			go h.Run()
+		}
 
-	h := &harvester{
-		db:           db,
-		endpoint:     *harvestAdr,
-		authEndpoint: *harvestAuthAdr,
-		username:     *harvestUser,
-		password:     *harvestPass,
-		imageDir:     *harvestImgDir,
-		ignoreCursor: *harvestIgnoreCursor,
-		start:        time.Now().Add(-harvestStart),
-		pollInterval: *harvestPoll,
-		batchSize:    *harvestSize,
+		base := "/c/" + c.Name
+		http.Handle(base+"/", http.StripPrefix(base, catalogueMux(db, h, c, base, *adminPass)))
+		if i == 0 {
+			// The first catalogue is also served from the root
+			http.Handle("/", catalogueMux(db, h, c, "", *adminPass))
+		}
 	}
-	go h.Run()
+	http.Handle("/search", multiQueryHandler(cats))
 
 	log.Printf("Starting otra server. Listening at %s", *listenAdr)
 	log.Fatal(http.ListenAndServe(*listenAdr, nil))
 }
 
-func indexFn(p *onix.Product) (res []storage.IndexEntry) {
-	for _, id := range p.ProductIdentifier {
-		switch id.ProductIDType.Value {
-		case list5.ISBN13:
-			res = append(res, storage.IndexEntry{
-				Index: "isbn",
-				Term:  id.IDValue.Value,
-			})
-		case list5.GTIN13:
-			res = append(res, storage.IndexEntry{
-				Index: "ean",
-				Term:  id.IDValue.Value,
-			})
+// purge periodically removes tombstones, and journals of harvest runs,
+// older than their given retention.
+func purge(db *storage.DB, tombstoneRetention, journalRetention time.Duration) {
+	for {
+		n, err := db.PurgeTombstones(time.Now().Add(-tombstoneRetention))
+		if err != nil {
+			log.Printf("purging tombstones failed: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d tombstones older than %v", n, tombstoneRetention)
+		}
+		n, err = db.PurgeHarvestRuns(time.Now().Add(-journalRetention))
+		if err != nil {
+			log.Printf("purging harvest journal failed: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d harvest runs older than %v", n, journalRetention)
 		}
+		time.Sleep(time.Hour)
 	}
+}
+
+func indexFn(p *onix.Product) ([]storage.IndexEntry, []fieldError) {
+	var (
+		res  []storage.IndexEntry
+		errs fieldErrors
+	)
+	errs.do("ProductIdentifier", func() {
+		for _, id := range p.ProductIdentifier {
+			switch id.ProductIDType.Value {
+			case list5.ISBN13:
+				res = append(res, storage.IndexEntry{
+					Index: "isbn",
+					Term:  id.IDValue.Value,
+				})
+			case list5.GTIN13:
+				res = append(res, storage.IndexEntry{
+					Index: "ean",
+					Term:  id.IDValue.Value,
+				})
+			}
+		}
+	})
 	if p.DescriptiveDetail == nil {
-		return res
+		return res, errs
 	}
-	for _, c := range p.DescriptiveDetail.Collection {
-		for _, t := range c.TitleDetail {
-			for _, tt := range t.TitleElement {
-				if tt.TitleText != nil {
-					res = append(res, storage.IndexEntry{
-						Index: "series",
-						Term:  html.UnescapeString(tt.TitleText.Value),
-					})
+	errs.do("Collection", func() {
+		for _, c := range p.DescriptiveDetail.Collection {
+			for _, t := range c.TitleDetail {
+				for _, tt := range t.TitleElement {
+					if tt.TitleText != nil {
+						res = append(res, storage.IndexEntry{
+							Index: "series",
+							Term:  html.UnescapeString(tt.TitleText.Value),
+						})
+					}
 				}
 			}
 		}
-	}
+	})
 
-	for _, t := range p.DescriptiveDetail.TitleDetail {
-		if t.TitleType.Value == list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource {
-			res = append(res, storage.IndexEntry{
-				Index: "title",
-				Term:  html.UnescapeString(t.TitleElement[0].TitleText.Value),
-			})
-			if t.TitleElement[0].Subtitle != nil {
+	errs.do("TitleDetail", func() {
+		for _, t := range p.DescriptiveDetail.TitleDetail {
+			if t.TitleType.Value == list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource {
 				res = append(res, storage.IndexEntry{
 					Index: "title",
-					Term:  html.UnescapeString(t.TitleElement[0].Subtitle.Value),
+					Term:  html.UnescapeString(t.TitleElement[0].TitleText.Value),
 				})
+				if t.TitleElement[0].Subtitle != nil {
+					res = append(res, storage.IndexEntry{
+						Index: "title",
+						Term:  html.UnescapeString(t.TitleElement[0].Subtitle.Value),
+					})
+				}
 			}
-		}
-		if t.TitleType.Value == list15.TitleInOriginalLanguage {
-			res = append(res, storage.IndexEntry{
-				Index: "title",
-				Term:  t.TitleElement[0].TitleText.Value,
-			})
-			if t.TitleElement[0].Subtitle != nil {
+			if t.TitleType.Value == list15.TitleInOriginalLanguage {
 				res = append(res, storage.IndexEntry{
 					Index: "title",
-					Term:  t.TitleElement[0].Subtitle.Value,
+					Term:  t.TitleElement[0].TitleText.Value,
 				})
+				if t.TitleElement[0].Subtitle != nil {
+					res = append(res, storage.IndexEntry{
+						Index: "title",
+						Term:  t.TitleElement[0].Subtitle.Value,
+					})
+				}
 			}
 		}
-	}
+	})
 
 	/*
 		for _, l := range p.DescriptiveDetail.Language {
@@ -152,128 +308,221 @@ func indexFn(p *onix.Product) (res []storage.IndexEntry) {
 			}
 		}*/
 
-	if len(p.PublishingDetail.Imprint) > 0 {
-		for _, imp := range p.PublishingDetail.Imprint {
-			res = append(res, storage.IndexEntry{
-				Index: "publisher",
-				Term:  html.UnescapeString(imp.ImprintName.Value),
-			})
-			break
+	if p.PublishingDetail != nil {
+		errs.do("Publisher", func() {
+			if len(p.PublishingDetail.Imprint) > 0 {
+				for _, imp := range p.PublishingDetail.Imprint {
+					res = append(res, storage.IndexEntry{
+						Index: "publisher",
+						Term:  html.UnescapeString(imp.ImprintName.Value),
+					})
+					break
+				}
+			} else {
+				for _, p := range p.PublishingDetail.Publisher {
+					res = append(res, storage.IndexEntry{
+						Index: "publisher",
+						Term:  html.UnescapeString(p.PublisherName.Value),
+					})
+					break
+				}
+			}
+		})
+		errs.do("PublishingDate", func() {
+			for _, d := range p.PublishingDetail.PublishingDate {
+				if d.PublishingDateRole.Value == list163.LastReprintDate {
+					res = append(res, storage.IndexEntry{
+						Index: "year",
+						Term:  d.Date.Value,
+					})
+					break
+				}
+			}
+		})
+	}
+
+	errs.do("Subject", func() {
+		for _, s := range p.DescriptiveDetail.Subject {
+			for _, st := range s.SubjectHeadingText {
+				res = append(res, storage.IndexEntry{
+					Index: "subject",
+					Term:  st.Value,
+				})
+			}
 		}
-	} else {
-		for _, p := range p.PublishingDetail.Publisher {
-			res = append(res, storage.IndexEntry{
-				Index: "publisher",
-				Term:  html.UnescapeString(p.PublisherName.Value),
-			})
-			break
+	})
+
+	errs.do("Contributor", func() {
+		for _, c := range p.DescriptiveDetail.Contributor {
+			for _, role := range c.ContributorRole {
+				var agent string
+				if c.PersonNameInverted != nil {
+					agent = c.PersonNameInverted.Value
+				} else if c.PersonName != nil {
+					agent = c.PersonName.Value
+				} else if c.CorporateName != nil {
+					agent = c.CorporateName.Value
+				} else if c.CorporateNameInverted != nil {
+					agent = c.CorporateNameInverted.Value
+				}
+				res = append(res, storage.IndexEntry{
+					Index: "agent",
+					Term:  agent,
+				})
+				var roleIndex string
+				switch role.Value {
+				case "A01":
+					roleIndex = "author"
+				case "A03":
+					roleIndex = "scriptwriter"
+				case "A05":
+					roleIndex = "lyricist"
+				case "A06":
+					roleIndex = "composer"
+				case "A09":
+					roleIndex = "creator"
+				case "A12":
+					roleIndex = "illustrator"
+				case "A13":
+					roleIndex = "photographer"
+				case "A32":
+					roleIndex = "contributor"
+				case "A38":
+					roleIndex = "originalauthor"
+				case "A99":
+					roleIndex = "othercreator"
+				case "B01":
+					roleIndex = "editor"
+				case "B06":
+					roleIndex = "translator"
+				case "D01":
+					roleIndex = "producer"
+				case "D02":
+					roleIndex = "director"
+				case "E01":
+					roleIndex = "actor"
+				case "E06":
+					roleIndex = "solist"
+				case "E07":
+					roleIndex = "reader"
+				/* TODO:
+				roleA07: 15
+				roleB20: 5
+				roleE05: 7
+				roleZ02: 32
+				*/
+				default:
+					roleIndex = "role" + role.Value
+				}
+				res = append(res, storage.IndexEntry{
+					Index: roleIndex,
+					Term:  agent,
+				})
+			}
 		}
-	}
-	for _, d := range p.PublishingDetail.PublishingDate {
-		if d.PublishingDateRole.Value == list163.LastReprintDate {
-			res = append(res, storage.IndexEntry{
-				Index: "year",
-				Term:  d.Date.Value,
-			})
-			break
+	})
+
+	return res, errs
+}
+
+// workFn groups products into works. Products which are linked to a work
+// identifier through RelatedWork are grouped by that identifier, otherwise
+// they are grouped by normalized title and main author. Products listed as
+// alternative formats in RelatedProduct will join the work of those products.
+func workFn(p *onix.Product) (w storage.Work) {
+	if p.RelatedMaterial != nil {
+		for _, rw := range p.RelatedMaterial.RelatedWork {
+			if rw.WorkRelationCode.Value != "01" { // Manifestation of
+				continue
+			}
+			for _, id := range rw.WorkIdentifier {
+				w.Key = workKey("id", id.WorkIDType.Value, id.IDValue.Value)
+				break
+			}
 		}
+		for _, rp := range p.RelatedMaterial.RelatedProduct {
+			if !isAlternativeFormat(rp) {
+				continue
+			}
+			for _, id := range rp.ProductIdentifier {
+				if id.ProductIDType.Value == list5.ISBN13 {
+					w.Related = append(w.Related, storage.IndexEntry{
+						Index: "isbn",
+						Term:  id.IDValue.Value,
+					})
+				}
+			}
+		}
+	}
+	if w.Key != "" || p.DescriptiveDetail == nil {
+		return w
 	}
 
-	for _, s := range p.DescriptiveDetail.Subject {
-		for _, st := range s.SubjectHeadingText {
-			res = append(res, storage.IndexEntry{
-				Index: "subject",
-				Term:  st.Value,
-			})
+	var title, author string
+	for _, t := range p.DescriptiveDetail.TitleDetail {
+		if t.TitleType.Value != list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource {
+			continue
+		}
+		for _, te := range t.TitleElement {
+			if te.TitleText != nil {
+				title = te.TitleText.Value
+			} else if te.TitleWithoutPrefix != nil {
+				title = te.TitleWithoutPrefix.Value
+			}
+			break
 		}
+		break
 	}
-
 	for _, c := range p.DescriptiveDetail.Contributor {
 		for _, role := range c.ContributorRole {
-			var agent string
+			if role.Value != "A01" {
+				continue
+			}
 			if c.PersonNameInverted != nil {
-				agent = c.PersonNameInverted.Value
+				author = c.PersonNameInverted.Value
 			} else if c.PersonName != nil {
-				agent = c.PersonName.Value
+				author = c.PersonName.Value
 			} else if c.CorporateName != nil {
-				agent = c.CorporateName.Value
-			} else if c.CorporateNameInverted != nil {
-				agent = c.CorporateNameInverted.Value
-			}
-			res = append(res, storage.IndexEntry{
-				Index: "agent",
-				Term:  agent,
-			})
-			var roleIndex string
-			switch role.Value {
-			case "A01":
-				roleIndex = "author"
-			case "A03":
-				roleIndex = "scriptwriter"
-			case "A05":
-				roleIndex = "lyricist"
-			case "A06":
-				roleIndex = "composer"
-			case "A09":
-				roleIndex = "creator"
-			case "A12":
-				roleIndex = "illustrator"
-			case "A13":
-				roleIndex = "photographer"
-			case "A32":
-				roleIndex = "contributor"
-			case "A38":
-				roleIndex = "originalauthor"
-			case "A99":
-				roleIndex = "othercreator"
-			case "B01":
-				roleIndex = "editor"
-			case "B06":
-				roleIndex = "translator"
-			case "D01":
-				roleIndex = "producer"
-			case "D02":
-				roleIndex = "director"
-			case "E01":
-				roleIndex = "actor"
-			case "E06":
-				roleIndex = "solist"
-			case "E07":
-				roleIndex = "reader"
-			/* TODO:
-			roleA07: 15
-			roleB20: 5
-			roleE05: 7
-			roleZ02: 32
-			*/
-			default:
-				roleIndex = "role" + role.Value
+				author = c.CorporateName.Value
 			}
-			res = append(res, storage.IndexEntry{
-				Index: roleIndex,
-				Term:  agent,
-			})
+		}
+		if author != "" {
+			break
 		}
 	}
-
-	return res
+	if title = normalize(html.UnescapeString(title)); title != "" {
+		w.Key = workKey("ta", title, normalize(author))
+	}
+	return w
 }
 
-func extractLinks(p *onix.Product) (res [][2]string) {
-	if p.CollateralDetail == nil {
-		return res
-	}
-	res = make([][2]string, 0)
-	for _, r := range p.CollateralDetail.SupportingResource {
-		if r.ResourceMode.Value == list159.Image {
-			for _, v := range r.ResourceVersion {
-				for _, f := range v.ResourceVersionFeature {
-					if f.ResourceVersionFeatureType.Value == list162.Filename {
-						res = append(res, [2]string{f.FeatureNote[0].Value, v.ResourceLink[0].Value})
-					}
-				}
-			}
+// isAlternativeFormat reports whether the related product is another
+// manifestation of the same work.
+func isAlternativeFormat(rp onix.RelatedProduct) bool {
+	for _, code := range rp.ProductRelationCode {
+		switch code.Value {
+		case "06", // Alternative format
+			"13", // Epublication based on (print product)
+			"27": // Electronic version available as
+			return true
 		}
 	}
-	return res
+	return false
+}
+
+// workKey returns a short, URL-safe key identifying the work with the given parts.
+func workKey(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// normalize lowercases s and strips everything but letters and digits, so that
+// minor differences in punctuation and spacing between editions are ignored.
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
 }
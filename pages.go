@@ -17,6 +17,8 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 		label          { display: block; font-weight: bold; font-size: 80%; }
 		input          { width: 60% }
 		input, button  { padding: .2em .62em; font-size: 100% }
+		.collapse input { width: auto }
+		.flag          { font-size: smaller; background-color: #fe6; padding: 0 .3em; }
 		img            { float: left; max-width: 100px }
 		p              { margin: 0 0 0.22em 0; }
 		p.details      { font-size: smaller; }
@@ -43,8 +45,12 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 			<h1>Otra</h1>
 		</header>
 		<section class="relative">
-			<form id="searchForm" action="/">
+			<form id="searchForm" action="{{.Action}}">
 				<input list="suggestions" id="search" type="text" autocomplete="off" name="q" value="{{.Query}}" /> <button id="searchButton" type="submit">Søk</button>
+				{{range .Catalogues}}<input type="hidden" name="c" value="{{.}}" />{{end}}
+				{{range .Flags}}<input type="hidden" name="flag" value="{{.}}" />{{end}}
+				{{range .NoFlags}}<input type="hidden" name="noflag" value="{{.}}" />{{end}}
+				<label class="collapse"><input type="checkbox" name="collapse" value="work" {{if .Collapse}}checked{{end}} /> Slå sammen utgaver</label>
 			</form>
 			<datalist id="suggestions"></datalist>
 		</section>
@@ -52,31 +58,47 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 			<section id="hits">
 				<h4>{{.Total}} hits ({{.Took}}ms)</h4>
 				{{range .Hits}}
+					{{$base := .Base}}
 					<div class="record">
 						<div class="record-img">
 							{{if .HasImage}}
-								<a target="_blank" href="/img/{{.ID}}"><img src="/img/{{.ID}}/os.jpg"></a>
+								<a target="_blank" href="{{$base}}/img/{{.ID}}"><img src="{{$base}}/img/{{.ID}}/thumbnail"></a>
 							{{end}}
 						</div>
 						<div class="record-text">
-							<div class="xmlRecord"><a target="_blank" href="/record/{{.ID}}">xml</a> </div>
-							<p><strong>{{.Title}}</strong> <span class="grey">{{.Format}}</span><br/>
+							<div class="xmlRecord"><a target="_blank" href="{{$base}}/record/{{.ID}}">xml</a> </div>
+							{{if gt .Manifestations 1}}
+								<div class="xmlRecord"><a href="{{$base}}/work/{{.Work}}">{{.Manifestations}} utgaver</a>&nbsp;</div>
+							{{end}}
+							<p><strong>{{.Title}}</strong> <span class="grey">{{.Format}}</span>{{if .Catalogue}} <span class="grey">({{.Catalogue}})</span>{{end}}{{range .Flags}} <span class="flag">{{.}}</span>{{end}}<br/>
 								<span class="subtitles">{{range .Subtitles}}<small>{{.}}</small>{{end}}</span>
 							</p>
 							<p class="contributors">
 								{{range $role, $agents := .Contributors}}
-									<span>{{$role}} {{range $agents}}<a href="/?q=agent/{{.}}">{{.}}</a> {{end}}</span>
+									<span>{{$role}} {{range $agents}}<a href="{{$base}}/?q=agent/{{.}}">{{.}}</a> {{end}}</span>
 								{{end}}
 							</p>
-							<p class="details">Utgitt av {{.Publisher}} <a href="/?q=year/{{.PublishedYear}}">{{.PublishedYear}}</a></p>
+							<p class="details">Utgitt av {{.Publisher}} <a href="{{$base}}/?q=year/{{.PublishedYear}}">{{.PublishedYear}}</a>{{if .Source}} <span class="grey">Kilde: <a href="{{$base}}/?q=source/{{.Source}}">{{.Source}}</a></span>{{end}}</p>
 							{{if .Collection}}
 								<p class="collections details">Serie:
-									{{range .Collection}}<span><a href="/?q=series/{{.}}">{{.}}</a></span>{{end}}
+									{{range .Collection}}<span><a href="{{$base}}/?q=series/{{.}}">{{.}}</a></span>{{end}}
 								</p>
 							{{end}}
 							{{if .Subjects}}
 								<p class="subjects details">Emner:
-									{{range .Subjects}}<span><a href="/?q=subject/{{.}}">{{.}}</a></span>{{end}}
+									{{range .Subjects}}<span><a href="{{$base}}/?q=subject/{{.}}">{{.}}</a></span>{{end}}
+								</p>
+							{{end}}
+							{{if .Resources}}
+								{{$id := .ID}}
+								<p class="resources details">Ressurser:
+									{{range .Resources}}
+										{{$href := printf "%s/resource/%s/%s/%s" $base $id .Type .Name}}
+										{{if eq .Kind "image"}}<a target="_blank" href="{{$href}}" title="{{.Type}}"><img src="{{$href}}?w=100"></a>
+										{{else if eq .Kind "audio"}}<audio controls preload="none" src="{{$href}}" title="{{.Type}}"></audio>
+										{{else if eq .Kind "video"}}<video controls preload="none" width="300" src="{{$href}}" title="{{.Type}}"></video>
+										{{else}}<a target="_blank" href="{{$href}}">{{.Type}}</a>{{end}}
+									{{end}}
 								</p>
 							{{end}}
 							{{if .Desc}}
@@ -100,7 +122,7 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 								{{if .Active}}
 									<strong>{{.Page}}</strong>
 								{{else}}
-									<a href="/?q={{$results.Query}}&page={{.Page}}">{{.Page}}</a>
+									<a href="{{$results.Action}}?q={{$results.Query}}&page={{.Page}}{{range $results.Catalogues}}&c={{.}}{{end}}{{range $results.Flags}}&flag={{.}}{{end}}{{range $results.NoFlags}}&noflag={{.}}{{end}}{{if $results.Collapse}}&collapse=work{{end}}">{{.Page}}</a>
 								{{end}}
 							</li>
 						{{end}}
@@ -111,6 +133,7 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 	</article>
 	<script>
 		// global state
+		var base = {{.Base}}
 		var indexes = []
 
 		function setDatalist(options) {
@@ -127,7 +150,7 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 
 		function getIndexes() {
 			var req = new XMLHttpRequest()
-			req.open('GET', '/indexes')
+			req.open('GET', base+'/indexes')
 			req.onload = function(resp) {
 				if (req.status >= 200 && req.status < 400) {
 					indexes = JSON.parse(req.responseText).map(function(el) {
@@ -161,7 +184,7 @@ var indexTmpl = template.Must(template.New("index").Parse(`
 				return true
 			}
 			var req = new XMLHttpRequest()
-			req.open('GET', '/autocomplete/'+q, true)
+			req.open('GET', base+'/autocomplete/'+q, true)
 			req.onload = function(resp) {
 				if (req.status >= 200 && req.status < 400) {
 					suggestions = JSON.parse(req.responseText) || []
@@ -200,7 +223,54 @@ records: {{.Records}}
 Indexes
 =======
 {{range .Indexes -}}
-{{.Name}}: {{.Count}}
+<a href="stats/index/{{.Name}}">{{.Name}}</a>: {{.Count}}
 {{end}}
+Images
+======
+<a href="stats/images">disk usage</a>
+queued: {{.Images}}
+
+Sources
+=======
+{{range .Sources -}}
+{{.Name}} ({{.Type}}){{if .Paused}} PAUSED{{end}}{{if .Unhealthy}} UNHEALTHY{{end}}: {{.Harvested}} harvested, started {{.Started.Format "2006-01-02 15:04:05"}}{{if not .NextPoll.IsZero}}, next attempt {{.NextPoll.Format "2006-01-02 15:04:05"}}{{end}}
+  cursor: {{.Cursor}}{{if .Retries}}
+  retry queue: {{.Retries}}{{end}}{{if .Failures}}
+  error: {{.LastError}} ({{.Failures}} failures in a row){{end}}
+{{else -}}
+none
+{{end}}
+Problems
+========
+{{range .Problems -}}
+{{.Time.Format "2006-01-02 15:04:05"}} {{.Stage}} {{.Ref}} {{.Field}}: {{.Error}}
+{{else -}}
+none
+{{end}}
+</pre>
+`))
+
+var harvestAdminTmpl = template.Must(template.New("harvestAdmin").Parse(`<pre>
+Harvest
+=======
+{{$base := .Base -}}
+{{range .Sources -}}
+{{$action := printf "%s/admin/harvest/%s/" $base .Name -}}
+{{.Name}} ({{.Type}}){{if .Paused}} PAUSED{{end}}{{if .Unhealthy}} UNHEALTHY{{end}} <a href="{{$base}}/admin/harvest/runs?source={{.Name}}">runs</a>
+  cursor: {{.Cursor}}
+  last success: {{if .LastSuccess.IsZero}}none{{else}}{{.LastSuccess.Format "2006-01-02 15:04:05"}}{{end}}
+  last error: {{if .LastError}}{{.LastErrorTime.Format "2006-01-02 15:04:05"}} {{.LastError}}{{if .Failures}} ({{.Failures}} failures in a row){{end}}{{else}}none{{end}}
+  records: {{.RunRecords}} this run, {{.LastRunRecords}} last run, {{.Harvested}} since startup{{if .Retries}}
+  retry queue: {{.Retries}}{{end}}{{if not .NextPoll.IsZero}}
+  next attempt: {{.NextPoll.Format "2006-01-02 15:04:05"}}{{end}}
+  {{if .Paused -}}
+  <form style="display:inline" method="post" action="{{$action}}resume"><input type="hidden" name="html" value="1"><button>resume</button></form>
+  {{- else -}}
+  <form style="display:inline" method="post" action="{{$action}}pause"><input type="hidden" name="html" value="1"><button>pause</button></form> <form style="display:inline" method="post" action="{{$action}}poll"><input type="hidden" name="html" value="1"><button>poll now</button></form>
+  {{- end}} <form style="display:inline" method="post" action="{{$action}}reset" onsubmit="return confirm('Harvest {{.Name}} from its starting point?')"><input type="hidden" name="html" value="1"><button>reset cursor</button></form> <form style="display:inline" method="post" action="{{$action}}after"><input type="hidden" name="html" value="1"><input name="after" placeholder="2006-01-02T15:04:05Z"> <button>harvest after</button></form>
+
+{{else -}}
+none
+{{end -}}
 </pre>
 `))
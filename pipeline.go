@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+const (
+	// maxRetryAttempts is the number of times a product in the retry queue
+	// is tried again, before it is quarantined.
+	maxRetryAttempts = 5
+
+	// maxRetriesPerBatch is the number of products in the retry queue
+	// tried again along with a batch.
+	maxRetriesPerBatch = 100
+
+	// retryBackoff is how long a product waits in the retry queue after
+	// failing once. It doubles with every attempt.
+	retryBackoff = time.Minute
+
+	// maxErrorSamples is the number of errors of failed products kept in
+	// the journal of a page or a run.
+	maxErrorSamples = 10
+)
+
+// pending is a product to be handled.
+type pending struct {
+	p     *onix.Product
+	raw   rawProduct
+	err   error          // decoding error
+	retry *storage.Retry // queue entry if the product is retried
+}
+
+// retryableError is the error of a product which can not be handled yet,
+// such as a block update of a record which is not stored, and is put in
+// the retry queue. Other errors of handling a product fail its batch.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// itemError is the error of handling the pending product at the given
+// position in its batch.
+type itemError struct {
+	i   int
+	err error
+}
+
+func (e *itemError) Error() string {
+	return e.err.Error()
+}
+
+// harvestBatch handles the products of a batch fetched from the source at
+// cursor, along with the source's queued retries, returning the outcomes of
+// handling them. Only retries which are due are handled, up to
+// maxRetriesPerBatch of them. The products are decoded as the batch is read, with no
+// transaction open, and then handled in one transaction, which also stores
+// the source's next cursor; so the batch is stored as a whole, or not at
+// all. The products of a batch are held in memory until it is stored, and
+// are limited by the size of the batches requested from the source. If the
+// batch is not well-formed XML, the part of it which can not be read is
+// quarantined, and the cursor advanced past it.
+func (h *harvester) harvestBatch(s *harvestSource, cursor string, bat batch) (page storage.HarvestPage, err error) {
+	defer bat.Body.Close()
+	retries, err := h.db.DueRetries(s.name, time.Now(), maxRetriesPerBatch)
+	if err != nil {
+		return page, err
+	}
+	body := io.Reader(bat.Body)
+	if s.spool {
+		f, err := spool(bat.Body)
+		if err != nil {
+			return page, err
+		}
+		defer f.Close()
+		body = f
+	}
+
+	var items []pending
+	for i := range retries {
+		r := &retries[i]
+		raw := rawProduct{XML: []byte(r.Raw), Release: r.Release, Source: r.Source}
+		p, err := decodeProduct(raw)
+		items = append(items, pending{p: p, raw: raw, err: err, retry: r})
+	}
+	err = decodeProducts(body, func(p *onix.Product, raw rawProduct, err error) error {
+		raw.Source = s.name
+		items = append(items, pending{p: p, raw: raw, err: err})
+		return nil
+	})
+	me, malformed := err.(*malformedError)
+	if err != nil && !malformed {
+		// The rest of the batch is unknown; try it again rather than skip it
+		return page, fmt.Errorf("xml parsing error: %v", err)
+	}
+
+	page, err = h.commit(items, func(tx *storage.Tx) error {
+		if malformed {
+			id, err := tx.Quarantine(storage.Quarantined{
+				Release: me.release,
+				Source:  s.name,
+				Error:   fmt.Sprintf("xml parsing error: %v", me.err),
+				Raw:     string(me.tail),
+			})
+			if err != nil {
+				return err
+			}
+			tx.OnCommit(func() { log.Printf("harvester: quarantined unreadable rest of batch as %d: %v", id, me.err) })
+		}
+		return tx.MetaSet(s.cursorKey(), []byte(bat.Cursor))
+	})
+	if err != nil {
+		return page, err
+	}
+	if malformed {
+		page.Failed++
+		page.Errors = sampleErrors(page.Errors, "xml parsing error: "+me.err.Error())
+	}
+	h.wakeImages()
+	return page, nil
+}
+
+// commit handles decoded products in one transaction, which is finished by
+// calling finish. Products which fail with a retryableError are put in the
+// retry queue: the transaction is rolled back, and handled again with the
+// product queued instead. Any other error fails the whole transaction, and
+// is returned. The outcomes of handling the products are
+// returned, with samples of the errors of failed products.
+func (h *harvester) commit(items []pending, finish func(*storage.Tx) error) (page storage.HarvestPage, err error) {
+	failed := make(map[int]error) // by position
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		err = h.db.Batch(func(tx *storage.Tx) error {
+			page = storage.HarvestPage{}
+			for i, it := range items {
+				if err, ok := failed[i]; ok {
+					if err := h.queueRetry(tx, it, err); err != nil {
+						return err
+					}
+					page.Failed++
+					page.Errors = sampleErrors(page.Errors, err.Error())
+					continue
+				}
+				a, reason, err := h.processTx(tx, it.p, it.raw, it.err)
+				if re, ok := err.(retryableError); ok {
+					return &itemError{i: i, err: re.err}
+				}
+				if err != nil {
+					return err
+				}
+				if it.retry != nil {
+					if err := tx.RemoveRetry(it.retry.ID); err != nil {
+						return err
+					}
+				} else if it.p != nil {
+					// Older versions waiting to be retried must not overwrite this one
+					if err := tx.RemoveRetriesOf(it.p.RecordReference.Value); err != nil {
+						return err
+					}
+				}
+				switch a {
+				case actionStored:
+					page.Stored++
+				case actionDeleted:
+					page.Deleted++
+				case actionSkipped:
+					page.Skipped++
+				case actionQuarantined:
+					page.Failed++
+					page.Errors = sampleErrors(page.Errors, reason)
+				}
+			}
+			return finish(tx)
+		})
+		ie, ok := err.(*itemError)
+		if !ok {
+			return page, err
+		}
+		failed[ie.i] = ie.err
+	}
+}
+
+// sampleErrors adds errors to the samples, until there are maxErrorSamples.
+func sampleErrors(samples []string, errs ...string) []string {
+	for _, err := range errs {
+		if len(samples) >= maxErrorSamples {
+			break
+		}
+		samples = append(samples, err)
+	}
+	return samples
+}
+
+// queueRetry puts a product which failed to be handled in the retry queue,
+// or in quarantine if it has been retried too many times.
+func (h *harvester) queueRetry(tx *storage.Tx, it pending, err error) error {
+	r := storage.Retry{Source: it.raw.Source, Release: it.raw.Release, Raw: string(it.raw.XML), Error: err.Error()}
+	if it.p != nil {
+		r.Ref = it.p.RecordReference.Value
+	}
+	if it.retry != nil {
+		r.ID, r.Attempts = it.retry.ID, it.retry.Attempts
+	}
+	r.Attempts++
+	r.Due = time.Now().Add(retryBackoff << uint(r.Attempts-1))
+	if r.Attempts > maxRetryAttempts {
+		if err := tx.RemoveRetry(r.ID); err != nil {
+			return err
+		}
+		id, err := tx.Quarantine(storage.Quarantined{
+			Ref:     r.Ref,
+			Release: r.Release,
+			Source:  r.Source,
+			Error:   fmt.Sprintf("gave up after %d attempts: %s", maxRetryAttempts, r.Error),
+			Raw:     r.Raw,
+		})
+		if err != nil {
+			return err
+		}
+		tx.OnCommit(func() { log.Printf("harvester: quarantined product %q as %d: %s", r.Ref, id, r.Error) })
+		return nil
+	}
+	id, err := tx.QueueRetry(r)
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() {
+		log.Printf("harvester: queued product %q for retry as %d (attempt %d): %s", r.Ref, id, r.Attempts, r.Error)
+	})
+	return nil
+}
+
+// spooledFile is a temporary file, which is removed when closed.
+type spooledFile struct {
+	*os.File
+}
+
+func (f spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// spool copies r to a temporary file, returning it ready to be read from the start.
+func spool(r io.Reader) (io.ReadCloser, error) {
+	f, err := ioutil.TempFile("", "otra-harvest")
+	if err != nil {
+		return nil, err
+	}
+	sf := spooledFile{f}
+	if _, err := io.Copy(f, r); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return sf, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list1"
+	"github.com/knakk/otra/storage"
+)
+
+// validBlocks are the blocks of a product satisfying defaultValidation.
+const validBlocks = `<DescriptiveDetail><ProductForm>BC</ProductForm><TitleDetail><TitleType>01</TitleType>` +
+	`<TitleElement><TitleText>Title</TitleText></TitleElement></TitleDetail></DescriptiveDetail>` +
+	`<PublishingDetail></PublishingDetail>`
+
+// testProduct returns the XML of a product with the given notification type and blocks.
+func testProduct(ref, notification, blocks string) string {
+	return `<Product><RecordReference>` + ref + `</RecordReference><NotificationType>` + notification +
+		`</NotificationType>` + blocks + `</Product>`
+}
+
+// testMessage returns an ONIX 3.0 message of the given products.
+func testMessage(products ...string) string {
+	return `<ONIXMessage release="3.0">` + strings.Join(products, "") + `</ONIXMessage>`
+}
+
+// testHarvester returns a harvester storing to a new database indexed by fn,
+// or by indexFn if nil, and a function removing the database.
+func testHarvester(t *testing.T, fn storage.IndexFn) (*harvester, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "otra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn == nil {
+		fn = (*problemLog)(nil).indexFn(indexFn)
+	}
+	db, err := storage.Open(filepath.Join(dir, "db"), fn)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	h := &harvester{
+		db:         db,
+		imageDir:   filepath.Join(dir, "img"),
+		imageWake:  make(chan struct{}, 1),
+		validator:  validator(defaultValidation),
+		unknownRef: unknownRefReject,
+	}
+	return h, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHarvestBatch(t *testing.T) {
+	h, done := testHarvester(t, nil)
+	defer done()
+	s := &harvestSource{name: "s"}
+	harvest := func(msg, cursor string) (storage.HarvestPage, error) {
+		return h.harvestBatch(s, "", batch{Body: ioutil.NopCloser(strings.NewReader(msg)), Cursor: cursor})
+	}
+	stored := list1.NotificationConfirmedOnPublication
+
+	// A block update of an unknown record is queued for retry, unless a
+	// later product of the batch stores the record; the rest is stored
+	page, err := harvest(testMessage(
+		testProduct("A", stored, validBlocks),
+		testProduct("X", list1.UpdatePartial, validBlocks),
+		testProduct("Y", list1.UpdatePartial, validBlocks),
+		testProduct("Invalid", stored, ""),
+		testProduct("Y", stored, validBlocks),
+	), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (storage.HarvestCounts{Stored: 2, Failed: 3}); page.HarvestCounts != want {
+		t.Errorf("page => %+v; want %+v", page.HarvestCounts, want)
+	}
+	for _, ref := range []string{"A", "Y"} {
+		if h.db.Ref(ref) == 0 {
+			t.Errorf("product %s not stored", ref)
+		}
+	}
+	if total, retries, _ := h.db.Retries("s", 0); total != 1 || retries[0].Ref != "X" || retries[0].Attempts != 1 {
+		t.Errorf("db.Retries(s) => %d, %+v; want X", total, retries)
+	}
+	if total, _, _ := h.db.QuarantinedProducts(0, 10); total != 1 {
+		t.Errorf("%d products quarantined; want the invalid one", total)
+	}
+	if c, _ := h.db.MetaGet(s.cursorKey()); string(c) != "1" {
+		t.Errorf("cursor => %q; want 1", c)
+	}
+
+	// Storing the record supersedes its queued block update
+	if _, err := harvest(testMessage(testProduct("X", stored, validBlocks)), "2"); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, _ := h.db.Retries("s", 0); total != 0 || h.db.Ref("X") == 0 {
+		t.Errorf("after storing X: %d retries, X stored as %d; want no retries", total, h.db.Ref("X"))
+	}
+
+	// The readable part of a malformed batch is stored, and the rest
+	// quarantined, advancing the cursor past it
+	page, err = harvest(testMessage(
+		testProduct("B", stored, validBlocks),
+		`<Product><RecordReference>C</Recor></Product>`,
+		testProduct("D", stored, validBlocks),
+	), "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Stored != 1 || page.Failed != 1 || h.db.Ref("B") == 0 || h.db.Ref("D") != 0 {
+		t.Errorf("malformed batch => %+v, B stored as %d, D as %d; want B stored", page, h.db.Ref("B"), h.db.Ref("D"))
+	}
+	_, qs, _ := h.db.QuarantinedProducts(0, 10)
+	if q, err := h.db.QuarantinedProduct(qs[len(qs)-1].ID); err != nil || !strings.Contains(q.Raw, "<RecordReference>C</Recor>") || !strings.Contains(q.Raw, ">D<") {
+		t.Errorf("quarantined rest of batch => %+v, %v; want C and D", q, err)
+	}
+	if c, _ := h.db.MetaGet(s.cursorKey()); string(c) != "3" {
+		t.Errorf("cursor => %q; want 3", c)
+	}
+}
+
+func TestHarvestBatchRollback(t *testing.T) {
+	// Products with the reference "Fail" can not be stored, as their index
+	// term is empty
+	h, done := testHarvester(t, func(p *onix.Product) []storage.IndexEntry {
+		term := p.RecordReference.Value
+		if term == "Fail" {
+			term = ""
+		}
+		return []storage.IndexEntry{{Index: "ref", Term: term}}
+	})
+	defer done()
+	s := &harvestSource{name: "s"}
+	if err := h.db.MetaSet(s.cursorKey(), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	stored := list1.NotificationConfirmedOnPublication
+	msg := testMessage(
+		testProduct("A", stored, validBlocks),
+		testProduct("X", list1.UpdatePartial, validBlocks),
+		testProduct("Invalid", stored, ""),
+		testProduct("Fail", stored, validBlocks),
+		testProduct("B", stored, validBlocks),
+	)
+
+	// An error of storage itself fails the whole batch
+	if _, err := h.harvestBatch(s, "0", batch{Body: ioutil.NopCloser(strings.NewReader(msg)), Cursor: "1"}); err == nil {
+		t.Fatal("harvestBatch => nil error; want the batch to fail")
+	}
+	if h.db.Ref("A") != 0 || h.db.Ref("B") != 0 {
+		t.Errorf("products stored from failed batch: A as %d, B as %d", h.db.Ref("A"), h.db.Ref("B"))
+	}
+	if total, _, _ := h.db.Retries("", 0); total != 0 {
+		t.Errorf("%d products queued for retry from failed batch; want 0", total)
+	}
+	if total, _, _ := h.db.QuarantinedProducts(0, 10); total != 0 {
+		t.Errorf("%d products quarantined from failed batch; want 0", total)
+	}
+	if c, _ := h.db.MetaGet(s.cursorKey()); string(c) != "0" {
+		t.Errorf("cursor after failed batch => %q; want 0", c)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list1"
+	"github.com/knakk/otra/storage"
+)
+
+// Records are flagged by indexing them under flagIndex. Records flagged
+// as flagHidden are left out of searches, unless asked for.
+const (
+	flagIndex  = "flag"
+	flagHidden = "hidden"
+)
+
+// Policy actions, in order of precedence.
+const (
+	policyStore  = "store"  // store the record
+	policyFlag   = "flag"   // store and flag the record
+	policyHide   = "hide"   // store and flag the record, and hide it from searches
+	policyDelete = "delete" // delete the record if stored
+)
+
+var policyActions = map[string]int{
+	policyStore:  0,
+	policyFlag:   1,
+	policyHide:   2,
+	policyDelete: 3,
+}
+
+// policyRule matches records on NotificationType, PublishingStatus and
+// ProductAvailability. Empty conditions match any record; a rule with
+// several conditions matches if all of them do.
+type policyRule struct {
+	NotificationType    string `json:"notificationType"`
+	PublishingStatus    string `json:"publishingStatus"`
+	ProductAvailability string `json:"productAvailability"`
+	Action              string `json:"action"`
+	Flag                string `json:"flag"`
+}
+
+// policy decides how records are stored. The action of the matching rule
+// with highest precedence is used, and the flags of all matching rules
+// are applied. Records matching no rules are stored.
+type policy []policyRule
+
+// defaultPolicy stores early notifications, and flags or hides records
+// which are out of print, withdrawn or otherwise unavailable.
+var defaultPolicy = policy{
+	{NotificationType: list1.EarlyNotification, Action: policyFlag, Flag: "early"},
+	{PublishingStatus: "01", Action: policyHide, Flag: "cancelled"},
+	{PublishingStatus: "07", Action: policyFlag, Flag: "out-of-print"},
+	{PublishingStatus: "11", Action: policyHide, Flag: "withdrawn"},
+	{PublishingStatus: "12", Action: policyHide, Flag: "recalled"},
+	{PublishingStatus: "15", Action: policyHide, Flag: "recalled"},
+	{PublishingStatus: "16", Action: policyFlag, Flag: "withdrawn"},
+	{PublishingStatus: "17", Action: policyHide, Flag: "withdrawn"},
+	{ProductAvailability: "40", Action: policyFlag, Flag: "unavailable"},
+	{ProductAvailability: "43", Action: policyFlag, Flag: "unavailable"},
+	{ProductAvailability: "46", Action: policyHide, Flag: "withdrawn"},
+	{ProductAvailability: "51", Action: policyFlag, Flag: "out-of-print"},
+}
+
+// loadPolicy reads a policy from a JSON file, containing a list of rules.
+func loadPolicy(path string) (policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pol policy
+	if err := json.NewDecoder(f).Decode(&pol); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, r := range pol {
+		if _, ok := policyActions[r.Action]; !ok {
+			return nil, fmt.Errorf("%s: rule #%d: unknown action %q (want store, flag, hide or delete)", path, i+1, r.Action)
+		}
+		if r.NotificationType == "" && r.PublishingStatus == "" && r.ProductAvailability == "" {
+			return nil, fmt.Errorf("%s: rule #%d: no conditions", path, i+1)
+		}
+		if (r.Action == policyFlag || r.Action == policyHide) && r.Flag == "" {
+			return nil, fmt.Errorf("%s: rule #%d: missing flag", path, i+1)
+		}
+	}
+	return pol, nil
+}
+
+func (r policyRule) matches(p *onix.Product) bool {
+	if r.NotificationType != "" && p.NotificationType.Value != r.NotificationType {
+		return false
+	}
+	if r.PublishingStatus != "" &&
+		(p.PublishingDetail == nil || p.PublishingDetail.PublishingStatus == nil ||
+			p.PublishingDetail.PublishingStatus.Value != r.PublishingStatus) {
+		return false
+	}
+	if r.ProductAvailability != "" {
+		for _, ps := range p.ProductSupply {
+			for _, sd := range ps.SupplyDetail {
+				if sd.ProductAvailability.Value == r.ProductAvailability {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// decide returns the action to take for the product, and its flags.
+func (pol policy) decide(p *onix.Product) (action string, flags []string) {
+	action = policyStore
+	seen := make(map[string]bool)
+	for _, r := range pol {
+		if !r.matches(p) {
+			continue
+		}
+		if policyActions[r.Action] > policyActions[action] {
+			action = r.Action
+		}
+		if r.Flag != "" && !seen[r.Flag] {
+			seen[r.Flag] = true
+			flags = append(flags, r.Flag)
+		}
+		if r.Action == policyHide && !seen[flagHidden] {
+			seen[flagHidden] = true
+			flags = append(flags, flagHidden)
+		}
+	}
+	sort.Strings(flags)
+	return action, flags
+}
+
+// indexFn wraps fn, indexing the flags of products in the flag index.
+func (pol policy) indexFn(fn storage.IndexFn) storage.IndexFn {
+	return func(p *onix.Product) []storage.IndexEntry {
+		res := fn(p)
+		_, flags := pol.decide(p)
+		for _, f := range flags {
+			res = append(res, storage.IndexEntry{Index: flagIndex, Term: f})
+		}
+		return res
+	}
+}
+
+// searchFilters returns the query filters given by the "flag" and "noflag"
+// parameters. Hidden records are excluded unless explicitly asked for.
+func searchFilters(params map[string][]string) (filters []storage.Filter) {
+	hidden := false
+	for _, f := range params["flag"] {
+		if f == flagHidden {
+			hidden = true
+		}
+		filters = append(filters, storage.Filter{Index: flagIndex, Term: f})
+	}
+	for _, f := range params["noflag"] {
+		filters = append(filters, storage.Filter{Index: flagIndex, Term: f, Exclude: true})
+	}
+	if !hidden {
+		filters = append(filters, storage.Filter{Index: flagIndex, Term: flagHidden, Exclude: true})
+	}
+	return filters
+}
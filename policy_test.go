@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/knakk/kbp/onix/codes/list1"
+	"github.com/knakk/otra/storage"
+)
+
+func TestPolicyDecide(t *testing.T) {
+	pol := policy{
+		{NotificationType: list1.EarlyNotification, Action: policyFlag, Flag: "early"},
+		{PublishingStatus: "07", Action: policyFlag, Flag: "out-of-print"},
+		{PublishingStatus: "11", Action: policyHide, Flag: "withdrawn"},
+		{ProductAvailability: "46", Action: policyHide, Flag: "withdrawn"},
+		{PublishingStatus: "11", ProductAvailability: "40", Action: policyDelete},
+	}
+	product := func(notification, status string, availability ...string) string {
+		blocks := `<PublishingDetail><PublishingStatus>` + status + `</PublishingStatus></PublishingDetail>`
+		if status == "" {
+			blocks = ""
+		}
+		for _, a := range availability {
+			blocks += `<ProductSupply><SupplyDetail><ProductAvailability>` + a + `</ProductAvailability></SupplyDetail></ProductSupply>`
+		}
+		return testProduct("a", notification, blocks)
+	}
+	published := list1.NotificationConfirmedOnPublication
+
+	tests := []struct {
+		product string
+		action  string
+		flags   []string
+	}{
+		{product(published, ""), policyStore, nil},
+		{product(published, "04", "21"), policyStore, nil},
+		{product(list1.EarlyNotification, "02"), policyFlag, []string{"early"}},
+		{product(list1.EarlyNotification, "07"), policyFlag, []string{"early", "out-of-print"}},
+		{product(published, "11"), policyHide, []string{"hidden", "withdrawn"}},
+		{product(published, "04", "21", "46"), policyHide, []string{"hidden", "withdrawn"}},
+		{product(published, "11", "46"), policyHide, []string{"hidden", "withdrawn"}},
+		{product(published, "11", "21", "40"), policyDelete, []string{"hidden", "withdrawn"}},
+		{product(published, "04", "40"), policyStore, nil},
+	}
+	for _, test := range tests {
+		action, flags := pol.decide(mustDecode(t, test.product))
+		if action != test.action || !reflect.DeepEqual(flags, test.flags) {
+			t.Errorf("decide(%s) => %s, %v; want %s, %v", test.product, action, flags, test.action, test.flags)
+		}
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "otra")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		json string
+		err  string // part of the error, if any
+	}{
+		{`[{"publishingStatus": "07", "action": "flag", "flag": "oop"}, {"productAvailability": "40", "action": "delete"}]`, ""},
+		{`[{"publishingStatus": "07", "action": "remove"}]`, "unknown action"},
+		{`[{"action": "delete"}]`, "no conditions"},
+		{`[{"publishingStatus": "07", "action": "hide"}]`, "missing flag"},
+		{`{"action": "delete"}`, "cannot unmarshal"},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "policy.json")
+		if err := ioutil.WriteFile(path, []byte(test.json), 0666); err != nil {
+			t.Fatal(err)
+		}
+		pol, err := loadPolicy(path)
+		switch {
+		case test.err == "" && (err != nil || len(pol) != 2):
+			t.Errorf("#%d: loadPolicy(%s) => %v, %v; want 2 rules", i, test.json, pol, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("#%d: loadPolicy(%s) => %v; want error %q", i, test.json, err, test.err)
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	hidden := storage.Filter{Index: flagIndex, Term: flagHidden, Exclude: true}
+	tests := []struct {
+		params map[string][]string
+		want   []storage.Filter
+	}{
+		{nil, []storage.Filter{hidden}},
+		{map[string][]string{"flag": {"early"}}, []storage.Filter{{Index: flagIndex, Term: "early"}, hidden}},
+		{map[string][]string{"noflag": {"early"}}, []storage.Filter{{Index: flagIndex, Term: "early", Exclude: true}, hidden}},
+		{map[string][]string{"flag": {flagHidden}}, []storage.Filter{{Index: flagIndex, Term: flagHidden}}},
+	}
+	for _, test := range tests {
+		if got := searchFilters(test.params); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("searchFilters(%v) => %+v; want %+v", test.params, got, test.want)
+		}
+	}
+}
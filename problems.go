@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes"
+	"github.com/knakk/otra/storage"
+)
+
+// maxProblems is the number of problems kept per catalogue.
+const maxProblems = 1000
+
+// Stages where problems can occur.
+const (
+	stageIndex   = "index"
+	stageDisplay = "display"
+)
+
+// fieldError is a field of a record which could not be handled.
+type fieldError struct {
+	Field string
+	Err   error
+}
+
+// problem is a field of a record which failed to be indexed or displayed.
+type problem struct {
+	Ref   string
+	Stage string
+	Field string
+	Error string
+	Time  time.Time
+}
+
+type problemKey struct {
+	ref, stage, field string
+}
+
+type recordKey struct {
+	ref, stage string
+}
+
+// problemLog keeps the most recent problems of a catalogue, since startup.
+// Problems are logged when first seen, and not again while they are kept.
+// A nil *problemLog discards problems, logging them every time.
+type problemLog struct {
+	mu       sync.Mutex
+	problems map[problemKey]*list.Element // of problem
+	records  map[recordKey][]string       // fields with problems, by record and stage
+	order    *list.List                   // of problem, least recently reported first
+}
+
+func newProblemLog() *problemLog {
+	return &problemLog{
+		problems: make(map[problemKey]*list.Element),
+		records:  make(map[recordKey][]string),
+		order:    list.New(),
+	}
+}
+
+// report replaces the problems of the record in the given stage.
+func (l *problemLog) report(ref, stage string, errs []fieldError) {
+	if l == nil {
+		for _, e := range errs {
+			log.Printf("%s record %q: field %s: %v", stage, ref, e.Field, e.Err)
+		}
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	rk := recordKey{ref, stage}
+	var fields []string
+	for _, e := range errs {
+		k := problemKey{ref, stage, e.Field}
+		p := problem{Ref: ref, Stage: stage, Field: e.Field, Error: e.Err.Error(), Time: now}
+		if el, ok := l.problems[k]; ok {
+			if el.Value.(problem).Error != p.Error {
+				log.Printf("%s record %q: field %s: %v", stage, ref, e.Field, e.Err)
+			}
+			el.Value = p
+			l.order.MoveToBack(el)
+			continue
+		}
+		log.Printf("%s record %q: field %s: %v", stage, ref, e.Field, e.Err)
+		l.problems[k] = l.order.PushBack(p)
+		fields = append(fields, e.Field)
+	}
+	// Problems no longer reported are solved
+	for _, f := range l.records[rk] {
+		if !reported(errs, f) {
+			l.remove(problemKey{ref, stage, f})
+			continue
+		}
+		fields = append(fields, f)
+	}
+	l.setFields(rk, fields)
+
+	for l.order.Len() > maxProblems {
+		p := l.order.Front().Value.(problem)
+		l.remove(problemKey{p.Ref, p.Stage, p.Field})
+		rk := recordKey{p.Ref, p.Stage}
+		fields := l.records[rk][:0]
+		for _, f := range l.records[rk] {
+			if f != p.Field {
+				fields = append(fields, f)
+			}
+		}
+		l.setFields(rk, fields)
+	}
+}
+
+// reported tells if the field is among the reported errors.
+func reported(errs []fieldError, field string) bool {
+	for _, e := range errs {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *problemLog) remove(k problemKey) {
+	if el, ok := l.problems[k]; ok {
+		l.order.Remove(el)
+		delete(l.problems, k)
+	}
+}
+
+func (l *problemLog) setFields(rk recordKey, fields []string) {
+	if len(fields) == 0 {
+		delete(l.records, rk)
+		return
+	}
+	l.records[rk] = fields
+}
+
+// list returns the problems, most recent first.
+func (l *problemLog) list() (res []problem) {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for el := l.order.Back(); el != nil; el = el.Prev() {
+		res = append(res, el.Value.(problem))
+	}
+	return res
+}
+
+// checkedIndexFn is an IndexFn which also returns the fields it failed to index.
+type checkedIndexFn func(*onix.Product) ([]storage.IndexEntry, []fieldError)
+
+// indexFn returns an IndexFn using fn, which reports the fields fn failed to
+// index. Entries with empty terms are dropped and reported, as they would
+// make storing the record fail.
+func (l *problemLog) indexFn(fn checkedIndexFn) storage.IndexFn {
+	return func(p *onix.Product) []storage.IndexEntry {
+		entries, errs := fn(p)
+		res := entries[:0]
+		for _, e := range entries {
+			if e.Index == "" || e.Term == "" {
+				errs = append(errs, fieldError{Field: "index " + e.Index, Err: fmt.Errorf("empty term")})
+				continue
+			}
+			res = append(res, e)
+		}
+		l.report(p.RecordReference.Value, stageIndex, errs)
+		return res
+	}
+}
+
+// problemLogs holds the problem log of each open catalogue.
+var problemLogs = struct {
+	sync.Mutex
+	m map[*storage.DB]*problemLog
+}{m: make(map[*storage.DB]*problemLog)}
+
+func setProblemLog(db *storage.DB, l *problemLog) {
+	problemLogs.Lock()
+	problemLogs.m[db] = l
+	problemLogs.Unlock()
+}
+
+// problemsOf returns the problem log of the catalogue, or nil if it has none.
+func problemsOf(db *storage.DB) *problemLog {
+	problemLogs.Lock()
+	defer problemLogs.Unlock()
+	return problemLogs.m[db]
+}
+
+// fieldErrors collects the errors of extracting fields from a record.
+type fieldErrors []fieldError
+
+// do calls fn, recovering from any panic, and records it as an error of the field.
+func (errs *fieldErrors) do(field string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			*errs = append(*errs, fieldError{Field: field, Err: fmt.Errorf("panic: %v", r)})
+		}
+	}()
+	fn()
+}
+
+// label returns the Norwegian label of code in a codelist, recording an
+// error for the field if the code is unknown.
+func (errs *fieldErrors) label(field string, item func(string, codes.Language) (codes.Item, error), code string) string {
+	it, err := item(code, codes.Norwegian)
+	if err != nil {
+		*errs = append(*errs, fieldError{Field: field, Err: fmt.Errorf("code %q: %v", code, err)})
+		return code
+	}
+	return it.Label
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestProblemLog(t *testing.T) {
+	l := newProblemLog()
+	errA, errB := fieldError{"a", errors.New("bad a")}, fieldError{"b", errors.New("bad b")}
+	fields := func() (res []string) {
+		for _, p := range l.list() {
+			res = append(res, p.Ref+"/"+p.Stage+"/"+p.Field)
+		}
+		return res
+	}
+
+	l.report("1", stageIndex, []fieldError{errA, errB})
+	l.report("1", stageDisplay, []fieldError{errA})
+	l.report("1", stageIndex, []fieldError{errB, errB})
+	if got, want := fmt.Sprint(fields()), "[1/index/b 1/display/a]"; got != want {
+		t.Errorf("problems after solving 1/index/a => %s; want %s", got, want)
+	}
+	l.report("1", stageDisplay, nil)
+	if got, want := fmt.Sprint(fields()), "[1/index/b]"; got != want {
+		t.Errorf("problems after solving 1/display => %s; want %s", got, want)
+	}
+
+	for i := 0; i < maxProblems+10; i++ {
+		l.report(fmt.Sprint(i+2), stageIndex, []fieldError{errA})
+	}
+	if got := l.order.Len(); got != maxProblems || len(l.problems) != maxProblems || len(l.records) != maxProblems {
+		t.Errorf("%d problems of %d records kept; want %d", got, len(l.records), maxProblems)
+	}
+	if got, want := l.list()[0].Ref, fmt.Sprint(maxProblems+11); got != want {
+		t.Errorf("most recent problem of record %s; want %s", got, want)
+	}
+	if _, ok := l.problems[problemKey{"1", stageIndex, "b"}]; ok {
+		t.Error("oldest problem was kept")
+	}
+}
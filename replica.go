@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+// replicationChange is the XML representation of a storage.Change.
+type replicationChange struct {
+	XMLName xml.Name      `xml:"Change"`
+	Seq     uint64        `xml:"seq,attr"`
+	Op      string        `xml:"op,attr"`
+	ID      uint32        `xml:"id,attr"`
+	Ref     string        `xml:"ref,attr,omitempty"`
+	Time    time.Time     `xml:"time,attr"`
+	Source  string        `xml:"source,attr,omitempty"`
+	Product *onix.Product `xml:"Product,omitempty"`
+}
+
+type replicationChanges struct {
+	Change []replicationChange
+}
+
+// replicator keeps a read-only database up to date with a primary otra
+// instance, by polling it for changes.
+type replicator struct {
+	db           *storage.DB
+	primary      string // base URL of the primary catalogue
+	batchSize    int
+	pollInterval time.Duration
+	secret       string // shared with the primary
+	client       *http.Client
+}
+
+func (r *replicator) Run() {
+	log.Printf("replicator: following %s from change %d", r.primary, r.db.Replicated())
+	for {
+		n, err := r.pull()
+		if err != nil {
+			log.Printf("replicator: %v", err)
+			log.Println("replicator: trying again in 10 seconds")
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		if n > 0 {
+			log.Printf("replicator: applied %d changes", n)
+		}
+		if n == r.batchSize {
+			continue
+		}
+		if err := r.pullImageSet(); err != nil {
+			log.Printf("replicator: failed to get image set: %v", err)
+		}
+		time.Sleep(r.pollInterval)
+	}
+}
+
+// pull fetches and applies the next batch of changes from the primary,
+// returning the number of changes applied.
+func (r *replicator) pull() (int, error) {
+	url := fmt.Sprintf("%s/replication/changes?since=%d&limit=%d", r.primary, r.db.Replicated(), r.batchSize)
+	res, err := r.get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.New(res.Status)
+	}
+
+	var changes replicationChanges
+	if err := xml.NewDecoder(res.Body).Decode(&changes); err != nil {
+		return 0, err
+	}
+	batch := make([]storage.Change, len(changes.Change))
+	for i, c := range changes.Change {
+		batch[i] = storage.Change{Seq: c.Seq, Op: c.Op, ID: c.ID, Ref: c.Ref, Time: c.Time, Source: c.Source, Product: c.Product}
+	}
+	return len(batch), r.db.Apply(batch)
+}
+
+// pullImageSet fetches the set of records which have images from the primary.
+func (r *replicator) pullImageSet() error {
+	res, err := r.get(r.primary + "/replication/images")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.New(res.Status)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return r.db.MetaSet([]byte("hasImage"), b)
+}
+
+// get requests url from the primary, authorized by the shared secret.
+func (r *replicator) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.secret)
+	return r.client.Do(req)
+}
+
+func changesHandler(db *storage.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var since uint64
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "since must be a positive integer", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be an integer >= 1", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		changes, err := db.Changes(since, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		res := replicationChanges{Change: make([]replicationChange, len(changes))}
+		for i, c := range changes {
+			res.Change[i] = replicationChange{Seq: c.Seq, Op: c.Op, ID: c.ID, Ref: c.Ref, Time: c.Time, Source: c.Source, Product: c.Product}
+		}
+		if err := xml.NewEncoder(w).Encode(&res); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+func imageSetHandler(db *storage.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := db.MetaGet([]byte("hasImage"))
+		if err == storage.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	})
+}
+
+// primaryRedirect redirects requests to the same path and query on the
+// primary. It is used by replicas to serve images, which are not replicated.
+func primaryRedirect(primary string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := strings.TrimSuffix(primary, "/") + r.URL.Path
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults for harvesting sources.
+const (
+	defaultRetries        = 5
+	defaultConnectTimeout = 30 * time.Second
+	defaultReadTimeout    = 2 * time.Minute
+	defaultCooldown       = 10 * time.Minute
+	defaultTokenTTL       = time.Hour
+
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// newHTTPClient returns a client which gives up connecting after the connect
+// timeout, and fails requests when the server is silent for longer than the
+// read timeout, both while waiting for the response and reading the body.
+func newHTTPClient(connectTimeout, readTimeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return &timeoutConn{Conn: conn, timeout: readTimeout}, nil
+			},
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: readTimeout,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// timeoutConn is a connection where each read times out.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// backoff returns how long to wait before retry number n (starting at 1):
+// a random duration up to an exponentially growing limit.
+func backoff(n int) time.Duration {
+	limit := maxBackoff
+	if n < 20 {
+		if d := minBackoff << uint(n); d < maxBackoff {
+			limit = d
+		}
+	}
+	return minBackoff + time.Duration(rand.Int63n(int64(limit-minBackoff)+1))
+}
+
+// breaker is a circuit breaker for a source. After more consecutive failures
+// than the number of retries, the circuit opens, and the source is not tried
+// again until the cooldown has passed. If that attempt fails, it opens again.
+type breaker struct {
+	retries  int
+	cooldown time.Duration
+	failures int
+}
+
+// failure records a failed attempt, returning how long to wait before the next.
+func (b *breaker) failure() time.Duration {
+	b.failures++
+	if b.open() {
+		return b.cooldown
+	}
+	return backoff(b.failures)
+}
+
+// success records a successful attempt, closing the circuit.
+func (b *breaker) success() {
+	b.failures = 0
+}
+
+// open reports whether the circuit is open, ie the source is persistently failing.
+func (b *breaker) open() bool {
+	return b.failures > b.retries
+}
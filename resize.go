@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // decode GIF images
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// sizesDir is the directory in a product's image directory where
+	// derivatives and resized images are kept.
+	sizesDir = "sizes"
+
+	// maxImagePixels is the size of the largest image which is decoded.
+	// Resizing it takes about 6 bytes per pixel.
+	maxImagePixels = 16 << 20
+
+	// maxResizing is the number of images resized at once.
+	maxResizing = 2
+
+	jpegQuality = 85
+)
+
+// imageSizes are the widths and heights images are resized to on request.
+// Requested sizes are rounded up to one of them, to limit the number of
+// resized images kept.
+var imageSizes = []int{60, 120, 180, 300, 450, 600, 800, 1200, 2000}
+
+// imageSize returns the smallest of imageSizes which is at least n, or the
+// largest of them.
+func imageSize(n int) int {
+	for _, size := range imageSizes {
+		if size >= n {
+			return size
+		}
+	}
+	return imageSizes[len(imageSizes)-1]
+}
+
+// resizing limits the images being resized to maxResizing.
+var resizing = make(chan struct{}, maxResizing)
+
+// derivative is a standard size of product images, generated when the
+// images are downloaded. It fits within a bounding box.
+type derivative struct {
+	name string
+	w, h int
+}
+
+var derivatives = []derivative{
+	{"thumbnail", 120, 180},
+	{"medium", 300, 450},
+	{"large", 800, 1200},
+}
+
+// derivativeNamed returns the derivative with the given name.
+func derivativeNamed(name string) (derivative, bool) {
+	for _, d := range derivatives {
+		if d.name == name {
+			return d, true
+		}
+	}
+	return derivative{}, false
+}
+
+// imageFormat is a format images can be resized to.
+type imageFormat struct {
+	ext    string
+	encode func(w io.Writer, img image.Image) error
+}
+
+// imageFormats are the formats images can be resized to, by name. WebP is
+// only available when built with the webp tag.
+var imageFormats = map[string]imageFormat{
+	"jpeg": {".jpg", encodeJPEG},
+	"png":  {".png", png.Encode},
+}
+
+// derivativeFormats are the formats derivatives are generated in, if available.
+var derivativeFormats = []string{"jpeg", "webp"}
+
+// errUnavailableFormat is returned for WebP when not built with the webp tag.
+var errUnavailableFormat = errors.New("image format not available")
+
+// imageFormatNamed returns the format with the given name, "jpg" being an
+// alias of "jpeg".
+func imageFormatNamed(name string) (imageFormat, error) {
+	switch name {
+	case "", "jpg":
+		name = "jpeg"
+	}
+	if f, ok := imageFormats[name]; ok {
+		return f, nil
+	}
+	if name == "webp" {
+		return imageFormat{}, errUnavailableFormat
+	}
+	return imageFormat{}, fmt.Errorf("unknown image format: %q", name)
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		// JPEG has no transparency; put the image on white rather than black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+}
+
+// errNoImage is returned when a product has no images.
+var errNoImage = errors.New("no image")
+
+// sourceImage returns the path of the image in a product's image directory
+// which derivatives are made from: org.jpg if it exists, otherwise the
+// largest file.
+func sourceImage(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", errNoImage
+	} else if err != nil {
+		return "", err
+	}
+	var best os.FileInfo
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if fi.Name() == "org.jpg" {
+			best = fi
+			break
+		}
+		if best == nil || fi.Size() > best.Size() {
+			best = fi
+		}
+	}
+	if best == nil {
+		return "", errNoImage
+	}
+	return filepath.Join(dir, best.Name()), nil
+}
+
+// resizedImage returns the path of the product's source image resized to
+// fit within w×h, in the given format, and kept under the given name in
+// the sizes directory. The resized image is made if it is missing or older
+// than the source image.
+func resizedImage(dir, name string, w, h int, f imageFormat) (string, error) {
+	src, err := sourceImage(dir)
+	if err != nil {
+		return "", err
+	}
+	si, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, sizesDir, name+f.ext)
+	if fi, err := os.Stat(path); err == nil && !fi.ModTime().Before(si.ModTime()) {
+		return path, nil
+	}
+
+	resizing <- struct{}{}
+	defer func() { <-resizing }()
+	if fi, err := os.Stat(path); err == nil && !fi.ModTime().Before(si.ModTime()) {
+		// Made while waiting
+		return path, nil
+	}
+	img, err := decodeImage(src)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".resize")
+	if err != nil {
+		return "", err
+	}
+	err = f.encode(tmp, resize(img, w, h))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+// makeDerivatives makes the standard sizes of a product's source image, in
+// the available formats.
+func makeDerivatives(dir string) error {
+	for _, d := range derivatives {
+		for _, name := range derivativeFormats {
+			f, ok := imageFormats[name]
+			if !ok {
+				continue
+			}
+			if _, err := resizedImage(dir, d.name, d.w, d.h, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeImage decodes the image file at path, refusing images too large
+// to be decoded safely.
+func decodeImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// fitSize returns the size of an image of size sw×sh scaled down to fit
+// within w×h, keeping its aspect ratio. A width or height of 0 is
+// unconstrained. Images are never scaled up.
+func fitSize(sw, sh, w, h int) (int, int) {
+	scale := 1.0
+	if w > 0 && float64(w)/float64(sw) < scale {
+		scale = float64(w) / float64(sw)
+	}
+	if h > 0 && float64(h)/float64(sh) < scale {
+		scale = float64(h) / float64(sh)
+	}
+	dw, dh := int(float64(sw)*scale+0.5), int(float64(sh)*scale+0.5)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	return dw, dh
+}
+
+// resize scales img down to fit within w×h, as fitSize, averaging the
+// pixels covered by each pixel of the resized image.
+func resize(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := fitSize(sw, sh, w, h)
+	if dw == sw && dh == sh {
+		return img
+	}
+	src := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += uint64(src.Pix[i])
+					sum[1] += uint64(src.Pix[i+1])
+					sum[2] += uint64(src.Pix[i+2])
+					sum[3] += uint64(src.Pix[i+3])
+					i += 4
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,19 @@
+//go:build webp
+// +build webp
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// Building with the webp tag adds WebP as a format images can be resized
+// to, and derivatives are made in.
+func init() {
+	imageFormats["webp"] = imageFormat{".webp", func(w io.Writer, img image.Image) error {
+		return webp.Encode(w, img, &webp.Options{Quality: jpegQuality})
+	}}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list159"
+	"github.com/knakk/kbp/onix/codes/list162"
+)
+
+// frontCover is the ResourceContentType (ONIX list 158) of front covers.
+const frontCover = "01"
+
+// resourceTypes are the names supporting resources are stored and served
+// under, by ResourceContentType (ONIX list 158). Resources of other types
+// are named by their code.
+var resourceTypes = map[string]string{
+	"02": "backcover",
+	"03": "cover",
+	"04": "contributor",
+	"05": "seriesimage",
+	"06": "serieslogo",
+	"07": "productimage",
+	"08": "productlogo",
+	"09": "publisherlogo",
+	"10": "imprintlogo",
+	"11": "interview",
+	"12": "presentation",
+	"13": "reading",
+	"14": "events",
+	"15": "sample",
+	"16": "widget",
+	"17": "review",
+	"18": "commentary",
+	"19": "readingguide",
+	"20": "teachersguide",
+	"21": "article",
+	"22": "characterinterview",
+	"23": "wallpaper",
+	"24": "pressrelease",
+	"25": "toc",
+	"26": "trailer",
+	"27": "coverthumbnail",
+	"28": "fullcontent",
+	"29": "fullcover",
+	"30": "masterbrandlogo",
+	"31": "description",
+	"32": "index",
+}
+
+// resourceType returns the name of the type of a supporting resource with
+// the given ResourceContentType. It is empty for front covers, and images
+// without a content type, which are the product's images.
+func resourceType(contentType, mode string) string {
+	switch {
+	case contentType == frontCover:
+		return ""
+	case contentType == "" && mode == list159.Image:
+		return ""
+	}
+	if name, ok := resourceTypes[contentType]; ok {
+		return name
+	}
+	if validResourceType(contentType) {
+		return contentType
+	}
+	return "other"
+}
+
+// validResourceType reports whether name can be the name of a resource
+// type: lower case letters and digits only, and not the directory of
+// resized images.
+func validResourceType(name string) bool {
+	if name == "" || name == sizesDir {
+		return false
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// resource is a supporting resource of a product.
+type resource struct {
+	typ  string // as given by resourceType
+	mode string // ResourceMode (ONIX list 159)
+	name string // file name given in the feed, or the last part of the URL
+	url  string
+}
+
+// extractResources returns the supporting resources of the product which
+// can be downloaded: images, audio, video and text.
+func extractResources(p *onix.Product) (res []resource) {
+	if p.CollateralDetail == nil {
+		return nil
+	}
+	for _, r := range p.CollateralDetail.SupportingResource {
+		mode := r.ResourceMode.Value
+		if _, ok := resourceExts[mode]; !ok {
+			continue
+		}
+		typ := resourceType(r.ResourceContentType.Value, mode)
+		for _, v := range r.ResourceVersion {
+			if len(v.ResourceLink) == 0 || v.ResourceLink[0].Value == "" {
+				continue
+			}
+			link := v.ResourceLink[0].Value
+			var name string
+			for _, f := range v.ResourceVersionFeature {
+				if f.ResourceVersionFeatureType.Value == list162.Filename && len(f.FeatureNote) > 0 {
+					name = f.FeatureNote[0].Value
+				}
+			}
+			if name == "" {
+				if u, err := url.Parse(link); err == nil {
+					name = path.Base(u.Path)
+				}
+			}
+			res = append(res, resource{typ: typ, mode: mode, name: name, url: link})
+		}
+	}
+	return res
+}
+
+// resourceExts are the file extensions resources of each ResourceMode
+// are given, the first being the default.
+var resourceExts = map[string][]string{
+	list159.Image: {".jpg", ".jpeg", ".png", ".gif", ".webp"},
+	list159.Audio: {".mp3", ".m4a", ".aac", ".ogg", ".oga", ".wav"},
+	list159.Video: {".mp4", ".m4v", ".webm", ".ogv"},
+	list159.Text:  {".pdf", ".epub", ".txt"},
+}
+
+// audioTypes are the MIME types of audio files, by extension. They are
+// registered with the mime package, which does not know them all.
+var audioTypes = map[string]string{
+	".mp3": "audio/mpeg",
+	".m4a": "audio/mp4",
+	".aac": "audio/aac",
+	".ogg": "audio/ogg",
+	".oga": "audio/ogg",
+	".wav": "audio/wav",
+}
+
+func init() {
+	for ext, typ := range audioTypes {
+		mime.AddExtensionType(ext, typ)
+	}
+}
+
+// audioType returns the MIME type of an audio file named name, whose type
+// was detected from its content as typ, and declared by the server as
+// declared. MP3 files without ID3 tags are not detected, and AAC files are
+// detected as video/mp4, so for them the declared type is used if it is
+// audio, or else the type of the file's extension.
+func audioType(typ, declared, name string) string {
+	if typ != "application/octet-stream" && typ != "video/mp4" {
+		return typ
+	}
+	if mt, _, err := mime.ParseMediaType(declared); err == nil && strings.HasPrefix(mt, "audio/") {
+		return mt
+	}
+	if t, ok := audioTypes[strings.ToLower(path.Ext(name))]; ok {
+		return t
+	}
+	return typ
+}
+
+// resourceName returns a name for a resource of the given ResourceMode,
+// from the file name given in the feed, which is safe to use in the
+// product's directory: no path, only letters, digits, '.', '-' and '_',
+// and not hidden. The name is given an extension of the mode, so it is
+// never served as another type. If nothing is left of the name, a hash of
+// the URL is used.
+func resourceName(name, url, mode string) string {
+	name = path.Base(strings.Replace(name, `\`, "/", -1))
+	b := []byte(name)
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			b[i] = '_'
+		}
+	}
+	name = strings.TrimLeft(string(b), ".")
+
+	exts, ok := resourceExts[mode]
+	if !ok {
+		// Queued before other resources than images were downloaded
+		exts = resourceExts[list159.Image]
+	}
+	ext := strings.ToLower(path.Ext(name))
+	known := false
+	for _, e := range exts {
+		known = known || e == ext
+	}
+	if known {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	} else {
+		ext = exts[0]
+	}
+	if strings.Trim(name, "_") == "" || name == sizesDir {
+		sum := sha256.Sum256([]byte(url))
+		name = hex.EncodeToString(sum[:8])
+	}
+	if len(name)+len(ext) > maxImageName {
+		name = name[:maxImageName-len(ext)]
+	}
+	return name + ext
+}
+
+// acceptedType reports whether a resource of the given ResourceMode may
+// have the MIME type detected from its content.
+func acceptedType(mode, typ string) bool {
+	switch mode {
+	case list159.Audio:
+		return strings.HasPrefix(typ, "audio/") || typ == "application/ogg"
+	case list159.Video:
+		return strings.HasPrefix(typ, "video/") || typ == "application/ogg"
+	case list159.Text:
+		return typ == "application/pdf" || typ == "application/zip" || strings.HasPrefix(typ, "text/plain")
+	}
+	_, ok := imageTypes[typ]
+	return ok
+}
+
+// resourceKind returns how a resource with the given MIME type is shown:
+// as an image, audio, video or a document.
+func resourceKind(typ string) string {
+	for _, kind := range []string{"image", "audio", "video"} {
+		if strings.HasPrefix(typ, kind+"/") {
+			return kind
+		}
+	}
+	return "document"
+}
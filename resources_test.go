@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/knakk/kbp/onix/codes/list159"
+)
+
+func TestResourceName(t *testing.T) {
+	const url = "http://example.org/covers/1"
+	hashed := func(url string) string {
+		sum := sha256.Sum256([]byte(url))
+		return hex.EncodeToString(sum[:8])
+	}
+	longURL := "http://example.org/" + strings.Repeat("x", 5000)
+
+	tests := []struct {
+		name string
+		url  string
+		mode string
+		want string
+	}{
+		{name: "cover.jpg", mode: list159.Image, want: "cover.jpg"},
+		{name: "Cover.PNG", mode: list159.Image, want: "Cover.png"},
+		{name: "cover", mode: list159.Image, want: "cover.jpg"},
+
+		// Traversal and absolute paths
+		{name: "../../etc/passwd", mode: list159.Image, want: "passwd.jpg"},
+		{name: "../cover.jpg", mode: list159.Image, want: "cover.jpg"},
+		{name: `..\..\boot.ini`, mode: list159.Image, want: "boot.ini.jpg"},
+		{name: "/etc/passwd", mode: list159.Image, want: "passwd.jpg"},
+		{name: `C:\covers\cover.png`, mode: list159.Image, want: "cover.png"},
+		{name: "covers/", mode: list159.Image, want: "covers.jpg"},
+
+		// Dot-files
+		{name: ".htaccess", mode: list159.Image, want: "htaccess.jpg"},
+		{name: "..jpg", mode: list159.Image, want: "jpg.jpg"},
+		{name: ".download123", mode: list159.Image, want: "download123.jpg"},
+
+		// Reserved and empty names
+		{name: "sizes", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+		{name: "sizes.jpg", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+		{name: "", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+		{name: ".", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+		{name: "..", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+		{name: "/", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+		{name: "???", url: url, mode: list159.Image, want: hashed(url) + ".jpg"},
+
+		// Overlong names and URLs
+		{name: strings.Repeat("a", 300) + ".jpg", mode: list159.Image, want: strings.Repeat("a", maxImageName-4) + ".jpg"},
+		{name: strings.Repeat("a", 300), mode: list159.Audio, want: strings.Repeat("a", maxImageName-4) + ".mp3"},
+		{name: "", url: longURL, mode: list159.Image, want: hashed(longURL) + ".jpg"},
+
+		// Unsafe characters, and extensions of other modes
+		{name: "a b?c<d>.mp3", mode: list159.Audio, want: "a_b_c_d_.mp3"},
+		{name: "sample.exe", mode: list159.Text, want: "sample.exe.pdf"},
+		{name: "sample.html", mode: list159.Video, want: "sample.html.mp4"},
+		{name: "cover.jpg", mode: list159.Audio, want: "cover.jpg.mp3"},
+		{name: "cover.png", mode: "", want: "cover.png"},
+	}
+	for _, test := range tests {
+		if got := resourceName(test.name, test.url, test.mode); got != test.want {
+			t.Errorf("resourceName(%q, %q, %q) => %q; want %q", test.name, test.url, test.mode, got, test.want)
+		}
+		if got := resourceName(test.want, test.url, test.mode); got != test.want {
+			t.Errorf("resourceName(%q, %q, %q) => %q; want it unchanged", test.want, test.url, test.mode, got)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+)
+
+// shortTags maps ONIX 3.0 reference names to short tags.
+var shortTags = map[string]string{
+	// Message
+	"ONIXMessage":           "ONIXmessage",
+	"Header":                "header",
+	"Sender":                "sender",
+	"SenderIdentifier":      "senderidentifier",
+	"SenderIDType":          "m379",
+	"SenderName":            "x298",
+	"ContactName":           "x299",
+	"EmailAddress":          "j272",
+	"Addressee":             "addressee",
+	"AddresseeName":         "x300",
+	"MessageNumber":         "m180",
+	"MessageRepeat":         "m181",
+	"SentDateTime":          "x307",
+	"MessageNote":           "m183",
+	"DefaultLanguageOfText": "m184",
+	"DefaultPriceType":      "x310",
+	"DefaultCurrencyCode":   "m186",
+	"IDTypeName":            "b233",
+	"IDValue":               "b244",
+
+	// Product record
+	"Product":                "product",
+	"RecordReference":        "a001",
+	"NotificationType":       "a002",
+	"DeletionText":           "a199",
+	"RecordSourceType":       "a194",
+	"RecordSourceIdentifier": "recordsourceidentifier",
+	"RecordSourceIDType":     "x311",
+	"RecordSourceName":       "a197",
+	"ProductIdentifier":      "productidentifier",
+	"ProductIDType":          "b221",
+	"Barcode":                "barcode",
+	"BarcodeType":            "x312",
+	"PositionOnProduct":      "x313",
+
+	// Block 1: Product description
+	"DescriptiveDetail":             "descriptivedetail",
+	"ProductComposition":            "x314",
+	"ProductForm":                   "b012",
+	"ProductFormDetail":             "b333",
+	"ProductFormFeature":            "productformfeature",
+	"ProductFormFeatureType":        "b334",
+	"ProductFormFeatureValue":       "b335",
+	"ProductFormFeatureDescription": "b336",
+	"ProductPackaging":              "b225",
+	"ProductFormDescription":        "b014",
+	"TradeCategory":                 "b384",
+	"PrimaryContentType":            "x416",
+	"ProductContentType":            "b385",
+	"Measure":                       "measure",
+	"MeasureType":                   "x315",
+	"Measurement":                   "c094",
+	"MeasureUnitCode":               "c095",
+	"CountryOfManufacture":          "x316",
+	"EpubTechnicalProtection":       "x317",
+	"EpubUsageConstraint":           "epubusageconstraint",
+	"EpubUsageType":                 "x318",
+	"EpubUsageStatus":               "x319",
+	"EpubUsageLimit":                "epubusagelimit",
+	"Quantity":                      "x320",
+	"EpubUsageUnit":                 "x321",
+	"MapScale":                      "b063",
+	"ProductClassification":         "productclassification",
+	"ProductClassificationType":     "b274",
+	"ProductClassificationCode":     "b275",
+	"Percent":                       "b337",
+	"ProductPart":                   "productpart",
+	"PrimaryPart":                   "x457",
+	"NumberOfItemsOfThisForm":       "x322",
+	"NumberOfCopies":                "x323",
+	"Collection":                    "collection",
+	"CollectionType":                "x329",
+	"SourceName":                    "x330",
+	"CollectionIdentifier":          "collectionidentifier",
+	"CollectionIDType":              "x344",
+	"CollectionSequence":            "collectionsequence",
+	"CollectionSequenceType":        "x479",
+	"CollectionSequenceTypeName":    "x480",
+	"CollectionSequenceNumber":      "x481",
+	"NoCollection":                  "x411",
+	"TitleDetail":                   "titledetail",
+	"TitleType":                     "b202",
+	"TitleElement":                  "titleelement",
+	"SequenceNumber":                "b034",
+	"TitleElementLevel":             "x409",
+	"PartNumber":                    "x410",
+	"YearOfAnnual":                  "b020",
+	"TitlePrefix":                   "b030",
+	"NoPrefix":                      "x501",
+	"TitleWithoutPrefix":            "b031",
+	"TitleText":                     "b203",
+	"Subtitle":                      "b029",
+	"TitleStatement":                "x478",
+	"ThesisType":                    "b368",
+	"ThesisPresentedTo":             "b369",
+	"ThesisYear":                    "b370",
+	"Contributor":                   "contributor",
+	"ContributorRole":               "b035",
+	"FromLanguage":                  "x412",
+	"ToLanguage":                    "x413",
+	"NameType":                      "x414",
+	"NameIdentifier":                "nameidentifier",
+	"NameIDType":                    "x415",
+	"PersonName":                    "b036",
+	"PersonNameInverted":            "b037",
+	"TitlesBeforeNames":             "b038",
+	"NamesBeforeKey":                "b039",
+	"PrefixToKey":                   "b247",
+	"KeyNames":                      "b040",
+	"NamesAfterKey":                 "b041",
+	"SuffixToKey":                   "b248",
+	"LettersAfterNames":             "b042",
+	"TitlesAfterNames":              "b043",
+	"CorporateName":                 "b047",
+	"CorporateNameInverted":         "x443",
+	"AlternativeName":               "alternativename",
+	"ContributorDate":               "contributordate",
+	"ContributorDateRole":           "x417",
+	"DateFormat":                    "j260",
+	"Date":                          "b306",
+	"ProfessionalAffiliation":       "professionalaffiliation",
+	"ProfessionalPosition":          "b045",
+	"Affiliation":                   "b046",
+	"BiographicalNote":              "b044",
+	"Website":                       "website",
+	"WebsiteRole":                   "b367",
+	"WebsiteDescription":            "b294",
+	"WebsiteLink":                   "b295",
+	"ContributorDescription":        "b048",
+	"UnnamedPersons":                "b249",
+	"ContributorPlace":              "contributorplace",
+	"ContributorPlaceRelator":       "x418",
+	"CountryCode":                   "b251",
+	"RegionCode":                    "b398",
+	"ContributorStatement":          "b049",
+	"NoContributor":                 "n339",
+	"EditionType":                   "x419",
+	"EditionNumber":                 "b057",
+	"EditionVersionNumber":          "b217",
+	"EditionStatement":              "b058",
+	"NoEdition":                     "n386",
+	"Language":                      "language",
+	"LanguageRole":                  "b253",
+	"LanguageCode":                  "b252",
+	"ScriptCode":                    "x420",
+	"Extent":                        "extent",
+	"ExtentType":                    "b218",
+	"ExtentValue":                   "b219",
+	"ExtentValueRoman":              "x421",
+	"ExtentUnit":                    "b220",
+	"Illustrated":                   "x422",
+	"NumberOfIllustrations":         "b125",
+	"IllustrationsNote":             "b062",
+	"AncillaryContent":              "ancillarycontent",
+	"AncillaryContentType":          "x423",
+	"AncillaryContentDescription":   "x424",
+	"Number":                        "b257",
+	"Subject":                       "subject",
+	"MainSubject":                   "x425",
+	"SubjectSchemeIdentifier":       "b067",
+	"SubjectSchemeName":             "b171",
+	"SubjectSchemeVersion":          "b068",
+	"SubjectCode":                   "b069",
+	"SubjectHeadingText":            "b070",
+	"NameAsSubject":                 "nameassubject",
+	"AudienceCode":                  "b073",
+	"Audience":                      "audience",
+	"AudienceCodeType":              "b204",
+	"AudienceCodeTypeName":          "b205",
+	"AudienceCodeValue":             "b206",
+	"AudienceRange":                 "audiencerange",
+	"AudienceRangeQualifier":        "b074",
+	"AudienceRangePrecision":        "b075",
+	"AudienceRangeValue":            "b076",
+	"AudienceDescription":           "b207",
+	"Complexity":                    "complexity",
+	"ComplexitySchemeIdentifier":    "b077",
+	"ComplexityCode":                "b078",
+
+	// Block 2: Marketing collateral detail
+	"CollateralDetail":           "collateraldetail",
+	"TextContent":                "textcontent",
+	"TextType":                   "x426",
+	"ContentAudience":            "x427",
+	"Text":                       "d104",
+	"TextAuthor":                 "d107",
+	"TextSourceCorporate":        "b374",
+	"SourceTitle":                "x428",
+	"ContentDate":                "contentdate",
+	"ContentDateRole":            "x429",
+	"CitedContent":               "citedcontent",
+	"CitedContentType":           "x430",
+	"SourceType":                 "x431",
+	"ListName":                   "x432",
+	"PositionOnList":             "x433",
+	"SupportingResource":         "supportingresource",
+	"ResourceContentType":        "x436",
+	"ResourceMode":               "x437",
+	"ResourceFeature":            "resourcefeature",
+	"ResourceFeatureType":        "x438",
+	"FeatureValue":               "x439",
+	"FeatureNote":                "x440",
+	"ResourceVersion":            "resourceversion",
+	"ResourceForm":               "x441",
+	"ResourceVersionFeature":     "resourceversionfeature",
+	"ResourceVersionFeatureType": "x442",
+	"ResourceLink":               "x435",
+	"Prize":                      "prize",
+	"PrizeName":                  "g126",
+	"PrizeYear":                  "g127",
+	"PrizeCountry":               "g128",
+	"PrizeCode":                  "g129",
+	"PrizeStatement":             "x503",
+	"PrizeJury":                  "g343",
+
+	// Block 3: Content detail
+	"ContentDetail":       "contentdetail",
+	"ContentItem":         "contentitem",
+	"LevelSequenceNumber": "b284",
+	"TextItem":            "textitem",
+	"TextItemType":        "b290",
+	"TextItemIdentifier":  "textitemidentifier",
+	"TextItemIDType":      "b285",
+	"PageRun":             "pagerun",
+	"FirstPageNumber":     "b286",
+	"LastPageNumber":      "b287",
+	"NumberOfPages":       "b061",
+	"ComponentTypeName":   "b288",
+	"ComponentNumber":     "b289",
+
+	// Block 4: Publishing detail
+	"PublishingDetail":         "publishingdetail",
+	"Imprint":                  "imprint",
+	"ImprintIdentifier":        "imprintidentifier",
+	"ImprintIDType":            "x445",
+	"ImprintName":              "b079",
+	"Publisher":                "publisher",
+	"PublishingRole":           "b291",
+	"PublisherIdentifier":      "publisheridentifier",
+	"PublisherIDType":          "x447",
+	"PublisherName":            "b081",
+	"Funding":                  "funding",
+	"FundingIdentifier":        "fundingidentifier",
+	"FundingIDType":            "x523",
+	"CityOfPublication":        "b209",
+	"CountryOfPublication":     "b083",
+	"ProductContact":           "productcontact",
+	"ProductContactRole":       "x482",
+	"ProductContactIdentifier": "productcontactidentifier",
+	"ProductContactIDType":     "x483",
+	"ProductContactName":       "x484",
+	"PublishingStatus":         "b394",
+	"PublishingStatusNote":     "b395",
+	"PublishingDate":           "publishingdate",
+	"PublishingDateRole":       "x448",
+	"LatestReprintNumber":      "x446",
+	"CopyrightStatement":       "copyrightstatement",
+	"CopyrightYear":            "b087",
+	"CopyrightOwner":           "copyrightowner",
+	"CopyrightOwnerIdentifier": "copyrightowneridentifier",
+	"CopyrightOwnerIDType":     "b392",
+	"SalesRights":              "salesrights",
+	"SalesRightsType":          "b089",
+	"Territory":                "territory",
+	"CountriesIncluded":        "x449",
+	"RegionsIncluded":          "x450",
+	"CountriesExcluded":        "x451",
+	"RegionsExcluded":          "x452",
+	"SalesRestriction":         "salesrestriction",
+	"SalesRestrictionType":     "b381",
+	"SalesOutlet":              "salesoutlet",
+	"SalesOutletIdentifier":    "salesoutletidentifier",
+	"SalesOutletIDType":        "b393",
+	"SalesOutletName":          "b382",
+	"SalesRestrictionNote":     "x453",
+	"StartDate":                "b324",
+	"EndDate":                  "b325",
+	"ROWSalesRightsType":       "x456",
+
+	// Block 5: Related material
+	"RelatedMaterial":     "relatedmaterial",
+	"RelatedWork":         "relatedwork",
+	"WorkRelationCode":    "x454",
+	"WorkIdentifier":      "workidentifier",
+	"WorkIDType":          "b201",
+	"RelatedProduct":      "relatedproduct",
+	"ProductRelationCode": "x455",
+
+	// Block 6: Product supply
+	"ProductSupply":              "productsupply",
+	"Market":                     "market",
+	"MarketPublishingDetail":     "marketpublishingdetail",
+	"PublisherRepresentative":    "publisherrepresentative",
+	"AgentIdentifier":            "agentidentifier",
+	"AgentIDType":                "j400",
+	"AgentName":                  "j401",
+	"AgentRole":                  "j402",
+	"MarketPublishingStatus":     "j407",
+	"MarketPublishingStatusNote": "x406",
+	"MarketDate":                 "marketdate",
+	"MarketDateRole":             "j408",
+	"PromotionCampaign":          "k165",
+	"PromotionContact":           "k166",
+	"InitialPrintRun":            "k167",
+	"ReprintDetail":              "k309",
+	"CopiesSold":                 "k168",
+	"BookClubAdoption":           "k169",
+	"SupplyDetail":               "supplydetail",
+	"Supplier":                   "supplier",
+	"SupplierRole":               "j292",
+	"SupplierIdentifier":         "supplieridentifier",
+	"SupplierIDType":             "j345",
+	"SupplierName":               "j137",
+	"TelephoneNumber":            "j270",
+	"FaxNumber":                  "j271",
+	"SupplierOwnCoding":          "supplierowncoding",
+	"SupplierCodeType":           "x458",
+	"SupplierCodeValue":          "x459",
+	"ReturnsConditions":          "returnsconditions",
+	"ReturnsCodeType":            "j268",
+	"ReturnsCodeTypeName":        "x460",
+	"ReturnsCode":                "j269",
+	"ProductAvailability":        "j396",
+	"SupplyDate":                 "supplydate",
+	"SupplyDateRole":             "x461",
+	"OrderTime":                  "j144",
+	"NewSupplier":                "newsupplier",
+	"Stock":                      "stock",
+	"LocationIdentifier":         "locationidentifier",
+	"LocationIDType":             "j377",
+	"LocationName":               "j349",
+	"StockQuantityCoded":         "stockquantitycoded",
+	"StockQuantityCodeType":      "j293",
+	"StockQuantityCodeTypeName":  "j296",
+	"StockQuantityCode":          "j297",
+	"OnHand":                     "j350",
+	"Proximity":                  "x502",
+	"OnOrder":                    "j351",
+	"CBO":                        "j375",
+	"OnOrderDetail":              "onorderdetail",
+	"Velocity":                   "velocity",
+	"VelocityMetric":             "x504",
+	"Rate":                       "x505",
+	"PackQuantity":               "j145",
+	"UnpricedItemType":           "j192",
+	"Price":                      "price",
+	"PriceIdentifier":            "priceidentifier",
+	"PriceIDType":                "x506",
+	"PriceType":                  "x462",
+	"PriceQualifier":             "j261",
+	"PriceTypeDescription":       "j262",
+	"PricePer":                   "j239",
+	"PriceCondition":             "pricecondition",
+	"PriceConditionType":         "x463",
+	"PriceConditionQuantity":     "priceconditionquantity",
+	"PriceConditionQuantityType": "x464",
+	"QuantityUnit":               "x466",
+	"MinimumOrderQuantity":       "j263",
+	"BatchBonus":                 "batchbonus",
+	"BatchQuantity":              "j264",
+	"FreeQuantity":               "j265",
+	"DiscountCoded":              "discountcoded",
+	"DiscountCodeType":           "j363",
+	"DiscountCodeTypeName":       "j378",
+	"DiscountCode":               "j364",
+	"Discount":                   "discount",
+	"DiscountType":               "x467",
+	"DiscountPercent":            "j267",
+	"DiscountAmount":             "x469",
+	"PriceStatus":                "j266",
+	"PriceAmount":                "j151",
+	"PriceCoded":                 "pricecoded",
+	"PriceCodeType":              "x465",
+	"PriceCodeTypeName":          "x477",
+	"PriceCode":                  "x468",
+	"Tax":                        "tax",
+	"TaxType":                    "x470",
+	"TaxRateCode":                "x471",
+	"TaxRatePercent":             "x472",
+	"TaxableAmount":              "x473",
+	"TaxAmount":                  "x474",
+	"CurrencyCode":               "j152",
+	"ComparisonProductPrice":     "comparisonproductprice",
+	"PriceDate":                  "pricedate",
+	"PriceDateRole":              "x476",
+	"PrintedOnProduct":           "x301",
+}
+
+// referenceNames maps ONIX 3.0 short tags to reference names.
+var referenceNames = make(map[string]string, len(shortTags))
+
+func init() {
+	for ref, short := range shortTags {
+		referenceNames[short] = ref
+	}
+}
+
+// renamer is a xml.TokenReader which renames elements according to names.
+// Elements not found in names are passed through unchanged.
+type renamer struct {
+	tr    xml.TokenReader
+	names map[string]string
+}
+
+func (r renamer) Token() (xml.Token, error) {
+	t, err := r.tr.Token()
+	switch tok := t.(type) {
+	case xml.StartElement:
+		if name, ok := r.names[tok.Name.Local]; ok {
+			tok.Name.Local = name
+		}
+		return tok, err
+	case xml.EndElement:
+		if name, ok := r.names[tok.Name.Local]; ok {
+			tok.Name.Local = name
+		}
+		return tok, err
+	}
+	return t, err
+}
+
+// newONIXDecoder returns a decoder which reads ONIX messages using either
+// reference names or short tags, translating the latter to reference names.
+func newONIXDecoder(r io.Reader) *xml.Decoder {
+	return xml.NewTokenDecoder(renamer{tr: xml.NewDecoder(r), names: referenceNames})
+}
+
+// shortTagsRequested reports whether ONIX output using short tags was requested.
+func shortTagsRequested(r *http.Request) bool {
+	return r.FormValue("tags") == "short"
+}
+
+// encodeShort writes the XML encoding of v to enc, using short tags.
+func encodeShort(enc *xml.Encoder, v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tr := renamer{tr: xml.NewDecoder(bytes.NewReader(b)), names: shortTags}
+	for {
+		t, err := tr.Token()
+		if err == io.EOF {
+			return enc.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(t); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source is a provider of ONIX products, harvested in batches.
+type Source interface {
+	// Fetch returns the batch following cursor. An empty cursor means
+	// the source's starting point.
+	Fetch(cursor string) (batch, error)
+}
+
+// batch is a batch of products fetched from a source.
+type batch struct {
+	// Body is an ONIX message, or any XML document wrapping Product
+	// elements. It is decoded as it is read, and must be closed.
+	Body io.ReadCloser
+
+	// Cursor is where to continue from. It is opaque to the harvester, and
+	// is stored so that harvesting can be resumed after a restart.
+	Cursor string
+
+	// More is true if the next batch can be fetched at once, rather than
+	// after the poll interval.
+	More bool
+}
+
+// requestAuthorizer is implemented by sources which need to authorize
+// requests for resources linked from their products, ie images.
+type requestAuthorizer interface {
+	authorize(req *http.Request) error
+	// expireToken makes the next request obtain a new token, after a
+	// request was refused with the current one.
+	expireToken()
+}
+
+// Source types.
+const (
+	sourceBoknett = "boknett"
+	sourceOAIPMH  = "oai-pmh"
+	sourceFolder  = "folder"
+	sourceHTTP    = "http"
+)
+
+// sourceConfig is the configuration of a source. Which fields are used
+// depends on the type.
+type sourceConfig struct {
+	Name string `json:"name"` // unique within the catalogue; not runs or status
+	Type string `json:"type"` // one of the source types; default boknett
+
+	PollInterval duration `json:"poll"`
+
+	// Before is how long before the current time to start harvesting
+	// from, when a Boknett source has no cursor. Default -harvest-before.
+	Before duration `json:"before"`
+
+	// Retries is the number of consecutive failures retried with backoff,
+	// before the source is considered unhealthy and left alone for the
+	// cooldown. Zero means the default.
+	Retries        int      `json:"retries"`
+	Cooldown       duration `json:"cooldown"`
+	ConnectTimeout duration `json:"connectTimeout"`
+	ReadTimeout    duration `json:"readTimeout"`
+
+	// TokenTTL is how long a Boknett token is used before it is renewed.
+	TokenTTL duration `json:"tokenTTL"`
+
+	Endpoint     string `json:"endpoint"`
+	AuthEndpoint string `json:"auth"`
+	Username     string `json:"user"`
+	Password     string `json:"pass"`
+	BatchSize    int    `json:"size"`
+
+	// OAI-PMH
+	MetadataPrefix string `json:"metadataPrefix"`
+	Set            string `json:"set"`
+
+	// Watch-folder
+	Dir string `json:"dir"`
+
+	// Paged HTTP feed
+	CursorParam string `json:"cursorParam"` // default "cursor"
+	NextHeader  string `json:"nextHeader"`  // default "Next"
+
+	// Spool copies each batch to a temporary file before decoding it, rather
+	// than decoding it from the network, for slow connections which would
+	// otherwise be reset while products are stored.
+	Spool bool `json:"spool"`
+}
+
+// newSource returns the source described by the configuration, making
+// requests with the given client.
+func newSource(c sourceConfig, client *http.Client) (Source, error) {
+	switch c.Type {
+	case "", sourceBoknett:
+		if c.Endpoint == "" || c.AuthEndpoint == "" || c.Username == "" || c.Password == "" {
+			return nil, errors.New("boknett source: missing endpoint, auth, user or pass")
+		}
+		return &boknettSource{
+			endpoint:     c.Endpoint,
+			authEndpoint: c.AuthEndpoint,
+			username:     c.Username,
+			password:     c.Password,
+			batchSize:    c.BatchSize,
+			before:       c.Before.Duration,
+			tokenTTL:     c.TokenTTL.Duration,
+			client:       client,
+		}, nil
+	case sourceOAIPMH:
+		if c.Endpoint == "" || c.MetadataPrefix == "" {
+			return nil, errors.New("oai-pmh source: missing endpoint or metadataPrefix")
+		}
+		return &oaiSource{endpoint: c.Endpoint, prefix: c.MetadataPrefix, set: c.Set, client: client}, nil
+	case sourceFolder:
+		if c.Dir == "" {
+			return nil, errors.New("folder source: missing dir")
+		}
+		return &folderSource{dir: c.Dir}, nil
+	case sourceHTTP:
+		if c.Endpoint == "" {
+			return nil, errors.New("http source: missing endpoint")
+		}
+		s := &httpSource{
+			endpoint:    c.Endpoint,
+			cursorParam: c.CursorParam,
+			nextHeader:  c.NextHeader,
+			batchSize:   c.BatchSize,
+			client:      client,
+		}
+		if s.cursorParam == "" {
+			s.cursorParam = "cursor"
+		}
+		if s.nextHeader == "" {
+			s.nextHeader = "Next"
+		}
+		return s, nil
+	}
+	return nil, validSourceType(c.Type)
+}
+
+// openBody returns the body of a response, or an error if the request failed.
+func openBody(res *http.Response, err error) (io.ReadCloser, error) {
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &statusError{Code: res.StatusCode, Status: res.Status, Body: string(bytes.TrimSpace(b))}
+	}
+	return res.Body, nil
+}
+
+// statusError is the error of a request answered with another status than 200 OK.
+type statusError struct {
+	Code   int
+	Status string
+	Body   string
+}
+
+func (e *statusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("request failed: %v", e.Status)
+	}
+	return fmt.Sprintf("request failed: %v: %s", e.Status, e.Body)
+}
+
+// boknettSource harvests from Boknett. Its cursor is either a next token
+// given by the server, or "after:" followed by the time to harvest changes
+// after, as yyyyMMddHHmmss. The token is renewed when it is older than the
+// token TTL, or rejected by the server.
+type boknettSource struct {
+	endpoint     string
+	authEndpoint string
+	username     string
+	password     string
+	batchSize    int
+	before       time.Duration
+	tokenTTL     time.Duration
+	client       *http.Client
+
+	mu        sync.Mutex // protects token
+	token     string
+	tokenTime time.Time
+}
+
+const boknettTime = "20060102150405" // yyyyMMddHHmmss
+
+func (s *boknettSource) Fetch(cursor string) (batch, error) {
+	start := time.Now()
+	q := url.Values{}
+	switch {
+	case cursor == "":
+		q.Add("after", start.Add(-s.before).Format(boknettTime))
+	case strings.HasPrefix(cursor, "after:"):
+		q.Add("after", strings.TrimPrefix(cursor, "after:"))
+	default:
+		q.Add("next", cursor)
+	}
+	q.Add("subscription", "extended")
+	q.Add("pagesize", strconv.Itoa(s.batchSize))
+
+	var (
+		res  *http.Response
+		body io.ReadCloser
+	)
+	for retried := false; ; retried = true {
+		req, err := http.NewRequest("GET", s.endpoint, nil)
+		if err != nil {
+			return batch{}, err
+		}
+		rq := req.URL.Query()
+		for k, v := range q {
+			rq[k] = v
+		}
+		req.URL.RawQuery = rq.Encode()
+		if err := s.authorize(req); err != nil {
+			return batch{}, err
+		}
+		res, err = s.client.Do(req)
+		body, err = openBody(res, err)
+		if se, ok := err.(*statusError); ok && se.Code == http.StatusUnauthorized && !retried {
+			s.expireToken()
+			continue
+		}
+		if err != nil {
+			return batch{}, err
+		}
+		break
+	}
+
+	if next := res.Header.Get("Next"); next != "" && res.Header.Get("Link") != "" {
+		return batch{Body: body, Cursor: next, More: true}, nil
+	}
+	// No more records; harvest changes made since this request on next poll.
+	return batch{Body: body, Cursor: "after:" + start.Format(boknettTime)}, nil
+}
+
+// authorize sets the authorization headers of the request, obtaining a new
+// token first if needed.
+func (s *boknettSource) authorize(req *http.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == "" || s.tokenTTL > 0 && time.Since(s.tokenTime) > s.tokenTTL {
+		if err := s.getToken(); err != nil {
+			return fmt.Errorf("boknett: failed to get token: %v", err)
+		}
+	}
+	req.Header.Set("Date", time.Now().UTC().Format(time.RFC1123))
+	req.Header.Set("Authorization", "Boknett "+s.token)
+	return nil
+}
+
+// expireToken makes the next request obtain a new token.
+func (s *boknettSource) expireToken() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+func (s *boknettSource) getToken() error {
+	res, err := s.client.PostForm(s.authEndpoint,
+		url.Values{"username": {s.username}, "password": {s.password}})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return errors.New(res.Status)
+	}
+	s.token = res.Header.Get("Boknett-TGT")
+	s.tokenTime = time.Now()
+	return nil
+}
+
+// oaiSource harvests ONIX records from an OAI-PMH repository using
+// ListRecords. Its cursor is either a resumption token, or "from:" followed
+// by the response date of the last completed list. Deleted records are
+// not handled, as OAI-PMH identifiers are not record references. Responses
+// are spooled to a temporary file, as the resumption token comes last.
+type oaiSource struct {
+	endpoint string
+	prefix   string
+	set      string
+	client   *http.Client
+}
+
+// oaiResponse is the part of an OAI-PMH response needed to continue the list.
+type oaiResponse struct {
+	ResponseDate string `xml:"responseDate"`
+	Error        struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"error"`
+	ResumptionToken string `xml:"ListRecords>resumptionToken"`
+}
+
+func (s *oaiSource) Fetch(cursor string) (batch, error) {
+	q := url.Values{"verb": {"ListRecords"}}
+	if strings.HasPrefix(cursor, "from:") || cursor == "" {
+		q.Set("metadataPrefix", s.prefix)
+		if s.set != "" {
+			q.Set("set", s.set)
+		}
+		if from := strings.TrimPrefix(cursor, "from:"); from != "" {
+			q.Set("from", from)
+		}
+	} else {
+		q.Set("resumptionToken", cursor)
+	}
+	body, err := openBody(s.client.Get(s.endpoint + "?" + q.Encode()))
+	if err != nil {
+		return batch{}, err
+	}
+	f, err := spool(body)
+	body.Close()
+	if err != nil {
+		return batch{}, err
+	}
+
+	var res oaiResponse
+	err = xml.NewDecoder(f).Decode(&res)
+	if err == nil {
+		_, err = f.(io.Seeker).Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return batch{}, err
+	}
+	switch res.Error.Code {
+	case "":
+	case "noRecordsMatch":
+		f.Close()
+		if cursor == "" {
+			cursor = "from:" + res.ResponseDate
+		}
+		return batch{Body: http.NoBody, Cursor: cursor}, nil
+	default:
+		f.Close()
+		return batch{}, fmt.Errorf("oai-pmh: %s: %s", res.Error.Code, strings.TrimSpace(res.Error.Message))
+	}
+	if token := strings.TrimSpace(res.ResumptionToken); token != "" {
+		return batch{Body: f, Cursor: token, More: true}, nil
+	}
+	return batch{Body: f, Cursor: "from:" + res.ResponseDate}, nil
+}
+
+// folderSource harvests ONIX files put in a directory, in order of their
+// names. Its cursor is the name of the last file harvested, so files should
+// be named so that newer files sort last, ie by a timestamp prefix.
+type folderSource struct {
+	dir string
+}
+
+func (s *folderSource) Fetch(cursor string) (batch, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.xml"))
+	if err != nil {
+		return batch{}, err
+	}
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	sort.Strings(names)
+	i := sort.Search(len(names), func(i int) bool { return names[i] > cursor })
+	if i == len(names) {
+		return batch{Body: http.NoBody, Cursor: cursor}, nil
+	}
+	f, err := os.Open(filepath.Join(s.dir, names[i]))
+	if err != nil {
+		return batch{}, err
+	}
+	return batch{Body: f, Cursor: names[i], More: i+1 < len(names)}, nil
+}
+
+// httpSource harvests a generic paged feed of ONIX messages. The cursor is
+// passed as a query parameter, and the cursor of the next page is read from
+// a response header. When there are no more pages, the last cursor is kept,
+// so that the last page is fetched again on the next poll.
+type httpSource struct {
+	endpoint    string
+	cursorParam string
+	nextHeader  string
+	batchSize   int
+	client      *http.Client
+}
+
+func (s *httpSource) Fetch(cursor string) (batch, error) {
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return batch{}, err
+	}
+	q := u.Query()
+	if cursor != "" {
+		q.Set(s.cursorParam, cursor)
+	}
+	if s.batchSize > 0 {
+		q.Set("pagesize", strconv.Itoa(s.batchSize))
+	}
+	u.RawQuery = q.Encode()
+
+	res, err := s.client.Get(u.String())
+	body, err := openBody(res, err)
+	if err != nil {
+		return batch{}, err
+	}
+	if next := res.Header.Get(s.nextHeader); next != "" && next != cursor {
+		return batch{Body: body, Cursor: next, More: true}, nil
+	}
+	return batch{Body: body, Cursor: cursor}, nil
+}
+
+// validSourceType returns an error if typ is not a known source type.
+func validSourceType(typ string) error {
+	switch typ {
+	case "", sourceBoknett, sourceOAIPMH, sourceFolder, sourceHTTP:
+		return nil
+	}
+	return fmt.Errorf("unknown source type %q (want one of %s, %s, %s, %s)",
+		typ, sourceBoknett, sourceOAIPMH, sourceFolder, sourceHTTP)
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// ErrCatalogueExists is returned when opening a catalogue with a name
+// which is already in use.
+var ErrCatalogueExists = errors.New("catalogue already exists")
+
+// Catalogues represents a set of named databases, each stored in its own file
+// and indexed with its own indexing function.
+type Catalogues struct {
+	mu    sync.RWMutex
+	names []string
+	dbs   map[string]*DB
+}
+
+// CatalogueHit represents a record ID in a named catalogue.
+type CatalogueHit struct {
+	Catalogue string
+	ID        uint32
+}
+
+// NewCatalogues returns an empty set of catalogues.
+func NewCatalogues() *Catalogues {
+	return &Catalogues{dbs: make(map[string]*DB)}
+}
+
+// Open opens the database at the given path, using the given indexing function,
+// and adds it to the set under the given name.
+func (c *Catalogues) Open(name, path string, fn IndexFn) (*DB, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.dbs[name]; ok {
+		return nil, ErrCatalogueExists
+	}
+	db, err := Open(path, fn)
+	if err != nil {
+		return nil, err
+	}
+	c.dbs[name] = db
+	c.names = append(c.names, name)
+	return db, nil
+}
+
+// Get returns the database of the named catalogue, if it exists.
+func (c *Catalogues) Get(name string) (*DB, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	db, ok := c.dbs[name]
+	return db, ok
+}
+
+// Names returns the names of the catalogues, in the order they were opened.
+func (c *Catalogues) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.names...)
+}
+
+// Close closes all the databases, returning the first error encountered.
+func (c *Catalogues) Close() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range c.names {
+		if err2 := c.dbs[name].Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// Query performs a query against the given index in each of the named
+// catalogues, or all catalogues if no names are given. Hits are ordered by
+// catalogue, in the order the names are given, and returned like DB.Query.
+// Catalogues where the index does not exist are skipped.
+func (c *Catalogues) Query(names []string, index, query string, offset, limit int, filters ...Filter) (total int, res []CatalogueHit, err error) {
+	if len(names) == 0 {
+		names = c.Names()
+	}
+	var all []CatalogueHit
+	for _, name := range names {
+		db, ok := c.Get(name)
+		if !ok {
+			return 0, nil, fmt.Errorf("catalogue not found: %s", name)
+		}
+		if !db.hasIndex(index) {
+			continue
+		}
+		_, ids, err := db.Query(index, query, 0, math.MaxInt32, filters...)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, id := range ids {
+			all = append(all, CatalogueHit{Catalogue: name, ID: id})
+		}
+	}
+	total = len(all)
+	return total, all[min(offset, total):min(offset+limit, total)], nil
+}
@@ -3,10 +3,13 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/boltdb/bolt"
@@ -16,9 +19,36 @@ import (
 // Exported errors
 var (
 	ErrNotFound = errors.New("not found")
+	ErrDeleted  = errors.New("deleted")
 	ErrDBFull   = errors.New("database full: id limit reached")
 )
 
+// buckets are the top-level buckets required by the database.
+var buckets = [][]byte{
+	[]byte("meta"),
+	[]byte("products"),
+	[]byte("indexes"),
+	[]byte("ref"),
+	[]byte("works"),
+	[]byte("workrelated"),
+	[]byte("workaliases"),
+	[]byte("tombstones"),
+	[]byte("deletions"),
+	[]byte("changes"),
+	[]byte("changeids"),
+	[]byte("quarantine"),
+	[]byte("quarantinerefs"),
+	[]byte("sources"),
+	[]byte("retries"),
+	[]byte("retryrefs"),
+	[]byte("retrysources"),
+	[]byte("imagequeue"),
+	[]byte("images"),
+	[]byte("harvestruns"),
+	[]byte("harvestpages"),
+	[]byte("harvestsources"),
+}
+
 // MaxProducts represents the maxiumum number of products the database can store.
 const MaxProducts = 4294967295
 
@@ -29,26 +59,78 @@ type DB struct {
 	encPool sync.Pool
 	decPool sync.Pool
 	indexFn IndexFn
+	workFn  WorkFn
+
+	readOnly bool
 }
 
 // Open opens a database at the given path, using the given indexing function.
-// If the database does not exist, a new will be created.
+// If the database does not exist, a new will be created. It cannot be opened
+// while another process has it open.
 func Open(path string, fn IndexFn) (*DB, error) {
-	kv, err := bolt.Open(path, 0666, nil)
+	kv, err := openBolt(path, false)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newDB(kv, fn)
 	if err != nil {
 		return nil, err
 	}
+	return db.setup()
+}
+
+// OpenReadOnly opens an existing database at the given path for reading only.
+// Other processes can read the database at the same time, but it cannot be
+// opened while another process has it open with Open.
+func OpenReadOnly(path string, fn IndexFn) (*DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	kv, err := openBolt(path, true)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newDB(kv, fn)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+	err = kv.View(func(tx *bolt.Tx) error {
+		for _, b := range buckets {
+			if tx.Bucket(b) == nil {
+				return fmt.Errorf("%s: missing bucket %q; open the database with write access once to upgrade it", path, b)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		kv.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openBolt opens the bolt database at path, failing rather than waiting if
+// another process has it locked.
+func openBolt(path string, readOnly bool) (*bolt.DB, error) {
+	kv, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: readOnly, Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s: database is in use by another process", path)
+	}
+	return kv, err
+}
+
+func newDB(kv *bolt.DB, fn IndexFn) (*DB, error) {
 	codec, err := newPrimedCodec(&onix.Product{})
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{
+	return &DB{
 		kv:      kv,
 		encPool: sync.Pool{New: func() interface{} { return codec.NewMarshaler() }},
 		decPool: sync.Pool{New: func() interface{} { return codec.NewUnmarshaler() }},
 		indexFn: fn,
-	}
-	return db.setup()
+	}, nil
 }
 
 // Close closes the database, releasing the lock on the file.
@@ -59,18 +141,65 @@ func (db *DB) Close() error {
 func (db *DB) setup() (*DB, error) {
 	// set up required buckets
 	err := db.kv.Update(func(tx *bolt.Tx) error {
-		for _, b := range [][]byte{[]byte("meta"), []byte("products"), []byte("indexes"), []byte("ref")} {
+		for _, b := range buckets {
 			_, err := tx.CreateBucketIfNotExists(b)
 			if err != nil {
 				return err
 			}
 		}
+
+		// Databases created before the change log was introduced need to
+		// have all their products logged, so that they can be replicated.
+		if tx.Bucket([]byte("changes")).Sequence() == 0 {
+			cur := tx.Bucket([]byte("products")).Cursor()
+			for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+				p, err := db.get(tx, btou32(k))
+				if err != nil {
+					return err
+				}
+				if err := db.logChange(tx, OpStore, btou32(k), p.RecordReference.Value, time.Now().UTC()); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Retries queued before the retry queue was indexed.
+		if k, _ := tx.Bucket([]byte("retrysources")).Cursor().First(); k == nil {
+			cur := tx.Bucket([]byte("retries")).Cursor()
+			for k, v := cur.First(); k != nil; k, v = cur.Next() {
+				var r Retry
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				if r.Due.IsZero() {
+					r.Due = r.Time
+				}
+				if err := indexRetry(tx, r); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Harvest runs journaled before they were indexed by source.
+		if k, _ := tx.Bucket([]byte("harvestsources")).Cursor().First(); k == nil {
+			cur := tx.Bucket([]byte("harvestruns")).Cursor()
+			for k, v := cur.First(); k != nil; k, v = cur.Next() {
+				var r HarvestRun
+				if err := json.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				if err := tx.Bucket([]byte("harvestsources")).Put(sourceRunKey(r.Source, r.ID), nil); err != nil {
+					return err
+				}
+			}
+		}
 		return nil
 	})
 	return db, err
 }
 
-// Get will retrieve the Product with the give ID, if it exists.
+// Get will retrieve the Product with the give ID, if it exists. If the product
+// has been deleted, ErrDeleted is returned.
 func (db *DB) Get(id uint32) (p *onix.Product, err error) {
 	err = db.kv.View(func(tx *bolt.Tx) error {
 		var err2 error
@@ -88,6 +217,9 @@ func (db *DB) get(tx *bolt.Tx, id uint32) (p *onix.Product, err error) {
 	b := bkt.Get(u32tob(id))
 	if b == nil {
 		err = ErrNotFound
+		if tx.Bucket([]byte("tombstones")).Get(u32tob(id)) != nil {
+			err = ErrDeleted
+		}
 		return p, err
 	}
 	dec := db.decPool.Get().(*primedDecoder)
@@ -99,52 +231,105 @@ func (db *DB) get(tx *bolt.Tx, id uint32) (p *onix.Product, err error) {
 // was assigned. If there already exist a prouduct with the same RecordReference,
 // it will be overwritten.
 func (db *DB) Store(p *onix.Product) (id uint32, err error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
 	err = db.kv.Update(func(tx *bolt.Tx) error {
-		var idb []byte
-		bkt := tx.Bucket([]byte("products"))
-
-		ref := tx.Bucket([]byte("ref")).Get([]byte(p.RecordReference.Value))
-		if ref != nil {
-			// There is already a store product with the same RecordReference
-			idb = ref
-			id = btou32(idb)
-
-			// We need update the indexes, removing the entires on the existing record,
-			// before storing an inserting the (potentially changed) record again.
-			if err := db.deIndex(tx, idb); err != nil {
-				return err
-			}
-		} else {
-			// Assign a new ID
-			n, _ := bkt.NextSequence()
-			if n > MaxProducts {
-				return ErrDBFull
-			}
+		var err2 error
+		id, err2 = db.store(tx, p)
+		return err2
+	})
+	return id, err
+}
 
-			id = uint32(n)
-			idb = u32tob(uint32(n))
-		}
+// Update applies fn to the stored product with the given RecordReference, and
+// stores and reindexes the result. If there is no such product, ErrNotFound
+// is returned. If fn returns an error, the stored product is left unchanged.
+func (db *DB) Update(ref string, fn func(p *onix.Product) error) (id uint32, err error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	err = db.kv.Update(func(tx *bolt.Tx) error {
+		var err2 error
+		id, err2 = db.update(tx, "", ref, fn)
+		return err2
+	})
+	return id, err
+}
 
-		enc := db.encPool.Get().(*primedEncoder)
-		defer db.encPool.Put(enc)
-		b, err := enc.Marshal(p)
-		if err != nil {
-			return err
+func (db *DB) update(tx *bolt.Tx, source, ref string, fn func(p *onix.Product) error) (uint32, error) {
+	idb := tx.Bucket([]byte("ref")).Get([]byte(ref))
+	if idb == nil {
+		return 0, ErrNotFound
+	}
+	p, err := db.get(tx, btou32(idb))
+	if err != nil {
+		return 0, err
+	}
+	if err := fn(p); err != nil {
+		return 0, err
+	}
+	if p.RecordReference.Value != ref {
+		return 0, errors.New("storage: Update must not change RecordReference")
+	}
+	return db.storeFrom(tx, source, p)
+}
+
+func (db *DB) store(tx *bolt.Tx, p *onix.Product) (id uint32, err error) {
+	var idb []byte
+	bkt := tx.Bucket([]byte("products"))
+
+	ref := tx.Bucket([]byte("ref")).Get([]byte(p.RecordReference.Value))
+	if ref != nil {
+		// There is already a store product with the same RecordReference
+		idb = ref
+		id = btou32(idb)
+
+		// We need update the indexes, removing the entires on the existing record,
+		// before storing an inserting the (potentially changed) record again.
+		if err := db.deIndex(tx, idb); err != nil {
+			return 0, err
 		}
-		if err := bkt.Put(idb, b); err != nil {
-			return err
+	} else {
+		// Assign a new ID
+		n, _ := bkt.NextSequence()
+		if n > MaxProducts {
+			return 0, ErrDBFull
 		}
 
-		if ref == nil {
-			// Store the record reference
-			if err := tx.Bucket([]byte("ref")).Put([]byte(p.RecordReference.Value), idb); err != nil {
-				return err
-			}
+		id = uint32(n)
+		idb = u32tob(uint32(n))
+	}
+
+	enc := db.encPool.Get().(*primedEncoder)
+	defer db.encPool.Put(enc)
+	b, err := enc.Marshal(p)
+	if err != nil {
+		return 0, err
+	}
+	// The encoder's buffer is reused, but the value must stay valid for
+	// the rest of the transaction, as it may store several products.
+	if err := bkt.Put(idb, append([]byte(nil), b...)); err != nil {
+		return 0, err
+	}
+
+	if ref == nil {
+		// Store the record reference
+		if err := tx.Bucket([]byte("ref")).Put([]byte(p.RecordReference.Value), idb); err != nil {
+			return 0, err
 		}
+	}
 
-		return db.index(tx, p, id)
-	})
-	return id, err
+	if err := db.index(tx, p, id); err != nil {
+		return 0, err
+	}
+
+	// A stored product supersedes any quarantined version of it
+	if err := db.unquarantineRef(tx, p.RecordReference.Value); err != nil {
+		return 0, err
+	}
+
+	return id, db.logChange(tx, OpStore, id, p.RecordReference.Value, time.Now().UTC())
 }
 
 // Ref returns the product ID for the given product reference. If not found,
@@ -160,51 +345,73 @@ func (db *DB) Ref(ref string) (u uint32) {
 	return u
 }
 
+// Delete removes the product with the given ID, leaving a tombstone in its place.
 func (db *DB) Delete(id uint32) (err error) {
+	if db.readOnly {
+		return ErrReadOnly
+	}
 	err = db.kv.Update(func(tx *bolt.Tx) error {
 		p, err2 := db.get(tx, id)
 		if err2 != nil {
 			return err2
 		}
-
-		idb := u32tob(id)
-		if err := db.deIndex(tx, idb); err != nil {
-			return err
-		}
-
-		if err := tx.Bucket([]byte("products")).Delete(idb); err != nil {
-			return err
-		}
-
-		if err := tx.Bucket([]byte("ref")).Delete([]byte(p.RecordReference.Value)); err != nil {
-			return err
-		}
-
-		return nil
+		return db.remove(tx, p, id, time.Now().UTC())
 	})
 	return err
 }
 
+// DeleteByRef removes the product with the given RecordReference, leaving a
+// tombstone in its place.
 func (db *DB) DeleteByRef(ref string) (err error) {
-	err = db.kv.Update(func(tx *bolt.Tx) error {
-		ref := tx.Bucket([]byte("ref")).Get([]byte(ref))
-		if ref == nil {
-			return ErrNotFound
-		}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		return db.removeByRef(tx, ref)
+	})
+}
 
-		idb := ref
+func (db *DB) removeByRef(tx *bolt.Tx, ref string) error {
+	idb := tx.Bucket([]byte("ref")).Get([]byte(ref))
+	if idb == nil {
+		return ErrNotFound
+	}
+	id := btou32(idb)
+	p, err := db.get(tx, id)
+	if err != nil {
+		return err
+	}
+	return db.remove(tx, p, id, time.Now().UTC())
+}
 
-		if err := db.deIndex(tx, idb); err != nil {
-			return err
-		}
+// remove removes the product, deleted at time t.
+func (db *DB) remove(tx *bolt.Tx, p *onix.Product, id uint32, t time.Time) error {
+	idb := u32tob(id)
+	if err := db.deIndex(tx, idb); err != nil {
+		return err
+	}
 
-		if err := tx.Bucket([]byte("products")).Delete(idb); err != nil {
-			return err
-		}
+	if err := tx.Bucket([]byte("products")).Delete(idb); err != nil {
+		return err
+	}
 
-		return nil
-	})
-	return err
+	if err := tx.Bucket([]byte("ref")).Delete([]byte(p.RecordReference.Value)); err != nil {
+		return err
+	}
+
+	if err := db.removeSource(tx, id); err != nil {
+		return err
+	}
+
+	if err := removeImagesOf(tx, id); err != nil {
+		return err
+	}
+
+	if err := db.bury(tx, p, id, t); err != nil {
+		return err
+	}
+
+	return db.logChange(tx, OpDelete, id, p.RecordReference.Value, t)
 }
 
 func (db *DB) index(tx *bolt.Tx, p *onix.Product, id uint32) error {
@@ -239,7 +446,7 @@ func (db *DB) index(tx *bolt.Tx, p *onix.Product, id uint32) error {
 			return err
 		}
 	}
-	return nil
+	return db.indexWork(tx, p, id, entries)
 }
 
 func (db *DB) deIndex(tx *bolt.Tx, idb []byte) error {
@@ -284,7 +491,7 @@ func (db *DB) deIndex(tx *bolt.Tx, idb []byte) error {
 			return err
 		}
 	}
-	return nil
+	return db.deIndexWork(tx, p, idb)
 }
 
 // IndexEntry represent an term to be indexed.
@@ -311,6 +518,14 @@ func (db *DB) Indexes() (res []string) {
 	return res
 }
 
+func (db *DB) hasIndex(index string) (ok bool) {
+	db.kv.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket([]byte("indexes")).Bucket([]byte(index)) != nil
+		return nil
+	})
+	return ok
+}
+
 // Scan performs a prefix scan of the given index, starting at the given query, and returns
 // up to limit terms which matches.
 func (db *DB) Scan(index, start string, limit int) (res []string, err error) {
@@ -338,8 +553,8 @@ func (db *DB) Scan(index, start string, limit int) (res []string, err error) {
 }
 
 // Query performs a query against the given index, returning up to limit matching
-// record IDs, as well as a count of total hits..
-func (db *DB) Query(index, query string, offset, limit int) (total int, res []uint32, err error) {
+// record IDs, as well as a count of total hits. The hits can be restricted by filters.
+func (db *DB) Query(index, query string, offset, limit int, filters ...Filter) (total int, res []uint32, err error) {
 	err = db.kv.View(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(index))
 		if bkt == nil {
@@ -355,6 +570,9 @@ func (db *DB) Query(index, query string, offset, limit int) (total int, res []ui
 		if _, err := hits.ReadFrom(bytes.NewReader(bo)); err != nil {
 			return err
 		}
+		if err := applyFilters(tx, hits, filters); err != nil {
+			return err
+		}
 
 		res = hits.ToArray()
 		total = len(res)
@@ -379,6 +597,16 @@ func (db *DB) ReindexAll() error {
 			}
 		}
 
+		// Delete work assignments, as they will be resolved again when indexing
+		for _, name := range []string{"works", "workrelated", "workaliases"} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+
 		cur := tx.Bucket([]byte("products")).Cursor()
 		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
 			id := btou32(k)
@@ -389,6 +617,28 @@ func (db *DB) ReindexAll() error {
 			if err := db.index(tx, p, id); err != nil {
 				return err
 			}
+			if err := db.indexSource(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls fn for every stored product, in the order they were first
+// stored. If fn returns an error, the iteration is stopped and the error returned.
+func (db *DB) ForEach(fn func(id uint32, p *onix.Product) error) error {
+	return db.kv.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("products")).Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			id := btou32(k)
+			p, err := db.get(tx, id)
+			if err != nil {
+				return err
+			}
+			if err := fn(id, p); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/boltdb/bolt"
+)
+
+// Filter restricts query results to records which have the given term in the
+// given index, or, if Exclude is set, to records which do not.
+type Filter struct {
+	Index   string
+	Term    string
+	Exclude bool
+}
+
+// applyFilters removes the hits which do not satisfy all the filters.
+func applyFilters(tx *bolt.Tx, hits *roaring.Bitmap, filters []Filter) error {
+	for _, f := range filters {
+		matches := roaring.New()
+		if bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(f.Index)); bkt != nil {
+			if bo := bkt.Get([]byte(strings.ToLower(f.Term))); bo != nil {
+				if _, err := matches.ReadFrom(bytes.NewReader(bo)); err != nil {
+					return err
+				}
+			}
+		}
+		if f.Exclude {
+			hits.AndNot(matches)
+		} else {
+			hits.And(matches)
+		}
+	}
+	return nil
+}
+
+// TermsOf returns the terms of the given index which the product with the
+// given ID is indexed under. It scans the whole index, and is only suited
+// for indexes with few terms.
+func (db *DB) TermsOf(index string, id uint32) (res []string, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(index))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			hits := roaring.New()
+			if _, err := hits.ReadFrom(bytes.NewReader(v)); err != nil {
+				return err
+			}
+			if hits.Contains(id) {
+				res = append(res, string(k))
+			}
+			return nil
+		})
+	})
+	return res, err
+}
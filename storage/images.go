@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ImageJob is an image, or other supporting resource, of a product which is
+// queued to be downloaded.
+type ImageJob struct {
+	Product  uint32
+	Resource string // type of resource; empty for front cover images
+	Mode     string `json:",omitempty"` // ResourceMode (ONIX list 159)
+	Name     string // file name in the product's directory for the type
+	URL      string
+	Source   string    // name of the source the product was harvested from
+	Attempts int       // failed attempts so far
+	Next     time.Time // when it is to be tried next
+	Error    string    `json:",omitempty"` // of the last failed attempt
+}
+
+// Image is a downloaded image, or other supporting resource, of a product.
+type Image struct {
+	Product      uint32
+	Resource     string `json:",omitempty"`
+	Name         string
+	URL          string
+	ETag         string    `json:",omitempty"`
+	LastModified string    `json:",omitempty"`
+	Time         time.Time // when it was last downloaded, or found unchanged
+
+	Type     string // MIME type, as detected from the content
+	Size     int64
+	Width    int    `json:",omitempty"` // 0 if the type can not be decoded
+	Height   int    `json:",omitempty"`
+	Checksum string // SHA-256, hex encoded
+}
+
+// Path returns the path of the file relative to the product's directory.
+func (j ImageJob) Path() string {
+	return resourcePath(j.Resource, j.Name)
+}
+
+// Path returns the path of the file relative to the product's directory.
+func (img Image) Path() string {
+	return resourcePath(img.Resource, img.Name)
+}
+
+// resourcePath returns the path of a file of the given resource type,
+// relative to the product's directory. Front cover images are kept in the
+// product's directory, and other resources in a directory per type.
+func resourcePath(resource, name string) string {
+	if resource == "" {
+		return name
+	}
+	return resource + "/" + name
+}
+
+// imageKey is the key of a product's image with the given path.
+func imageKey(product uint32, path string) []byte {
+	return append(u32tob(product), path...)
+}
+
+// QueueImage queues the image to be downloaded, replacing any queued job
+// for the same image. A job without a time set is due at once.
+func (t *Tx) QueueImage(j ImageJob) error {
+	return queueImage(t.tx, j)
+}
+
+func queueImage(tx *bolt.Tx, j ImageJob) error {
+	if j.Next.IsZero() {
+		j.Next = time.Now().UTC()
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("imagequeue")).Put(imageKey(j.Product, j.Path()), b)
+}
+
+// RescheduleImage updates a queued job after a failed attempt, unless the
+// image has been queued again with another URL in the meantime.
+func (db *DB) RescheduleImage(j ImageJob) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		if !queuedURL(tx, j) {
+			return nil
+		}
+		return queueImage(tx, j)
+	})
+}
+
+// RemoveImageJob removes the job from the queue, unless the image has been
+// queued again with another URL in the meantime.
+func (db *DB) RemoveImageJob(j ImageJob) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		if !queuedURL(tx, j) {
+			return nil
+		}
+		return tx.Bucket([]byte("imagequeue")).Delete(imageKey(j.Product, j.Path()))
+	})
+}
+
+// queuedURL reports whether the image is queued with the job's URL.
+func queuedURL(tx *bolt.Tx, j ImageJob) bool {
+	b := tx.Bucket([]byte("imagequeue")).Get(imageKey(j.Product, j.Path()))
+	if b == nil {
+		return false
+	}
+	var queued ImageJob
+	if err := json.Unmarshal(b, &queued); err != nil {
+		return true
+	}
+	return queued.URL == j.URL
+}
+
+// ImageJobs returns up to limit queued images which are due at the given
+// time. A limit of 0 means no limit. The total number of queued images is
+// also returned.
+func (db *DB) ImageJobs(due time.Time, limit int) (total int, res []ImageJob, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("imagequeue")).ForEach(func(k, v []byte) error {
+			total++
+			if limit > 0 && len(res) >= limit {
+				return nil
+			}
+			var j ImageJob
+			if err := json.Unmarshal(v, &j); err != nil {
+				return err
+			}
+			if !j.Next.After(due) {
+				res = append(res, j)
+			}
+			return nil
+		})
+	})
+	return total, res, err
+}
+
+// Image returns the downloaded image of the product with the given path,
+// relative to the product's directory.
+func (db *DB) Image(product uint32, path string) (img Image, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("images")).Get(imageKey(product, path))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, &img)
+	})
+	return img, err
+}
+
+// SetImage records a downloaded image.
+func (db *DB) SetImage(img Image) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	b, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("images")).Put(imageKey(img.Product, img.Path()), b)
+	})
+}
+
+// Images returns the downloaded images and other resources of the product,
+// ordered by path.
+func (db *DB) Images(product uint32) (res []Image, err error) {
+	prefix := u32tob(product)
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("images")).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var img Image
+			if err := json.Unmarshal(v, &img); err != nil {
+				return err
+			}
+			res = append(res, img)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// RemoveImagesOf removes the records and queued downloads of the images of
+// the product with the given ID. They are also removed when the product is
+// deleted.
+func (db *DB) RemoveImagesOf(product uint32) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		return removeImagesOf(tx, product)
+	})
+}
+
+func removeImagesOf(tx *bolt.Tx, product uint32) error {
+	prefix := u32tob(product)
+	for _, name := range []string{"images", "imagequeue"} {
+		cur := tx.Bucket([]byte(name)).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Seek(prefix) {
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// HarvestCounts are the outcomes of handling harvested products.
+type HarvestCounts struct {
+	Stored  int
+	Deleted int
+	Skipped int
+	Failed  int // quarantined, or queued to be retried
+}
+
+// Add adds the counts of c2 to c.
+func (c *HarvestCounts) Add(c2 HarvestCounts) {
+	c.Stored += c2.Stored
+	c.Deleted += c2.Deleted
+	c.Skipped += c2.Skipped
+	c.Failed += c2.Failed
+}
+
+// HarvestPage is the journal of harvesting a batch from a source.
+type HarvestPage struct {
+	Start        time.Time
+	End          time.Time
+	CursorBefore string
+	CursorAfter  string `json:",omitempty"` // empty if harvesting the batch failed
+	HarvestCounts
+	Errors   []string `json:",omitempty"` // samples of errors of failed products
+	Error    string   `json:",omitempty"` // why harvesting the batch failed
+	Attempts int      `json:",omitempty"` // failed attempts in a row, if it failed
+}
+
+// HarvestRun is the journal of a run of harvesting a source: the batches
+// fetched one after another, until there are no more to fetch at once.
+// Batches which fail are tried again within the run.
+type HarvestRun struct {
+	ID           uint64
+	Source       string
+	Start        time.Time
+	End          time.Time // zero while running, or if interrupted
+	CursorBefore string
+	CursorAfter  string // of the last batch harvested
+	Pages        int
+	Updated      time.Time // when its last page was journaled
+	HarvestCounts
+	Errors []string `json:",omitempty"` // samples of errors of failed products
+	Error  string   `json:",omitempty"` // of the last batch which failed, if any
+}
+
+// Journal records a harvested page along with the run it is part of, which
+// is assigned an ID if it has none. The page is numbered by the run's
+// Pages, and so should be counted in the run before it is recorded. A page
+// with the number of one already recorded replaces it.
+func (db *DB) Journal(r *HarvestRun, p HarvestPage) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("harvestruns"))
+		if r.ID == 0 {
+			var err error
+			if r.ID, err = bkt.NextSequence(); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket([]byte("harvestsources")).Put(sourceRunKey(r.Source, r.ID), nil); err != nil {
+			return err
+		}
+		if r.Updated = p.End; r.Updated.IsZero() {
+			r.Updated = time.Now().UTC()
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := bkt.Put(u64tob(r.ID), b); err != nil {
+			return err
+		}
+		if b, err = json.Marshal(p); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("harvestpages")).Put(append(u64tob(r.ID), u32tob(uint32(r.Pages))...), b)
+	})
+}
+
+// HarvestRuns returns up to limit journaled runs of harvesting the named
+// source, or all sources if source is empty, with IDs below before, newest
+// first. A before of 0 means from the newest, and a limit of 0 means no
+// limit. The total number of runs of the source is also returned.
+func (db *DB) HarvestRuns(source string, before uint64, limit int) (total int, res []HarvestRun, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		// The runs of a source are found by their keys in the source's index
+		runs := tx.Bucket([]byte("harvestruns"))
+		cur, prefix := runs.Cursor(), []byte(nil)
+		if source != "" {
+			cur, prefix = tx.Bucket([]byte("harvestsources")).Cursor(), []byte(source+"\x00")
+		}
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			total++
+		}
+
+		if before == 0 {
+			before = math.MaxUint64
+		}
+		k, _ := cur.Seek(append(append([]byte(nil), prefix...), u64tob(before)...))
+		if k == nil {
+			k, _ = cur.Last()
+		} else {
+			k, _ = cur.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && (limit == 0 || len(res) < limit); k, _ = cur.Prev() {
+			v := runs.Get(k[len(prefix):])
+			if v == nil {
+				continue
+			}
+			var r HarvestRun
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			res = append(res, r)
+		}
+		return nil
+	})
+	return total, res, err
+}
+
+// PurgeHarvestRuns removes the journals of runs started before the given
+// time, and last journaled before it, returning the number of runs removed.
+func (db *DB) PurgeHarvestRuns(before time.Time) (n int, err error) {
+	err = db.kv.Update(func(tx *bolt.Tx) error {
+		var old []HarvestRun
+		cur := tx.Bucket([]byte("harvestruns")).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			var r HarvestRun
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			// A run is given its ID when its first page is journaled, so
+			// IDs are not in the order of start; look at every run
+			if r.Start.Before(before) && r.Updated.Before(before) {
+				old = append(old, r)
+			}
+		}
+		for _, r := range old {
+			if err := removeHarvestRun(tx, r); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return n, err
+}
+
+func removeHarvestRun(tx *bolt.Tx, r HarvestRun) error {
+	prefix := u64tob(r.ID)
+	cur := tx.Bucket([]byte("harvestpages")).Cursor()
+	for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Seek(prefix) {
+		if err := cur.Delete(); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket([]byte("harvestsources")).Delete(sourceRunKey(r.Source, r.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("harvestruns")).Delete(prefix)
+}
+
+// sourceRunKey is the key of a run in the index of runs by source.
+func sourceRunKey(source string, id uint64) []byte {
+	return append([]byte(source+"\x00"), u64tob(id)...)
+}
+
+// HarvestRun returns the journaled run with the given ID, along with its
+// pages in order.
+func (db *DB) HarvestRun(id uint64) (r HarvestRun, pages []HarvestPage, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("harvestruns")).Get(u64tob(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		prefix := u64tob(id)
+		cur := tx.Bucket([]byte("harvestpages")).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var p HarvestPage
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			pages = append(pages, p)
+		}
+		return nil
+	})
+	return r, pages, err
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Quarantined is a product which could not be decoded or failed validation.
+type Quarantined struct {
+	ID      uint64
+	Ref     string // empty if the product could not be decoded
+	Release string // ONIX release of the raw XML
+	Source  string `json:",omitempty"` // name of the source it was harvested from
+	Error   string
+	Raw     string `json:",omitempty"`
+	Time    time.Time
+}
+
+// Quarantine stores a product which could not be decoded or failed validation,
+// returning the ID it was assigned. A previously quarantined product with the
+// same RecordReference is replaced.
+func (db *DB) Quarantine(q Quarantined) (id uint64, err error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	err = db.kv.Update(func(tx *bolt.Tx) error {
+		var err2 error
+		id, err2 = db.quarantine(tx, q)
+		return err2
+	})
+	return id, err
+}
+
+func (db *DB) quarantine(tx *bolt.Tx, q Quarantined) (uint64, error) {
+	if q.Ref != "" {
+		if err := db.unquarantineRef(tx, q.Ref); err != nil {
+			return 0, err
+		}
+	}
+	bkt := tx.Bucket([]byte("quarantine"))
+	var err error
+	if q.ID, err = bkt.NextSequence(); err != nil {
+		return 0, err
+	}
+	q.Time = time.Now().UTC()
+	b, err := json.Marshal(q)
+	if err != nil {
+		return 0, err
+	}
+	if err := bkt.Put(u64tob(q.ID), b); err != nil {
+		return 0, err
+	}
+	if q.Ref != "" {
+		if err := tx.Bucket([]byte("quarantinerefs")).Put([]byte(q.Ref), u64tob(q.ID)); err != nil {
+			return 0, err
+		}
+	}
+	return q.ID, nil
+}
+
+// QuarantinedProduct returns the quarantined product with the given ID.
+func (db *DB) QuarantinedProduct(id uint64) (q Quarantined, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("quarantine")).Get(u64tob(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, &q)
+	})
+	return q, err
+}
+
+// QuarantinedProducts returns up to limit quarantined products with IDs
+// greater than after, in the order they were quarantined. The raw XML
+// is left out. It also returns the total number of quarantined products.
+func (db *DB) QuarantinedProducts(after uint64, limit int) (total int, res []Quarantined, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("quarantine"))
+		total = bkt.Stats().KeyN
+		cur := bkt.Cursor()
+		for k, v := cur.Seek(u64tob(after + 1)); k != nil && len(res) < limit; k, v = cur.Next() {
+			var q Quarantined
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			q.Raw = ""
+			res = append(res, q)
+		}
+		return nil
+	})
+	return total, res, err
+}
+
+// Unquarantine removes the quarantined product with the given ID.
+func (db *DB) Unquarantine(id uint64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		return db.unquarantine(tx, id)
+	})
+}
+
+// Unquarantine is like DB.Unquarantine, within the transaction.
+func (t *Tx) Unquarantine(id uint64) error {
+	return t.db.unquarantine(t.tx, id)
+}
+
+func (db *DB) unquarantine(tx *bolt.Tx, id uint64) error {
+	bkt := tx.Bucket([]byte("quarantine"))
+	b := bkt.Get(u64tob(id))
+	if b == nil {
+		return ErrNotFound
+	}
+	var q Quarantined
+	if err := json.Unmarshal(b, &q); err != nil {
+		return err
+	}
+	if q.Ref != "" {
+		if err := tx.Bucket([]byte("quarantinerefs")).Delete([]byte(q.Ref)); err != nil {
+			return err
+		}
+	}
+	return bkt.Delete(u64tob(id))
+}
+
+// unquarantineRef removes the quarantined product with the given RecordReference, if any.
+func (db *DB) unquarantineRef(tx *bolt.Tx, ref string) error {
+	refs := tx.Bucket([]byte("quarantinerefs"))
+	idb := refs.Get([]byte(ref))
+	if idb == nil {
+		return nil
+	}
+	if err := tx.Bucket([]byte("quarantine")).Delete(idb); err != nil {
+		return err
+	}
+	return refs.Delete([]byte(ref))
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/knakk/kbp/onix"
+)
+
+// ErrReadOnly is returned when trying to store or delete products in a
+// read-only database.
+var ErrReadOnly = errors.New("database is read-only")
+
+// Change operations
+const (
+	OpStore  = "store"
+	OpDelete = "delete"
+)
+
+// Change represents a stored or deleted product in the change log.
+type Change struct {
+	Seq     uint64
+	Op      string
+	ID      uint32
+	Ref     string
+	Time    time.Time     // when the product was stored or deleted
+	Source  string        `json:"-"` // the source a stored product is attributed to, if any
+	Product *onix.Product `json:"-"`
+}
+
+// SetReadOnly makes Store, Delete and DeleteByRef fail with ErrReadOnly, so that
+// products can only be changed by applying changes from another database.
+func (db *DB) SetReadOnly(readOnly bool) {
+	db.readOnly = readOnly
+}
+
+// logChange appends a change made at time t to the change log. Only the latest
+// change of each product is kept, so the log never grows beyond the number of
+// products ever stored.
+func (db *DB) logChange(tx *bolt.Tx, op string, id uint32, ref string, t time.Time) error {
+	bkt := tx.Bucket([]byte("changes"))
+	latest := tx.Bucket([]byte("changeids"))
+	idb := u32tob(id)
+	if prev := latest.Get(idb); prev != nil {
+		if err := bkt.Delete(prev); err != nil {
+			return err
+		}
+	}
+	seq, err := bkt.NextSequence()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(Change{Seq: seq, Op: op, ID: id, Ref: ref, Time: t})
+	if err != nil {
+		return err
+	}
+	if err := bkt.Put(u64tob(seq), b); err != nil {
+		return err
+	}
+	return latest.Put(idb, u64tob(seq))
+}
+
+// Changes returns up to limit changes after the given sequence number, in
+// the order they were made. Stored products are included in their current version,
+// along with their source.
+func (db *DB) Changes(since uint64, limit int) (res []Change, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("changes")).Cursor()
+		for k, v := cur.Seek(u64tob(since + 1)); k != nil && len(res) < limit; k, v = cur.Next() {
+			var c Change
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.Op == OpStore {
+				p, err := db.get(tx, c.ID)
+				if err != nil {
+					return fmt.Errorf("change %d: %v", c.Seq, err)
+				}
+				c.Product = p
+				c.Source = string(tx.Bucket([]byte("sources")).Get(u32tob(c.ID)))
+			}
+			res = append(res, c)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// ChangedSince returns the IDs of the stored products which were last changed
+// at or after the given time, in the order they were changed.
+func (db *DB) ChangedSince(t time.Time) (res []uint32, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("changes")).ForEach(func(k, v []byte) error {
+			var c Change
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			if c.Op == OpStore && !c.Time.Before(t) {
+				res = append(res, c.ID)
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+// Apply applies changes from another database, keeping the product IDs, sources
+// and times of changes of the originating database. The sequence number of the
+// last change is stored, and can be retrieved with Replicated. Apply works on
+// read-only databases.
+func (db *DB) Apply(changes []Change) error {
+	return db.kv.Update(func(tx *bolt.Tx) error {
+		for _, c := range changes {
+			var err error
+			switch c.Op {
+			case OpStore:
+				err = db.applyStore(tx, c)
+			case OpDelete:
+				var p *onix.Product
+				if p, err = db.get(tx, c.ID); err == nil {
+					err = db.remove(tx, p, c.ID, changeTime(c))
+				} else if err == ErrNotFound || err == ErrDeleted {
+					err = nil
+				}
+			default:
+				err = fmt.Errorf("unknown operation: %q", c.Op)
+			}
+			if err != nil {
+				return fmt.Errorf("change %d: %v", c.Seq, err)
+			}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		return tx.Bucket([]byte("meta")).Put([]byte("replicated"), u64tob(changes[len(changes)-1].Seq))
+	})
+}
+
+func (db *DB) applyStore(tx *bolt.Tx, c Change) error {
+	if c.Product == nil {
+		return errors.New("missing product")
+	}
+	bkt := tx.Bucket([]byte("products"))
+	refs := tx.Bucket([]byte("ref"))
+	idb := u32tob(c.ID)
+
+	if bkt.Get(idb) != nil {
+		if err := db.deIndex(tx, idb); err != nil {
+			return err
+		}
+		old, err := db.get(tx, c.ID)
+		if err != nil {
+			return err
+		}
+		if err := refs.Delete([]byte(old.RecordReference.Value)); err != nil {
+			return err
+		}
+	}
+
+	// Make sure products stored locally are not assigned an ID already in use
+	if bkt.Sequence() < uint64(c.ID) {
+		if err := bkt.SetSequence(uint64(c.ID)); err != nil {
+			return err
+		}
+	}
+
+	enc := db.encPool.Get().(*primedEncoder)
+	defer db.encPool.Put(enc)
+	b, err := enc.Marshal(c.Product)
+	if err != nil {
+		return err
+	}
+	// The encoder's buffer is reused, but the value must stay valid for
+	// the rest of the transaction, as it may apply several changes.
+	if err := bkt.Put(idb, append([]byte(nil), b...)); err != nil {
+		return err
+	}
+	if err := refs.Put([]byte(c.Product.RecordReference.Value), idb); err != nil {
+		return err
+	}
+	if err := db.index(tx, c.Product, c.ID); err != nil {
+		return err
+	}
+	if c.Source != "" {
+		err = db.setSource(tx, c.ID, c.Source)
+	} else {
+		err = db.removeSource(tx, c.ID)
+	}
+	if err != nil {
+		return err
+	}
+	return db.logChange(tx, OpStore, c.ID, c.Product.RecordReference.Value, changeTime(c))
+}
+
+// changeTime returns the time of a change from another database, or the
+// current time for changes from databases which do not tell.
+func changeTime(c Change) time.Time {
+	if c.Time.IsZero() {
+		return time.Now().UTC()
+	}
+	return c.Time.UTC()
+}
+
+// Replicated returns the sequence number of the last change applied from
+// another database, or 0 if no changes have been applied.
+func (db *DB) Replicated() (seq uint64) {
+	db.kv.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("meta")).Get([]byte("replicated")); b != nil {
+			seq = binary.BigEndian.Uint64(b)
+		}
+		return nil
+	})
+	return seq
+}
+
+// u64tob converts a uint64 into an 8-byte slice.
+func u64tob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
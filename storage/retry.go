@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Retry is a product which could not be stored, for other reasons than its
+// content, and is queued to be tried again.
+type Retry struct {
+	ID       uint64
+	Ref      string
+	Source   string // name of the source it was harvested from
+	Release  string // ONIX release of the raw XML
+	Raw      string
+	Error    string
+	Attempts int
+	Time     time.Time // of the last attempt
+	Due      time.Time // when it is to be tried again; Time if zero
+}
+
+// QueueRetry adds the product to the retry queue, returning the ID it was
+// assigned. If r.ID is set, the queued product with that ID is replaced.
+func (t *Tx) QueueRetry(r Retry) (uint64, error) {
+	bkt := t.tx.Bucket([]byte("retries"))
+	if r.ID == 0 {
+		var err error
+		if r.ID, err = bkt.NextSequence(); err != nil {
+			return 0, err
+		}
+	} else if err := t.RemoveRetry(r.ID); err != nil {
+		return 0, err
+	}
+	r.Time = time.Now().UTC()
+	if r.Due.IsZero() {
+		r.Due = r.Time
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := bkt.Put(u64tob(r.ID), b); err != nil {
+		return 0, err
+	}
+	return r.ID, indexRetry(t.tx, r)
+}
+
+// indexRetry adds the queued product to the indexes of the retry queue by
+// RecordReference, and by source along with when it is due.
+func indexRetry(tx *bolt.Tx, r Retry) error {
+	if r.Ref != "" {
+		if err := tx.Bucket([]byte("retryrefs")).Put(retryKey(r.Ref, r.ID), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte("retrysources")).Put(retryKey(r.Source, r.ID), u64tob(uint64(r.Due.UnixNano())))
+}
+
+// retryKey is the key of a queued product in the indexes of the retry queue.
+func retryKey(term string, id uint64) []byte {
+	return append([]byte(term+"\x00"), u64tob(id)...)
+}
+
+// RemoveRetry removes the product with the given ID from the retry queue.
+func (t *Tx) RemoveRetry(id uint64) error {
+	bkt := t.tx.Bucket([]byte("retries"))
+	b := bkt.Get(u64tob(id))
+	if b == nil {
+		return nil
+	}
+	var r Retry
+	if err := json.Unmarshal(b, &r); err != nil {
+		return err
+	}
+	if err := t.tx.Bucket([]byte("retryrefs")).Delete(retryKey(r.Ref, id)); err != nil {
+		return err
+	}
+	if err := t.tx.Bucket([]byte("retrysources")).Delete(retryKey(r.Source, id)); err != nil {
+		return err
+	}
+	return bkt.Delete(u64tob(id))
+}
+
+// RemoveRetriesOf removes the products with the given RecordReference from
+// the retry queue, as they are superseded when the product is stored.
+func (t *Tx) RemoveRetriesOf(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	prefix := []byte(ref + "\x00")
+	var ids []uint64
+	cur := t.tx.Bucket([]byte("retryrefs")).Cursor()
+	for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+		ids = append(ids, binary.BigEndian.Uint64(k[len(prefix):]))
+	}
+	for _, id := range ids {
+		if err := t.RemoveRetry(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retries returns up to limit products in the retry queue from the named
+// source, or from all sources if source is empty, oldest first. A limit of 0
+// means no limit. The total number of queued products from the source is
+// also returned.
+func (db *DB) Retries(source string, limit int) (total int, res []Retry, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		// The products of a source are found by their keys in the source's index
+		retries := tx.Bucket([]byte("retries"))
+		cur, prefix := retries.Cursor(), []byte(nil)
+		if source != "" {
+			cur, prefix = tx.Bucket([]byte("retrysources")).Cursor(), []byte(source+"\x00")
+		}
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			total++
+			if limit != 0 && len(res) >= limit {
+				continue
+			}
+			var r Retry
+			if err := json.Unmarshal(retries.Get(k[len(prefix):]), &r); err != nil {
+				return err
+			}
+			res = append(res, r)
+		}
+		return nil
+	})
+	return total, res, err
+}
+
+// DueRetries returns up to limit products in the retry queue from the named
+// source which are due to be tried again at the given time, oldest first.
+// A limit of 0 means no limit.
+func (db *DB) DueRetries(source string, now time.Time, limit int) (res []Retry, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		retries := tx.Bucket([]byte("retries"))
+		prefix := []byte(source + "\x00")
+		cur := tx.Bucket([]byte("retrysources")).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			if limit != 0 && len(res) >= limit {
+				break
+			}
+			if int64(binary.BigEndian.Uint64(v)) > now.UnixNano() {
+				continue
+			}
+			var r Retry
+			if err := json.Unmarshal(retries.Get(k[len(prefix):]), &r); err != nil {
+				return err
+			}
+			res = append(res, r)
+		}
+		return nil
+	})
+	return res, err
+}
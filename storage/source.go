@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/boltdb/bolt"
+	"github.com/knakk/kbp/onix"
+)
+
+// SourceIndex is the name of the index where products are grouped by the
+// source they were harvested from.
+const SourceIndex = "source"
+
+// StoreFrom is like Store, but also attributes the product to the named
+// source. If source is empty, any previous attribution is kept.
+func (db *DB) StoreFrom(source string, p *onix.Product) (id uint32, err error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	err = db.kv.Update(func(tx *bolt.Tx) error {
+		var err2 error
+		id, err2 = db.storeFrom(tx, source, p)
+		return err2
+	})
+	return id, err
+}
+
+func (db *DB) storeFrom(tx *bolt.Tx, source string, p *onix.Product) (uint32, error) {
+	if source == "" {
+		return db.store(tx, p)
+	}
+	if idb := tx.Bucket([]byte("ref")).Get([]byte(p.RecordReference.Value)); idb != nil {
+		if err := db.setSource(tx, btou32(idb), source); err != nil {
+			return 0, err
+		}
+		return db.store(tx, p)
+	}
+	id, err := db.store(tx, p)
+	if err != nil {
+		return 0, err
+	}
+	return id, db.setSource(tx, id, source)
+}
+
+// SourceOf returns the name of the source the product with the given ID was
+// harvested from. If it has no attribution, ErrNotFound is returned.
+func (db *DB) SourceOf(id uint32) (source string, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("sources")).Get(u32tob(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		source = string(b)
+		return nil
+	})
+	return source, err
+}
+
+// setSource attributes the product to a source, replacing any previous attribution.
+func (db *DB) setSource(tx *bolt.Tx, id uint32, source string) error {
+	if err := db.removeSource(tx, id); err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte("sources")).Put(u32tob(id), []byte(source)); err != nil {
+		return err
+	}
+	return db.indexSource(tx, id)
+}
+
+// removeSource removes the attribution of the product, if any.
+func (db *DB) removeSource(tx *bolt.Tx, id uint32) error {
+	if err := db.updateSourceIndex(tx, id, (*roaring.Bitmap).Remove); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("sources")).Delete(u32tob(id))
+}
+
+// indexSource adds the product to the source index, if it has an attribution.
+func (db *DB) indexSource(tx *bolt.Tx, id uint32) error {
+	return db.updateSourceIndex(tx, id, (*roaring.Bitmap).Add)
+}
+
+func (db *DB) updateSourceIndex(tx *bolt.Tx, id uint32, op func(*roaring.Bitmap, uint32)) error {
+	source := tx.Bucket([]byte("sources")).Get(u32tob(id))
+	if source == nil {
+		return nil
+	}
+	bkt, err := tx.Bucket([]byte("indexes")).CreateBucketIfNotExists([]byte(SourceIndex))
+	if err != nil {
+		return err
+	}
+	term := []byte(strings.ToLower(string(source)))
+	hits := roaring.New()
+	if b := bkt.Get(term); b != nil {
+		if _, err := hits.ReadFrom(bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	op(hits, id)
+	b, err := hits.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return bkt.Put(term, b)
+}
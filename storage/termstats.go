@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/boltdb/bolt"
+)
+
+// TermCount is a term and the number of records it matches.
+type TermCount struct {
+	Term  string
+	Count int
+}
+
+// FrequencyBucket is the number of terms matching between Min and Max
+// records, inclusive.
+type FrequencyBucket struct {
+	Min   int
+	Max   int
+	Terms int
+}
+
+// IndexStats holds term statistics for an index.
+type IndexStats struct {
+	Name string
+
+	// Terms is the number of terms matching at least one record.
+	Terms int
+
+	// Top lists the most frequent terms, most frequent first.
+	Top []TermCount
+
+	// Distribution lists the number of terms by frequency, in buckets
+	// growing by powers of two: 1, 2-3, 4-7 and so on.
+	Distribution []FrequencyBucket
+
+	// Singletons lists terms matching exactly one record, in sorted order.
+	// SingletonCount is the total number of such terms, which may be more
+	// than the number listed.
+	Singletons     []string
+	SingletonCount int
+}
+
+// IndexStats returns term statistics for the given index, including the top
+// most frequent terms and up to limit terms which match only one record.
+// ErrNotFound is returned if there is no such index.
+func (db *DB) IndexStats(index string, top, limit int) (stats IndexStats, err error) {
+	stats.Name = index
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(index))
+		if bkt == nil {
+			return ErrNotFound
+		}
+
+		h := &termHeap{}
+		err := bkt.ForEach(func(k, v []byte) error {
+			hits := roaring.New()
+			if _, err := hits.ReadFrom(bytes.NewReader(v)); err != nil {
+				return err
+			}
+			n := int(hits.GetCardinality())
+			if n == 0 {
+				// Terms are left with empty hits when records are removed
+				return nil
+			}
+			stats.Terms++
+
+			b := 0
+			for f := n; f > 1; f >>= 1 {
+				b++
+			}
+			for len(stats.Distribution) <= b {
+				i := len(stats.Distribution)
+				stats.Distribution = append(stats.Distribution, FrequencyBucket{Min: 1 << uint(i), Max: 1<<uint(i+1) - 1})
+			}
+			stats.Distribution[b].Terms++
+
+			if n == 1 {
+				stats.SingletonCount++
+				if len(stats.Singletons) < limit {
+					stats.Singletons = append(stats.Singletons, string(k))
+				}
+			}
+
+			if top > 0 && (h.Len() < top || n > (*h)[0].Count) {
+				heap.Push(h, TermCount{Term: string(k), Count: n})
+				if h.Len() > top {
+					heap.Pop(h)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		stats.Top = make([]TermCount, h.Len())
+		for i := len(stats.Top) - 1; i >= 0; i-- {
+			stats.Top[i] = heap.Pop(h).(TermCount)
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// termHeap is a min-heap of terms by count, used to find the most frequent terms.
+type termHeap []TermCount
+
+func (h termHeap) Len() int { return len(h) }
+func (h termHeap) Less(i, j int) bool {
+	if h[i].Count == h[j].Count {
+		// Prefer alphabetically earlier terms on ties
+		return h[i].Term > h[j].Term
+	}
+	return h[i].Count < h[j].Count
+}
+func (h termHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *termHeap) Push(x interface{}) { *h = append(*h, x.(TermCount)) }
+func (h *termHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -436,3 +436,51 @@ func mustParse(b []byte) (p *onix.Product) {
 	}
 	return p
 }
+
+// product returns the XML of a minimal product with the given record reference.
+func product(ref string) []byte {
+	return []byte(`<Product><RecordReference>` + ref + `</RecordReference><DescriptiveDetail></DescriptiveDetail></Product>`)
+}
+
+func TestIndexStats(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range products.Product {
+		if _, err := db.Store(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := db.IndexStats("author", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// author terms: jensen (2), ole, kari, jens, olsen, and three full names (1)
+	want := storage.IndexStats{
+		Name:           "author",
+		Terms:          8,
+		Top:            []storage.TermCount{{Term: "jensen", Count: 2}, {Term: "jens", Count: 1}},
+		Distribution:   []storage.FrequencyBucket{{Min: 1, Max: 1, Terms: 7}, {Min: 2, Max: 3, Terms: 1}},
+		Singletons:     []string{"jens", "jensen, kari"},
+		SingletonCount: 7,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("db.IndexStats(author, 2, 2) =>\n%+v\nwant:\n%+v", stats, want)
+	}
+
+	if _, err := db.IndexStats("nonexisting", 2, 2); err != storage.ErrNotFound {
+		t.Errorf("db.IndexStats(nonexisting) => %v; want ErrNotFound", err)
+	}
+}
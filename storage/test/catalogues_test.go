@@ -0,0 +1,98 @@
+package test
+
+import (
+	"encoding/xml"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestCatalogues(t *testing.T) {
+	cats := storage.NewCatalogues()
+	defer checked(t, cats.Close)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store the first two products in catalogue a, and the last in b
+	for _, name := range []string{"a", "b"} {
+		f := tempfile()
+		defer os.Remove(f)
+		if _, err := cats.Open(name, f, indexFn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cats.Open("a", tempfile(), indexFn); err != storage.ErrCatalogueExists {
+		t.Errorf("opening catalogue with existing name => %v; want ErrCatalogueExists", err)
+	}
+	a, _ := cats.Get("a")
+	b, _ := cats.Get("b")
+	for i, p := range products.Product {
+		db := a
+		if i == 2 {
+			db = b
+		}
+		if _, err := db.Store(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(cats.Names(), want) {
+		t.Errorf("cats.Names() => %v; want %v", cats.Names(), want)
+	}
+
+	queryTests := []struct {
+		names []string
+		q     string
+		want  []storage.CatalogueHit
+	}{
+		{
+			names: nil,
+			q:     "book",
+			want:  []storage.CatalogueHit{{Catalogue: "a", ID: 2}, {Catalogue: "a", ID: 1}, {Catalogue: "b", ID: 1}},
+		},
+		{
+			names: nil,
+			q:     "c",
+			want:  []storage.CatalogueHit{{Catalogue: "b", ID: 1}},
+		},
+		{
+			names: []string{"b", "a"},
+			q:     "babel",
+			want:  []storage.CatalogueHit{{Catalogue: "a", ID: 2}},
+		},
+		{
+			names: []string{"a"},
+			q:     "c",
+			want:  nil,
+		},
+	}
+	for _, test := range queryTests {
+		n, res, err := cats.Query(test.names, "title", test.q, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(test.want) || !reflect.DeepEqual(res, test.want) {
+			t.Errorf("cats.Query(%v, title, %s) => %v; want %v", test.names, test.q, res, test.want)
+		}
+	}
+
+	n, res, err := cats.Query(nil, "subject", "subject api", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || res[0].Catalogue != "b" {
+		t.Errorf("cats.Query(nil, subject, subject api) => %v; want hit in catalogue b", res)
+	}
+
+	if _, _, err := cats.Query([]string{"c"}, "title", "book", 0, 10); err == nil {
+		t.Error("querying unknown catalogue should fail")
+	}
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"encoding/xml"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestFilters(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+
+	// Flag all records but id.1 as odd, and id.2 as hidden
+	flagFn := func(p *onix.Product) []storage.IndexEntry {
+		res := indexFn(p)
+		if p.RecordReference.Value != "id.1" {
+			res = append(res, storage.IndexEntry{Index: "flag", Term: "odd"})
+		}
+		if p.RecordReference.Value == "id.2" {
+			res = append(res, storage.IndexEntry{Index: "flag", Term: "hidden"})
+		}
+		return res
+	}
+	db, err := storage.Open(f, flagFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint32, len(products.Product))
+	for i, p := range products.Product {
+		if ids[i], err = db.Store(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filters []storage.Filter
+		want    []uint32
+	}{
+		{nil, []uint32{ids[2], ids[1], ids[0]}},
+		{[]storage.Filter{{Index: "flag", Term: "odd"}}, []uint32{ids[2], ids[0]}},
+		{[]storage.Filter{{Index: "flag", Term: "hidden", Exclude: true}}, []uint32{ids[1], ids[0]}},
+		{[]storage.Filter{{Index: "flag", Term: "odd"}, {Index: "flag", Term: "hidden", Exclude: true}}, []uint32{ids[0]}},
+		{[]storage.Filter{{Index: "flag", Term: "nope"}}, nil},
+		{[]storage.Filter{{Index: "nope", Term: "nope", Exclude: true}}, []uint32{ids[2], ids[1], ids[0]}},
+	}
+	for _, test := range tests {
+		total, got, err := db.Query("title", "book", 0, 10, test.filters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(got) > 0 || len(test.want) > 0) && !reflect.DeepEqual(got, test.want) || total != len(test.want) {
+			t.Errorf("db.Query(title, book, %v) => %d %v; want %v", test.filters, total, got, test.want)
+		}
+	}
+
+	flags, err := db.TermsOf("flag", ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hidden", "odd"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("db.TermsOf(flag, %d) => %v; want %v", ids[2], flags, want)
+	}
+	if flags, _ := db.TermsOf("flag", ids[1]); len(flags) != 0 {
+		t.Errorf("db.TermsOf(flag, %d) => %v; want none", ids[1], flags)
+	}
+}
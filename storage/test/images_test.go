@@ -0,0 +1,202 @@
+package test
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/otra/storage"
+)
+
+func TestImageQueue(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	queue := func(jobs ...storage.ImageJob) {
+		err := db.Batch(func(tx *storage.Tx) error {
+			for _, j := range jobs {
+				if err := tx.QueueImage(j); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	due := func(at time.Time) (int, []storage.ImageJob) {
+		total, jobs, err := db.ImageJobs(at, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total, jobs
+	}
+
+	a := storage.ImageJob{Product: 1, Name: "a.jpg", URL: "http://example.org/a1.jpg"}
+	b := storage.ImageJob{Product: 2, Name: "b.jpg", URL: "http://example.org/b.jpg"}
+	queue(a, b)
+	// Queueing again replaces the job
+	queue(a)
+	if total, jobs := due(time.Now()); total != 2 || len(jobs) != 2 {
+		t.Fatalf("db.ImageJobs(now) => %d, %v; want 2 due", total, jobs)
+	}
+
+	// A rescheduled job is not due until its time
+	_, jobs := due(time.Now())
+	j := jobs[0]
+	j.Attempts, j.Next, j.Error = 1, time.Now().Add(time.Hour), "503 Service Unavailable"
+	if err := db.RescheduleImage(j); err != nil {
+		t.Fatal(err)
+	}
+	if total, jobs := due(time.Now()); total != 2 || len(jobs) != 1 || jobs[0].Product != 2 {
+		t.Errorf("db.ImageJobs(now) after reschedule => %d, %v; want 2 queued, product 2 due", total, jobs)
+	}
+	if _, jobs := due(time.Now().Add(2 * time.Hour)); len(jobs) != 2 || jobs[0].Attempts != 1 {
+		t.Errorf("db.ImageJobs(later) => %v; want both due, first with 1 attempt", jobs)
+	}
+
+	// A job queued again with another URL is not removed by a stale worker
+	a2 := a
+	a2.URL = "http://example.org/a2.jpg"
+	queue(a2)
+	if err := db.RemoveImageJob(a); err != nil {
+		t.Fatal(err)
+	}
+	if total, jobs := due(time.Now()); total != 2 || len(jobs) != 2 {
+		t.Errorf("db.ImageJobs(now) after stale remove => %d, %v; want 2 due", total, jobs)
+	}
+	if err := db.RemoveImageJob(a2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveImageJob(b); err != nil {
+		t.Fatal(err)
+	}
+	if total, _ := due(time.Now()); total != 0 {
+		t.Errorf("db.ImageJobs(now) after remove => %d queued; want 0", total)
+	}
+
+	if _, err := db.Image(1, "a.jpg"); err != storage.ErrNotFound {
+		t.Errorf("db.Image(1, a.jpg) => %v; want ErrNotFound", err)
+	}
+	img := storage.Image{
+		Product:      1,
+		Name:         "a.jpg",
+		URL:          a2.URL,
+		ETag:         `"abc"`,
+		LastModified: "Mon, 02 Jan 2006 15:04:05 GMT",
+		Type:         "image/jpeg",
+		Size:         641,
+		Width:        40,
+		Height:       60,
+		Checksum:     "af8133290f1e59a186dc4266ba7c0887d5438fbc1424298ff3e6f5b3f67dca95",
+	}
+	if err := db.SetImage(img); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Image(1, "a.jpg"); err != nil || got != img {
+		t.Errorf("db.Image(1, a.jpg) => %+v, %v; want %+v", got, err, img)
+	}
+}
+
+func TestImagesRemovedWithProduct(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	var ids []uint32
+	err = db.Batch(func(tx *storage.Tx) error {
+		for _, ref := range []string{"id.a", "id.b"} {
+			id, err := tx.Store(mustParse(product(ref)))
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			for _, name := range []string{"1.jpg", "2.jpg"} {
+				if err := tx.QueueImage(storage.ImageJob{Product: id, Name: name, URL: "http://example.org/" + name}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err := db.SetImage(storage.Image{Product: id, Name: "1.jpg"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Image(ids[0], "1.jpg"); err != storage.ErrNotFound {
+		t.Errorf("db.Image of deleted product => %v; want ErrNotFound", err)
+	}
+	if _, err := db.Image(ids[1], "1.jpg"); err != nil {
+		t.Errorf("db.Image of other product => %v", err)
+	}
+	if total, jobs, _ := db.ImageJobs(time.Now(), 0); total != 2 || jobs[0].Product != ids[1] {
+		t.Errorf("db.ImageJobs after delete => %d, %+v; want 2 of product %d", total, jobs, ids[1])
+	}
+
+	if err := db.RemoveImagesOf(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, _ := db.ImageJobs(time.Now(), 0); total != 0 {
+		t.Errorf("db.ImageJobs after db.RemoveImagesOf => %d; want 0", total)
+	}
+	if _, err := db.Image(ids[1], "1.jpg"); err != storage.ErrNotFound {
+		t.Errorf("db.Image after db.RemoveImagesOf => %v; want ErrNotFound", err)
+	}
+}
+
+func TestImagesOfProduct(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	imgs := []storage.Image{
+		{Product: 1, Name: "cover.jpg"},
+		{Product: 1, Resource: "sample", Name: "chapter1.pdf"},
+		{Product: 1, Resource: "backcover", Name: "cover.jpg"},
+		{Product: 2, Name: "cover.jpg"},
+	}
+	for _, img := range imgs {
+		if err := db.SetImage(img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := db.Image(1, "backcover/cover.jpg"); err != nil || got != imgs[2] {
+		t.Errorf("db.Image(1, backcover/cover.jpg) => %+v, %v; want %+v", got, err, imgs[2])
+	}
+
+	got, err := db.Images(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, img := range got {
+		paths = append(paths, img.Path())
+	}
+	want := []string{"backcover/cover.jpg", "cover.jpg", "sample/chapter1.pdf"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("db.Images(1) => %v; want %v", paths, want)
+	}
+}
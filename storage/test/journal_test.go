@@ -0,0 +1,143 @@
+package test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knakk/otra/storage"
+)
+
+func TestHarvestJournal(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	journal := func(r *storage.HarvestRun, p storage.HarvestPage) {
+		r.Pages++
+		r.HarvestCounts.Add(p.HarvestCounts)
+		if err := db.Journal(r, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := &storage.HarvestRun{Source: "a", Start: start, CursorBefore: "1"}
+	journal(a, storage.HarvestPage{Start: start, CursorBefore: "1", CursorAfter: "2", HarvestCounts: storage.HarvestCounts{Stored: 3, Failed: 1}, Errors: []string{"invalid"}})
+	journal(a, storage.HarvestPage{Start: start, CursorBefore: "2", Error: "503 Service Unavailable"})
+	a.End = start.Add(time.Minute)
+	journal(a, storage.HarvestPage{Start: start, CursorBefore: "2", CursorAfter: "3", HarvestCounts: storage.HarvestCounts{Deleted: 2}})
+
+	b := &storage.HarvestRun{Source: "b", Start: start}
+	journal(b, storage.HarvestPage{Start: start, HarvestCounts: storage.HarvestCounts{Skipped: 1}})
+	if a.ID == 0 || b.ID <= a.ID {
+		t.Fatalf("run IDs => %d, %d; want increasing from 1", a.ID, b.ID)
+	}
+
+	run, pages, err := db.HarvestRun(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Pages != 3 || run.Stored != 3 || run.Deleted != 2 || run.Failed != 1 || !run.End.Equal(a.End) {
+		t.Errorf("db.HarvestRun(%d) => %+v; want 3 pages, 3 stored, 2 deleted, 1 failed, ended", a.ID, run)
+	}
+	if len(pages) != 3 || pages[0].Errors[0] != "invalid" || pages[1].Error == "" || pages[2].CursorAfter != "3" {
+		t.Errorf("db.HarvestRun(%d) pages => %+v", a.ID, pages)
+	}
+	if _, _, err := db.HarvestRun(99); err != storage.ErrNotFound {
+		t.Errorf("db.HarvestRun(99) => %v; want ErrNotFound", err)
+	}
+
+	if total, runs, _ := db.HarvestRuns("", 0, 0); total != 2 || len(runs) != 2 || runs[0].ID != b.ID {
+		t.Errorf("db.HarvestRuns() => %d, %+v; want 2, newest first", total, runs)
+	}
+	if total, runs, _ := db.HarvestRuns("a", 0, 0); total != 1 || len(runs) != 1 || runs[0].ID != a.ID {
+		t.Errorf("db.HarvestRuns(a) => %d, %+v; want run %d", total, runs, a.ID)
+	}
+	if _, runs, _ := db.HarvestRuns("", b.ID, 1); len(runs) != 1 || runs[0].ID != a.ID {
+		t.Errorf("db.HarvestRuns(before %d, limit 1) => %+v; want run %d", b.ID, runs, a.ID)
+	}
+}
+
+func TestHarvestJournalPaging(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	var runs []*storage.HarvestRun
+	for i, src := range []string{"a", "b", "a", "ab", "a"} {
+		start := old
+		if i >= 3 {
+			start = time.Now().UTC()
+		}
+		r := &storage.HarvestRun{Source: src, Start: start, Pages: 1}
+		if err := db.Journal(r, storage.HarvestPage{Start: start, End: start}); err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, r)
+	}
+
+	ids := func(runs []storage.HarvestRun) (res []uint64) {
+		for _, r := range runs {
+			res = append(res, r.ID)
+		}
+		return res
+	}
+	tests := []struct {
+		source string
+		before uint64
+		limit  int
+		total  int
+		want   []uint64
+	}{
+		{"a", 0, 0, 3, []uint64{runs[4].ID, runs[2].ID, runs[0].ID}},
+		{"a", 0, 2, 3, []uint64{runs[4].ID, runs[2].ID}},
+		{"a", runs[4].ID, 1, 3, []uint64{runs[2].ID}},
+		{"a", runs[2].ID, 0, 3, []uint64{runs[0].ID}},
+		{"a", runs[0].ID, 0, 3, nil},
+		{"ab", 0, 0, 1, []uint64{runs[3].ID}},
+		{"c", 0, 0, 0, nil},
+		{"", runs[3].ID, 2, 5, []uint64{runs[2].ID, runs[1].ID}},
+	}
+	for _, test := range tests {
+		total, res, err := db.HarvestRuns(test.source, test.before, test.limit)
+		if err != nil || total != test.total || !reflect.DeepEqual(ids(res), test.want) {
+			t.Errorf("db.HarvestRuns(%q, %d, %d) => %d, %v, %v; want %d, %v", test.source, test.before, test.limit, total, ids(res), err, test.total, test.want)
+		}
+	}
+
+	// A run started long ago, but still journaling, is kept
+	if err := db.Journal(runs[1], storage.HarvestPage{Start: time.Now().UTC(), End: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	// A run started long ago, but first journaled after later runs, is purged
+	late := &storage.HarvestRun{Source: "b", Start: old, Pages: 1}
+	if err := db.Journal(late, storage.HarvestPage{Start: old, End: old}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.PurgeHarvestRuns(time.Now().Add(-24 * time.Hour)); err != nil || n != 3 {
+		t.Errorf("db.PurgeHarvestRuns() => %d, %v; want 3", n, err)
+	}
+	if _, _, err := db.HarvestRun(late.ID); err != storage.ErrNotFound {
+		t.Errorf("db.HarvestRun(%d) => %v; want ErrNotFound", late.ID, err)
+	}
+	if _, _, err := db.HarvestRun(runs[0].ID); err != storage.ErrNotFound {
+		t.Errorf("db.HarvestRun(%d) => %v; want ErrNotFound", runs[0].ID, err)
+	}
+	if _, pages, err := db.HarvestRun(runs[1].ID); err != nil || len(pages) != 1 {
+		t.Errorf("db.HarvestRun(%d) => %d pages, %v; want 1", runs[1].ID, len(pages), err)
+	}
+	if total, res, _ := db.HarvestRuns("a", 0, 0); total != 1 || !reflect.DeepEqual(ids(res), []uint64{runs[4].ID}) {
+		t.Errorf("db.HarvestRuns(a) after purge => %d, %v; want 1, [%d]", total, ids(res), runs[4].ID)
+	}
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/knakk/otra/storage"
+)
+
+func TestQuarantine(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	first, err := db.Quarantine(storage.Quarantined{Ref: "id.0", Error: "bad", Raw: "<Product/>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Quarantine(storage.Quarantined{Error: "syntax error", Raw: "<Prod"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Quarantining a product again replaces the previous entry
+	second, err := db.Quarantine(storage.Quarantined{Ref: "id.0", Error: "still bad", Raw: "<Product/>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.QuarantinedProduct(first); err != storage.ErrNotFound {
+		t.Errorf("db.QuarantinedProduct(replaced) => %v; want ErrNotFound", err)
+	}
+	q, err := db.QuarantinedProduct(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Error != "still bad" || q.Raw != "<Product/>" {
+		t.Errorf("db.QuarantinedProduct(%d) => %+v", second, q)
+	}
+
+	total, list, err := db.QuarantinedProducts(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(list) != 2 || list[1].ID != second || list[1].Raw != "" {
+		t.Errorf("db.QuarantinedProducts(0, 10) => %d %+v", total, list)
+	}
+	if _, list, _ := db.QuarantinedProducts(list[0].ID, 10); len(list) != 1 || list[0].ID != second {
+		t.Errorf("db.QuarantinedProducts(after) => %+v; want only %d", list, second)
+	}
+
+	// Storing a product removes it from quarantine
+	if _, err := db.Store(mustParse([]byte(`<Product><RecordReference>id.0</RecordReference><DescriptiveDetail></DescriptiveDetail></Product>`))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.QuarantinedProduct(second); err != storage.ErrNotFound {
+		t.Errorf("db.QuarantinedProduct(stored) => %v; want ErrNotFound", err)
+	}
+
+	_, list, _ = db.QuarantinedProducts(0, 10)
+	if err := db.Unquarantine(list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, _ := db.QuarantinedProducts(0, 10); total != 0 {
+		t.Errorf("%d products in quarantine after Unquarantine; want 0", total)
+	}
+}
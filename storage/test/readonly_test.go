@@ -0,0 +1,85 @@
+package test
+
+import (
+	"encoding/xml"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+
+	if _, err := storage.OpenReadOnly(f, indexFn); err == nil {
+		t.Fatal("opening non-existing database read-only should fail")
+	}
+
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint32, len(products.Product))
+	for i, p := range products.Product {
+		if ids[i], err = db.Store(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	if _, err := db.Store(products.Product[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = storage.OpenReadOnly(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	// Verify that all products are visited in the order they were stored
+	var got []uint32
+	if err := db.ForEach(func(id uint32, p *onix.Product) error {
+		got = append(got, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("db.ForEach visited %v; want %v", got, ids)
+	}
+
+	changed, err := db.ChangedSince(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []uint32{ids[0]}) {
+		t.Errorf("db.ChangedSince() => %v; want %v", changed, []uint32{ids[0]})
+	}
+
+	if _, err := db.Store(products.Product[1]); err != storage.ErrReadOnly {
+		t.Errorf("db.Store() on read-only database => %v; want ErrReadOnly", err)
+	}
+	// Verify that opening the database for writing fails rather than waits
+	// while it is open
+	if db2, err := storage.Open(f, indexFn); err == nil || !strings.Contains(err.Error(), "in use") {
+		if err == nil {
+			db2.Close()
+		}
+		t.Errorf("storage.Open() on database in use => %v; want in use error", err)
+	}
+}
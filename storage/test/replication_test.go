@@ -0,0 +1,137 @@
+package test
+
+import (
+	"encoding/xml"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestReplication(t *testing.T) {
+	f1, f2 := tempfile(), tempfile()
+	defer os.Remove(f1)
+	defer os.Remove(f2)
+	primary, err := storage.Open(f1, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, primary.Close)
+	replica, err := storage.Open(f2, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, replica.Close)
+	replica.SetReadOnly(true)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint32, len(products.Product))
+	for i, p := range products.Product {
+		if ids[i], err = primary.StoreFrom("bokbasen", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := primary.Store(mustParse(updatedRecord)); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that only the latest change of each product is kept
+	changes, err := primary.Changes(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("primary.Changes(0, 10) => %d changes; want 3", len(changes))
+	}
+	got := []string{changes[0].Op, changes[1].Op, changes[2].Op}
+	if want := []string{storage.OpStore, storage.OpStore, storage.OpDelete}; !reflect.DeepEqual(got, want) {
+		t.Errorf("primary.Changes(0, 10) => %v; want %v", got, want)
+	}
+
+	// Verify that changes can be applied in batches, keeping the product IDs
+	for since := uint64(0); ; {
+		batch, err := primary.Changes(since, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if err := replica.Apply(batch); err != nil {
+			t.Fatal(err)
+		}
+		since = replica.Replicated()
+	}
+	if replica.Replicated() != changes[2].Seq {
+		t.Errorf("replica.Replicated() => %d; want %d", replica.Replicated(), changes[2].Seq)
+	}
+	for _, id := range []uint32{ids[0], ids[2]} {
+		want, _ := primary.Get(id)
+		got, err := replica.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("replicated record %d not equal to primary record", id)
+		}
+	}
+	if _, err := replica.Get(ids[1]); err != storage.ErrNotFound {
+		t.Errorf("replica.Get(deleted before replication) => %v; want ErrNotFound", err)
+	}
+	_, res, err := replica.Query("author", "zappa", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []uint32{ids[0]}) {
+		t.Errorf("replica.Query(author, zappa) => %v; want %v", res, []uint32{ids[0]})
+	}
+
+	// Verify that deletions are replicated
+	if err := primary.DeleteByRef("id.2"); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = primary.Changes(replica.Replicated(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Apply(changes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replica.Get(ids[2]); err != storage.ErrDeleted {
+		t.Errorf("replica.Get(deleted) => %v; want ErrDeleted", err)
+	}
+
+	// Verify that sources and deletion times are those of the primary
+	if src, err := replica.SourceOf(ids[0]); err != nil || src != "bokbasen" {
+		t.Errorf("replica.SourceOf(%d) => %q, %v; want bokbasen", ids[0], src, err)
+	}
+	pt, err := primary.Tombstone(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := replica.Tombstone(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rt.Deleted.Equal(pt.Deleted) {
+		t.Errorf("replica.Tombstone(%d).Deleted => %v; want %v", ids[2], rt.Deleted, pt.Deleted)
+	}
+
+	// Verify that the replica is read-only
+	if _, err := replica.Store(products.Product[0]); err != storage.ErrReadOnly {
+		t.Errorf("replica.Store() => %v; want ErrReadOnly", err)
+	}
+	if err := replica.Delete(ids[0]); err != storage.ErrReadOnly {
+		t.Errorf("replica.Delete() => %v; want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,93 @@
+package test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestSourceAttribution(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	a, err := db.StoreFrom("boknett", mustParse(product("id.a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.StoreFrom("oai", mustParse(product("id.b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Store(mustParse(product("id.c")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[uint32]string{a: "boknett", b: "oai"} {
+		if got, err := db.SourceOf(id); err != nil || got != want {
+			t.Errorf("db.SourceOf(%d) => %q, %v; want %q", id, got, err, want)
+		}
+	}
+	if _, err := db.SourceOf(c); err != storage.ErrNotFound {
+		t.Errorf("db.SourceOf(unattributed) => %v; want ErrNotFound", err)
+	}
+
+	// Storing without a source keeps the attribution; storing from
+	// another source replaces it.
+	if _, err := db.Store(mustParse(product("id.a"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.StoreFrom("oai", mustParse(product("id.c"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.StoreFrom("oai", mustParse(product("id.a"))); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func() []uint32 {
+		_, hits, err := db.Query(storage.SourceIndex, "oai", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hits
+	}
+	if got, want := query(), []uint32{c, b, a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("db.Query(source, oai) => %v; want %v", got, want)
+	}
+	if total, _, _ := db.Query(storage.SourceIndex, "boknett", 0, 10); total != 0 {
+		t.Errorf("db.Query(source, boknett) => %d hits; want 0", total)
+	}
+
+	if err := db.Delete(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReindexAll(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := query(), []uint32{c, a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("db.Query(source, oai) after delete and reindex => %v; want %v", got, want)
+	}
+
+	// Updating from a source attributes the product to it
+	err = db.Batch(func(tx *storage.Tx) error {
+		_, err := tx.UpdateFrom("boknett", "id.c", func(p *onix.Product) error { return nil })
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.SourceOf(c); err != nil || got != "boknett" {
+		t.Errorf("db.SourceOf(%d) after tx.UpdateFrom => %q, %v; want boknett", c, got, err)
+	}
+	if got, want := query(), []uint32{a}; !reflect.DeepEqual(got, want) {
+		t.Errorf("db.Query(source, oai) after tx.UpdateFrom => %v; want %v", got, want)
+	}
+}
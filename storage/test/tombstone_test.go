@@ -0,0 +1,89 @@
+package test
+
+import (
+	"encoding/xml"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestTombstones(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint32, len(products.Product))
+	for i, p := range products.Product {
+		if ids[i], err = db.Store(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if err := db.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteByRef("id.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that deleted records can be distinguished from records never stored
+	if _, err := db.Get(ids[0]); err != storage.ErrDeleted {
+		t.Errorf("db.Get(deleted) => %v; want ErrDeleted", err)
+	}
+	if _, err := db.Get(ids[2] + 1); err != storage.ErrNotFound {
+		t.Errorf("db.Get(non-existing) => %v; want ErrNotFound", err)
+	}
+	if db.Ref("id.1") != 0 {
+		t.Error("record reference not deleted when product deleted by reference")
+	}
+
+	// Verify that tombstones are listed in order of deletion
+	tombstones, err := db.Tombstones(time.Time{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 2 || tombstones[0].Ref != "id.0" || tombstones[1].Ref != "id.1" {
+		t.Fatalf("db.Tombstones() => %v; want tombstones for id.0 and id.1", tombstones)
+	}
+	if ts := tombstones[0]; ts.ID != ids[0] || len(ts.Identifiers) != 1 || ts.Identifiers[0].Value != "9780000000111" || ts.Deleted.Before(start) {
+		t.Errorf("tombstone => %+v; missing id, identifiers or deletion time", ts)
+	}
+	tombstones, err = db.Tombstones(tombstones[0].Deleted, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 || tombstones[0].Ref != "id.1" {
+		t.Errorf("db.Tombstones(since first deletion) => %v; want tombstone for id.1", tombstones)
+	}
+
+	// Verify that a deleted reference can be stored again
+	if _, err := db.Store(products.Product[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that tombstones are purged
+	n, err := db.PurgeTombstones(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("db.PurgeTombstones() => %d; want 2", n)
+	}
+	if _, err := db.Get(ids[0]); err != storage.ErrNotFound {
+		t.Errorf("db.Get(purged) => %v; want ErrNotFound", err)
+	}
+}
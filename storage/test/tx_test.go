@@ -0,0 +1,149 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/knakk/otra/storage"
+)
+
+func TestBatch(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	// A failing batch leaves nothing behind
+	errAbort := errors.New("abort")
+	committed := 0
+	err = db.Batch(func(tx *storage.Tx) error {
+		tx.OnCommit(func() { committed++ })
+		if _, err := tx.Store(mustParse(product("id.a"))); err != nil {
+			return err
+		}
+		if err := tx.MetaSet([]byte("cursor"), []byte("1")); err != nil {
+			return err
+		}
+		if _, err := tx.QueueRetry(storage.Retry{Ref: "id.b", Source: "s"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("db.Batch => %v; want %v", err, errAbort)
+	}
+	if committed != 0 {
+		t.Errorf("commit hook called %d times after rollback; want 0", committed)
+	}
+	if id := db.Ref("id.a"); id != 0 {
+		t.Errorf("product stored in rolled back batch as %d", id)
+	}
+	if _, err := db.MetaGet([]byte("cursor")); err != storage.ErrNotFound {
+		t.Errorf("db.MetaGet(cursor) after rollback => %v; want ErrNotFound", err)
+	}
+	if total, _, _ := db.Retries("", 0); total != 0 {
+		t.Errorf("%d products queued for retry after rollback; want 0", total)
+	}
+
+	// A successful batch commits everything, and several products can be
+	// stored in one transaction
+	err = db.Batch(func(tx *storage.Tx) error {
+		for _, ref := range []string{"id.a", "id.c"} {
+			if _, err := tx.StoreFrom("s", mustParse(product(ref))); err != nil {
+				return err
+			}
+		}
+		for _, ref := range []string{"id.b", "id.d", "id.b"} {
+			if _, err := tx.QueueRetry(storage.Retry{Ref: ref, Source: "s", Raw: string(product(ref))}); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.QueueRetry(storage.Retry{Ref: "id.e", Source: "other"}); err != nil {
+			return err
+		}
+		if id := tx.Ref("id.a"); id == 0 {
+			t.Error("tx.Ref(id.a) => 0 for product stored in the transaction")
+		}
+		tx.OnCommit(func() { committed++ })
+		return tx.MetaSet([]byte("cursor"), []byte("1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed != 1 {
+		t.Errorf("commit hook called %d times after commit; want 1", committed)
+	}
+	for _, ref := range []string{"id.a", "id.c"} {
+		p, err := db.Get(db.Ref(ref))
+		if err != nil || p.RecordReference.Value != ref {
+			t.Errorf("db.Get(db.Ref(%q)) => %v, %v", ref, p, err)
+		}
+	}
+	if v, err := db.MetaGet([]byte("cursor")); err != nil || string(v) != "1" {
+		t.Errorf("db.MetaGet(cursor) => %q, %v; want \"1\"", v, err)
+	}
+	total, retries, err := db.Retries("s", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || retries[0].Ref != "id.b" || retries[0].Raw == "" {
+		t.Fatalf("db.Retries(s, 0) => %d %+v", total, retries)
+	}
+
+	// Retries can be updated, removed, and are superseded by the same product
+	err = db.Batch(func(tx *storage.Tx) error {
+		r := retries[1]
+		r.Attempts++
+		if _, err := tx.QueueRetry(r); err != nil {
+			return err
+		}
+		if err := tx.RemoveRetry(retries[0].ID); err != nil {
+			return err
+		}
+		return tx.RemoveRetriesOf("id.b")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, retries, _ = db.Retries("", 1)
+	if total != 2 || len(retries) != 1 || retries[0].Ref != "id.d" || retries[0].Attempts != 1 {
+		t.Errorf("db.Retries(\"\", 1) => %d %+v", total, retries)
+	}
+
+	// Only retries which are due are tried again
+	now := time.Now()
+	err = db.Batch(func(tx *storage.Tx) error {
+		if _, err := tx.QueueRetry(storage.Retry{Ref: "id.f", Source: "s", Due: now.Add(time.Hour)}); err != nil {
+			return err
+		}
+		_, err := tx.QueueRetry(storage.Retry{Ref: "id.g", Source: "s", Due: now.Add(-time.Hour)})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, err := db.DueRetries("s", now, 0)
+	if err != nil || len(due) != 2 || due[0].Ref != "id.d" || due[1].Ref != "id.g" {
+		t.Errorf("db.DueRetries(s) => %+v, %v; want id.d, id.g", due, err)
+	}
+	if due, _ := db.DueRetries("s", now, 1); len(due) != 1 || due[0].Ref != "id.d" {
+		t.Errorf("db.DueRetries(s, limit 1) => %+v; want id.d", due)
+	}
+	if due, _ := db.DueRetries("s", now.Add(2*time.Hour), 0); len(due) != 3 {
+		t.Errorf("db.DueRetries(s, in 2 hours) => %+v; want 3", due)
+	}
+	if total, _, _ := db.Retries("s", 0); total != 3 {
+		t.Errorf("db.Retries(s) => %d; want 3", total)
+	}
+	if err := db.Batch(func(tx *storage.Tx) error { return tx.RemoveRetriesOf("id.f") }); err != nil {
+		t.Fatal(err)
+	}
+	if total, _, _ := db.Retries("s", 0); total != 2 {
+		t.Errorf("db.Retries(s) after tx.RemoveRetriesOf(id.f) => %d; want 2", total)
+	}
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+func TestUpdate(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.Store(products.Product[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the descriptive detail block, and verify that the record is reindexed
+	got, err := db.Update("id.0", func(p *onix.Product) error {
+		p.DescriptiveDetail = products.Product[1].DescriptiveDetail
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != id {
+		t.Errorf("db.Update(id.0) => %d; want %d", got, id)
+	}
+	p, err := db.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PublishingDetail == nil {
+		t.Error("db.Update removed block not touched by update")
+	}
+	if total, _, _ := db.Query("title", "A", 0, 10); total != 0 {
+		t.Errorf("db.Query(title, A) => %d hits after update; want 0", total)
+	}
+	if _, ids, _ := db.Query("title", "Babel", 0, 10); len(ids) != 1 || ids[0] != id {
+		t.Errorf("db.Query(title, Babel) => %v after update; want [%d]", ids, id)
+	}
+
+	// Errors from fn leave the record unchanged
+	errFn := errors.New("fail")
+	if _, err := db.Update("id.0", func(p *onix.Product) error {
+		p.PublishingDetail = nil
+		return errFn
+	}); err != errFn {
+		t.Errorf("db.Update with failing fn => %v; want %v", err, errFn)
+	}
+	if p, err := db.Get(id); err != nil || p.PublishingDetail == nil {
+		t.Errorf("db.Update with failing fn changed the stored record")
+	}
+
+	if _, err := db.Update("id.x", func(p *onix.Product) error { return nil }); err != storage.ErrNotFound {
+		t.Errorf("db.Update(unknown ref) => %v; want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,178 @@
+package test
+
+import (
+	"encoding/xml"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/otra/storage"
+)
+
+// workFn groups products by the surname of the first contributor, and
+// links products with subject "Subject Api" to the product with ISBN 9780000000111.
+func workFn(p *onix.Product) (w storage.Work) {
+	for _, c := range p.DescriptiveDetail.Contributor {
+		w.Key = c.KeyNames.Value
+		break
+	}
+	for _, s := range p.DescriptiveDetail.Subject {
+		for _, st := range s.SubjectHeadingText {
+			if st.Value == "Subject Api" {
+				w.Related = append(w.Related, storage.IndexEntry{Index: "isbn", Term: "9780000000111"})
+			}
+		}
+	}
+	return w
+}
+
+func TestWorks(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+	db.SetWorkFn(workFn)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint32, len(products.Product))
+	for i, p := range products.Product {
+		if ids[i], err = db.Store(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Verify that all products are grouped into the same work; the first two
+	// by key, the last through its related product.
+	work, err := db.WorkOf(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[1:] {
+		if got, _ := db.WorkOf(id); got != work {
+			t.Errorf("db.WorkOf(%d) => %q; want %q", id, got, work)
+		}
+	}
+	n, _, err := db.Query(storage.WorkIndex, work, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("db.Query(%q, %q) => %d hits; want 3", storage.WorkIndex, work, n)
+	}
+
+	// Verify that query results can be collapsed by work
+	n, res, err := db.QueryWorks("title", "book", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || !reflect.DeepEqual(res, []uint32{ids[2]}) {
+		t.Errorf("db.QueryWorks(title, book) => %d, %v; want 1, %v", n, res, []uint32{ids[2]})
+	}
+
+	// Verify that an updated product stays in the work of the product
+	// related to it, which its new work is merged into
+	if _, err := db.Store(mustParse(updatedRecord)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.WorkOf(ids[0]); got != work {
+		t.Errorf("db.WorkOf(%d) => %q; want %q", ids[0], got, work)
+	}
+
+	// Verify that a deleted product is removed from its work
+	if err := db.Delete(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.WorkOf(ids[1]); err != storage.ErrNotFound {
+		t.Errorf("db.WorkOf(%d) after delete => %v; want ErrNotFound", ids[1], err)
+	}
+	n, _, err = db.Query(storage.WorkIndex, work, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("db.Query(%q, %q) after delete => %d hits; want 2", storage.WorkIndex, work, n)
+	}
+}
+
+func TestWorksInAnyOrder(t *testing.T) {
+	f := tempfile()
+	defer os.Remove(f)
+	db, err := storage.Open(f, indexFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checked(t, db.Close)
+	db.SetWorkFn(workFn)
+
+	var products struct {
+		Product []*onix.Product
+	}
+	if err := xml.Unmarshal(records, &products); err != nil {
+		t.Fatal(err)
+	}
+
+	// Store the product related to the first product before it, so that it
+	// is assigned a work of its own, which the first product links to the
+	// work of the second.
+	ids := make([]uint32, len(products.Product))
+	for _, i := range []int{2, 1, 0} {
+		if ids[i], err = db.Store(products.Product[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	work, err := db.WorkOf(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[:2] {
+		if got, _ := db.WorkOf(id); got != work {
+			t.Errorf("db.WorkOf(%d) => %q; want %q", id, got, work)
+		}
+	}
+	n, _, err := db.Query(storage.WorkIndex, work, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("db.Query(%q, %q) => %d hits; want 3", storage.WorkIndex, work, n)
+	}
+
+	// Verify that products keyed by a merged work join the work it was merged into
+	p := mustParse(updatedRecord)
+	p.RecordReference.Value = "id.3"
+	p.ProductIdentifier[0].IDValue.Value = "9780000000444"
+	p.DescriptiveDetail.Contributor[0].KeyNames.Value = "Jensen"
+	id, err := db.Store(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.WorkOf(id); got != work {
+		t.Errorf("db.WorkOf(%d) => %q; want %q", id, got, work)
+	}
+
+	// Verify that works stay merged when the product linking them is
+	// deleted, until all products are reindexed
+	if err := db.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.WorkOf(ids[1]); got != work {
+		t.Errorf("db.WorkOf(%d) after delete => %q; want %q", ids[1], got, work)
+	}
+	if err := db.ReindexAll(); err != nil {
+		t.Fatal(err)
+	}
+	w1, _ := db.WorkOf(ids[1])
+	w2, _ := db.WorkOf(ids[2])
+	if w1 == "" || w1 == w2 {
+		t.Errorf("db.WorkOf(%d), db.WorkOf(%d) after reindex => %q, %q; want different works", ids[1], ids[2], w1, w2)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/knakk/kbp/onix"
+)
+
+// Tombstone represents a deleted product.
+type Tombstone struct {
+	ID          uint32
+	Ref         string
+	Identifiers []Identifier
+	Deleted     time.Time
+}
+
+// Identifier represents a ProductIdentifier of a deleted product.
+type Identifier struct {
+	Type  string
+	Value string
+}
+
+// bury stores a tombstone for the given product, deleted at the given time.
+// Tombstones are stored by ID in the tombstones bucket, and by deletion time
+// in the deletions bucket.
+func (db *DB) bury(tx *bolt.Tx, p *onix.Product, id uint32, deleted time.Time) error {
+	t := Tombstone{
+		ID:      id,
+		Ref:     p.RecordReference.Value,
+		Deleted: deleted,
+	}
+	for _, pid := range p.ProductIdentifier {
+		t.Identifiers = append(t.Identifiers, Identifier{Type: pid.ProductIDType.Value, Value: pid.IDValue.Value})
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte("tombstones")).Put(u32tob(id), b); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("deletions")).Put(deletionKey(t.Deleted, id), nil)
+}
+
+// Tombstone returns the tombstone of the deleted product with the given ID.
+func (db *DB) Tombstone(id uint32) (t Tombstone, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("tombstones")).Get(u32tob(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(b, &t)
+	})
+	return t, err
+}
+
+// Tombstones returns up to limit tombstones of products deleted after the
+// given time, in the order they were deleted.
+func (db *DB) Tombstones(since time.Time, limit int) (res []Tombstone, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("tombstones"))
+		cur := tx.Bucket([]byte("deletions")).Cursor()
+		for k, _ := cur.Seek(deletionKey(since, 0)); k != nil && len(res) < limit; k, _ = cur.Next() {
+			b := bkt.Get(k[8:])
+			if b == nil {
+				continue
+			}
+			var t Tombstone
+			if err := json.Unmarshal(b, &t); err != nil {
+				return err
+			}
+			if !t.Deleted.After(since) {
+				continue
+			}
+			res = append(res, t)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// PurgeTombstones removes the tombstones of products deleted before the
+// given time, returning the number of tombstones removed.
+func (db *DB) PurgeTombstones(before time.Time) (n int, err error) {
+	err = db.kv.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("tombstones"))
+		cur := tx.Bucket([]byte("deletions")).Cursor()
+		end := deletionKey(before, 0)
+		for k, _ := cur.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = cur.First() {
+			if err := bkt.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// deletionKey returns the key of a deletion at the given time, so that
+// deletions are sorted by time.
+func deletionKey(t time.Time, id uint32) []byte {
+	b := make([]byte, 12)
+	if ns := t.UnixNano(); ns > 0 {
+		binary.BigEndian.PutUint64(b, uint64(ns))
+	}
+	binary.BigEndian.PutUint32(b[8:], id)
+	return b
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/knakk/kbp/onix"
+)
+
+// Tx is a read-write transaction. The changes made in a transaction are
+// committed together, or not at all.
+type Tx struct {
+	db       *DB
+	tx       *bolt.Tx
+	onCommit []func()
+}
+
+// Batch calls fn within a read-write transaction, which is committed if fn
+// returns nil, and rolled back otherwise. The error of fn is returned.
+func (db *DB) Batch(fn func(tx *Tx) error) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	t := &Tx{db: db}
+	err := db.kv.Update(func(tx *bolt.Tx) error {
+		t.tx = tx
+		return fn(t)
+	})
+	if err != nil {
+		return err
+	}
+	for _, fn := range t.onCommit {
+		fn()
+	}
+	return nil
+}
+
+// OnCommit calls fn after the transaction is committed, for changes
+// outside the database which must not be made if it is rolled back.
+func (t *Tx) OnCommit(fn func()) {
+	t.onCommit = append(t.onCommit, fn)
+}
+
+// Ref is like DB.Ref, within the transaction.
+func (t *Tx) Ref(ref string) uint32 {
+	if b := t.tx.Bucket([]byte("ref")).Get([]byte(ref)); b != nil {
+		return btou32(b)
+	}
+	return 0
+}
+
+// Store is like DB.Store, within the transaction.
+func (t *Tx) Store(p *onix.Product) (uint32, error) {
+	return t.db.store(t.tx, p)
+}
+
+// StoreFrom is like DB.StoreFrom, within the transaction.
+func (t *Tx) StoreFrom(source string, p *onix.Product) (uint32, error) {
+	return t.db.storeFrom(t.tx, source, p)
+}
+
+// Update is like DB.Update, within the transaction.
+func (t *Tx) Update(ref string, fn func(p *onix.Product) error) (uint32, error) {
+	return t.db.update(t.tx, "", ref, fn)
+}
+
+// UpdateFrom is like Update, but also attributes the product to the named
+// source, like StoreFrom.
+func (t *Tx) UpdateFrom(source, ref string, fn func(p *onix.Product) error) (uint32, error) {
+	return t.db.update(t.tx, source, ref, fn)
+}
+
+// DeleteByRef is like DB.DeleteByRef, within the transaction.
+func (t *Tx) DeleteByRef(ref string) error {
+	return t.db.removeByRef(t.tx, ref)
+}
+
+// Quarantine is like DB.Quarantine, within the transaction.
+func (t *Tx) Quarantine(q Quarantined) (uint64, error) {
+	return t.db.quarantine(t.tx, q)
+}
+
+// MetaGet is like DB.MetaGet, within the transaction. The value is a copy,
+// and can be kept after the transaction.
+func (t *Tx) MetaGet(key []byte) ([]byte, error) {
+	val := t.tx.Bucket([]byte("meta")).Get(key)
+	if val == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// MetaSet is like DB.MetaSet, within the transaction.
+func (t *Tx) MetaSet(key, val []byte) error {
+	return t.tx.Bucket([]byte("meta")).Put(key, val)
+}
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/boltdb/bolt"
+	"github.com/knakk/kbp/onix"
+)
+
+// WorkIndex is the name of the index where products are grouped by the
+// work they are a manifestation of.
+const WorkIndex = "work"
+
+// Work describes which work a product is a manifestation of.
+type Work struct {
+	// Key identifies the work as derived from the product itself,
+	// for example from its normalized title and main author.
+	Key string
+
+	// Related lists index entries pointing to other products known to be
+	// manifestations of the same work. If any of them are assigned a work,
+	// whether stored before or after the product, the product joins that
+	// work instead of using Key, and the work of Key is merged into it.
+	// Merged works stay merged if the product linking them is changed or
+	// deleted, until ReindexAll groups all products again.
+	Related []IndexEntry
+}
+
+// WorkFn is a function which returns the work of a given onix.Product.
+type WorkFn func(*onix.Product) Work
+
+// SetWorkFn sets the function used to group products into works. It should
+// be called before any products are stored.
+func (db *DB) SetWorkFn(fn WorkFn) {
+	db.workFn = fn
+}
+
+func (db *DB) indexWork(tx *bolt.Tx, p *onix.Product, id uint32, entries []IndexEntry) error {
+	if db.workFn == nil {
+		return nil
+	}
+	w := db.workFn(p)
+
+	related := tx.Bucket([]byte("workrelated"))
+	for _, e := range w.Related {
+		hits, err := getHits(related, relatedKey(e))
+		if err != nil {
+			return err
+		}
+		hits.Add(id)
+		if err := putHits(related, relatedKey(e), hits); err != nil {
+			return err
+		}
+	}
+
+	// The product joins the works of the products it is related to, and of
+	// the products related to it, whichever order they were stored in. If it
+	// links several works, including the work of its key, they are merged.
+	linked, err := db.linkedWorks(tx, w.Related, entries, id)
+	if err != nil {
+		return err
+	}
+	key := workAlias(tx, strings.ToLower(w.Key))
+	work := key
+	if len(linked) > 0 {
+		work = linked[0]
+	}
+	if work == "" {
+		return nil
+	}
+	for _, other := range append(linked, key) {
+		if other != "" && other != work {
+			if err := mergeWork(tx, other, work); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Bucket([]byte("works")).Put(u32tob(id), []byte(work)); err != nil {
+		return err
+	}
+
+	bkt, err := tx.Bucket([]byte("indexes")).CreateBucketIfNotExists([]byte(WorkIndex))
+	if err != nil {
+		return err
+	}
+	hits, err := getHits(bkt, []byte(work))
+	if err != nil {
+		return err
+	}
+	hits.Add(id)
+	return putHits(bkt, []byte(work), hits)
+}
+
+// linkedWorks returns the works of the stored products matching any of the
+// related index entries, and of the products related to any of the
+// product's own index entries, in that order and without duplicates.
+func (db *DB) linkedWorks(tx *bolt.Tx, related, entries []IndexEntry, id uint32) (res []string, err error) {
+	works := tx.Bucket([]byte("works"))
+	add := func(hits *roaring.Bitmap) {
+		for _, other := range hits.ToArray() {
+			if other == id {
+				continue
+			}
+			work := works.Get(u32tob(other))
+			if work == nil {
+				continue
+			}
+			known := false
+			for _, w := range res {
+				known = known || w == string(work)
+			}
+			if !known {
+				res = append(res, string(work))
+			}
+		}
+	}
+	for _, e := range related {
+		bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(e.Index))
+		if bkt == nil {
+			continue
+		}
+		hits, err := getHits(bkt, []byte(strings.ToLower(e.Term)))
+		if err != nil {
+			return nil, err
+		}
+		add(hits)
+	}
+	for _, e := range entries {
+		hits, err := getHits(tx.Bucket([]byte("workrelated")), relatedKey(e))
+		if err != nil {
+			return nil, err
+		}
+		add(hits)
+	}
+	return res, nil
+}
+
+// mergeWork moves the products of a work into another, which the work's
+// name refers to from then on. The merge is not undone when the product
+// causing it is removed; only ReindexAll resets works and their aliases.
+func mergeWork(tx *bolt.Tx, from, into string) error {
+	if err := tx.Bucket([]byte("workaliases")).Put([]byte(from), []byte(into)); err != nil {
+		return err
+	}
+	bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(WorkIndex))
+	if bkt == nil {
+		return nil
+	}
+	moved, err := getHits(bkt, []byte(from))
+	if err != nil || moved.IsEmpty() {
+		return err
+	}
+	works := tx.Bucket([]byte("works"))
+	for _, id := range moved.ToArray() {
+		if err := works.Put(u32tob(id), []byte(into)); err != nil {
+			return err
+		}
+	}
+	hits, err := getHits(bkt, []byte(into))
+	if err != nil {
+		return err
+	}
+	hits.Or(moved)
+	if err := putHits(bkt, []byte(into), hits); err != nil {
+		return err
+	}
+	return bkt.Delete([]byte(from))
+}
+
+// workAlias returns the name of the work a work was merged into, if any,
+// following works which were merged again. Should the aliases form a
+// cycle, the last work before it repeats is returned.
+func workAlias(tx *bolt.Tx, work string) string {
+	aliases := tx.Bucket([]byte("workaliases"))
+	seen := make(map[string]bool)
+	for work != "" {
+		seen[work] = true
+		into := aliases.Get([]byte(work))
+		if into == nil || seen[string(into)] {
+			break
+		}
+		work = string(into)
+	}
+	return work
+}
+
+// relatedKey is the key of the products related to an index entry.
+func relatedKey(e IndexEntry) []byte {
+	return []byte(e.Index + "\x00" + strings.ToLower(e.Term))
+}
+
+// getHits returns the product IDs stored under key in bkt.
+func getHits(bkt *bolt.Bucket, key []byte) (*roaring.Bitmap, error) {
+	hits := roaring.New()
+	if bo := bkt.Get(key); bo != nil {
+		if _, err := hits.ReadFrom(bytes.NewReader(bo)); err != nil {
+			return nil, err
+		}
+	}
+	return hits, nil
+}
+
+// putHits stores the product IDs under key in bkt, removing the key if
+// there are none.
+func putHits(bkt *bolt.Bucket, key []byte, hits *roaring.Bitmap) error {
+	if hits.IsEmpty() {
+		return bkt.Delete(key)
+	}
+	b, err := hits.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, b)
+}
+
+func (db *DB) deIndexWork(tx *bolt.Tx, p *onix.Product, idb []byte) error {
+	if db.workFn != nil {
+		related := tx.Bucket([]byte("workrelated"))
+		for _, e := range db.workFn(p).Related {
+			hits, err := getHits(related, relatedKey(e))
+			if err != nil {
+				return err
+			}
+			hits.Remove(btou32(idb))
+			if err := putHits(related, relatedKey(e), hits); err != nil {
+				return err
+			}
+		}
+	}
+
+	works := tx.Bucket([]byte("works"))
+	work := works.Get(idb)
+	if work == nil {
+		return nil
+	}
+	// Copy the work, as the slice is only valid until the bucket is modified
+	work = append([]byte(nil), work...)
+	if err := works.Delete(idb); err != nil {
+		return err
+	}
+
+	bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(WorkIndex))
+	if bkt == nil {
+		return nil
+	}
+	hits, err := getHits(bkt, work)
+	if err != nil {
+		return err
+	}
+	hits.Remove(btou32(idb))
+	return putHits(bkt, work, hits)
+}
+
+// WorkOf returns the work of the product with the given ID. It returns
+// ErrNotFound if the product is not assigned to any work.
+func (db *DB) WorkOf(id uint32) (work string, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("works")).Get(u32tob(id))
+		if b == nil {
+			return ErrNotFound
+		}
+		work = string(b)
+		return nil
+	})
+	return work, err
+}
+
+// QueryWorks performs a query against the given index like Query, but collapses
+// the results so that only the most recent product of each work is returned.
+// The total is the number of distinct works matching the query.
+func (db *DB) QueryWorks(index, query string, offset, limit int, filters ...Filter) (total int, res []uint32, err error) {
+	err = db.kv.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("indexes")).Bucket([]byte(index))
+		if bkt == nil {
+			return fmt.Errorf("index not found: %s", index)
+		}
+		bo := bkt.Get([]byte(strings.ToLower(query)))
+		if bo == nil {
+			return nil
+		}
+
+		hits := roaring.New()
+		if _, err := hits.ReadFrom(bytes.NewReader(bo)); err != nil {
+			return err
+		}
+		if err := applyFilters(tx, hits, filters); err != nil {
+			return err
+		}
+
+		ids := hits.ToArray()
+		reverse(ids)
+
+		works := tx.Bucket([]byte("works"))
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			if work := works.Get(u32tob(id)); work != nil {
+				if seen[string(work)] {
+					continue
+				}
+				seen[string(work)] = true
+			}
+			res = append(res, id)
+		}
+		total = len(res)
+		res = res[min(offset, total):min(offset+limit, total)]
+
+		return nil
+	})
+	return total, res, err
+}
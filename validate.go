@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/knakk/kbp/onix"
+	"github.com/knakk/kbp/onix/codes/list15"
+	"github.com/knakk/kbp/onix/codes/list5"
+)
+
+// validationRule checks a product, returning a description of the problem
+// if it is invalid.
+type validationRule func(p *onix.Product) error
+
+// validationRules are the rules which can be selected by name.
+var validationRules = map[string]validationRule{
+	"record-reference": func(p *onix.Product) error {
+		if strings.TrimSpace(p.RecordReference.Value) == "" {
+			return fmt.Errorf("missing RecordReference")
+		}
+		return nil
+	},
+	"product-identifier": func(p *onix.Product) error {
+		for _, id := range p.ProductIdentifier {
+			if id.IDValue.Value != "" {
+				return nil
+			}
+		}
+		return fmt.Errorf("missing ProductIdentifier")
+	},
+	"descriptive-detail": func(p *onix.Product) error {
+		if p.DescriptiveDetail == nil {
+			return fmt.Errorf("missing DescriptiveDetail")
+		}
+		return nil
+	},
+	"product-form": func(p *onix.Product) error {
+		if p.DescriptiveDetail != nil && p.DescriptiveDetail.ProductForm.Value == "" {
+			return fmt.Errorf("missing ProductForm")
+		}
+		return nil
+	},
+	"title": func(p *onix.Product) error {
+		if p.DescriptiveDetail == nil {
+			return nil
+		}
+		for _, td := range p.DescriptiveDetail.TitleDetail {
+			if len(td.TitleElement) == 0 {
+				return fmt.Errorf("TitleDetail without TitleElement")
+			}
+			switch td.TitleType.Value {
+			case list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource,
+				list15.TitleInOriginalLanguage:
+				if td.TitleElement[0].TitleText == nil {
+					return fmt.Errorf("TitleDetail of type %s without TitleText", td.TitleType.Value)
+				}
+			}
+		}
+		return nil
+	},
+	"publishing-detail": func(p *onix.Product) error {
+		if p.PublishingDetail == nil {
+			return fmt.Errorf("missing PublishingDetail")
+		}
+		for _, imp := range p.PublishingDetail.Imprint {
+			if imp.ImprintName == nil {
+				return fmt.Errorf("Imprint without ImprintName")
+			}
+		}
+		for _, pub := range p.PublishingDetail.Publisher {
+			if pub.PublisherName == nil {
+				return fmt.Errorf("Publisher without PublisherName")
+			}
+		}
+		return nil
+	},
+	"isbn": func(p *onix.Product) error {
+		for _, id := range p.ProductIdentifier {
+			if id.ProductIDType.Value == list5.ISBN13 && !validISBN13(id.IDValue.Value) {
+				return fmt.Errorf("invalid ISBN-13: %q", id.IDValue.Value)
+			}
+		}
+		return nil
+	},
+}
+
+// defaultValidation are the rules which must hold for products to be indexed
+// and displayed.
+var defaultValidation = []string{
+	"record-reference", "descriptive-detail", "product-form", "title", "publishing-detail",
+}
+
+// validator checks products against a set of rules.
+type validator []string
+
+// newValidator returns a validator using the named rules.
+func newValidator(names []string) (validator, error) {
+	for _, name := range names {
+		if _, ok := validationRules[name]; !ok {
+			known := make([]string, 0, len(validationRules))
+			for k := range validationRules {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown validation rule %q (want one of %s)", name, strings.Join(known, ", "))
+		}
+	}
+	return validator(names), nil
+}
+
+// validationError describes the rules a product breaks.
+type validationError string
+
+func (e validationError) Error() string {
+	return "validation failed: " + string(e)
+}
+
+// Validate returns a validationError if the product breaks any of the rules.
+func (v validator) Validate(p *onix.Product) error {
+	var errs []string
+	for _, name := range v {
+		if err := validationRules[name](p); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return validationError(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validISBN13 checks the length and check digit of an ISBN-13.
+func validISBN13(s string) bool {
+	if len(s) != 13 {
+		return false
+	}
+	sum := 0
+	for i, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// splitList splits a comma-separated list, ignoring empty elements.
+func splitList(s string) (res []string) {
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
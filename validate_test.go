@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/knakk/kbp/onix/codes/list1"
+	"github.com/knakk/kbp/onix/codes/list15"
+	"github.com/knakk/kbp/onix/codes/list5"
+)
+
+func TestValidator(t *testing.T) {
+	if _, err := newValidator([]string{"title", "no-such-rule"}); err == nil || !strings.Contains(err.Error(), "no-such-rule") {
+		t.Errorf("newValidator(no-such-rule) => %v; want unknown rule", err)
+	}
+	v, err := newValidator(append(defaultValidation, "product-identifier", "isbn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		isbn = `<ProductIdentifier><ProductIDType>` + list5.ISBN13 + `</ProductIDType><IDValue>9780306406157</IDValue></ProductIdentifier>`
+		form = `<ProductForm>BC</ProductForm>`
+		pub  = `<PublishingDetail><Imprint><ImprintName>I</ImprintName></Imprint></PublishingDetail>`
+	)
+	title := func(typ, element string) string {
+		return `<TitleDetail><TitleType>` + typ + `</TitleType>` + element + `</TitleDetail>`
+	}
+	titleType := list15.DistinctiveTitleBookCoverTitleSerialTitleOnItemSerialContentItemOrReviewedResource
+	titleElement := `<TitleElement><TitleText>T</TitleText></TitleElement>`
+	tests := []struct {
+		ref    string
+		blocks string
+		broken string // rules broken, if any
+	}{
+		{"a", isbn + `<DescriptiveDetail>` + form + title(titleType, titleElement) + `</DescriptiveDetail>` + pub, ""},
+		{" ", isbn + `<DescriptiveDetail>` + form + `</DescriptiveDetail>` + pub, "record-reference"},
+		{"a", `<DescriptiveDetail>` + form + `</DescriptiveDetail>` + pub, "product-identifier"},
+		{"a", isbn + pub, "descriptive-detail"},
+		{"a", isbn + `<DescriptiveDetail></DescriptiveDetail>` + pub, "product-form"},
+		{"a", isbn + `<DescriptiveDetail>` + form + title(titleType, "") + `</DescriptiveDetail>` + pub, "title"},
+		{"a", isbn + `<DescriptiveDetail>` + form + title(list15.TitleInOriginalLanguage, `<TitleElement><Subtitle>S</Subtitle></TitleElement>`) + `</DescriptiveDetail>` + pub, "title"},
+		{"a", isbn + `<DescriptiveDetail>` + form + title("99", `<TitleElement><Subtitle>S</Subtitle></TitleElement>`) + `</DescriptiveDetail>` + pub, ""},
+		{"a", isbn + `<DescriptiveDetail>` + form + `</DescriptiveDetail>`, "publishing-detail"},
+		{"a", isbn + `<DescriptiveDetail>` + form + `</DescriptiveDetail><PublishingDetail><Imprint></Imprint></PublishingDetail>`, "publishing-detail"},
+		{"a", isbn + `<DescriptiveDetail>` + form + `</DescriptiveDetail><PublishingDetail><Publisher></Publisher></PublishingDetail>`, "publishing-detail"},
+		{"a", strings.Replace(isbn, "9780306406157", "9780306406158", 1) + `<DescriptiveDetail>` + form + `</DescriptiveDetail>` + pub, "isbn"},
+		{" ", pub, "record-reference, descriptive-detail, product-identifier"},
+	}
+	for _, test := range tests {
+		p := mustDecode(t, testProduct(test.ref, list1.NotificationConfirmedOnPublication, test.blocks))
+		err := v.Validate(p)
+		var broken []string
+		if ve, ok := err.(validationError); ok {
+			for _, e := range strings.Split(string(ve), "; ") {
+				broken = append(broken, strings.SplitN(e, ":", 2)[0])
+			}
+		} else if err != nil {
+			t.Errorf("Validate(%s) => %T; want validationError", test.blocks, err)
+		}
+		if got := strings.Join(broken, ", "); got != test.broken {
+			t.Errorf("Validate(%q, %s) => %v; want broken rules %q", test.ref, test.blocks, err, test.broken)
+		}
+	}
+}
+
+func TestValidISBN13(t *testing.T) {
+	for s, want := range map[string]bool{
+		"9780306406157":  true,
+		"9780306406158":  false,
+		"978030640615":   false,
+		"97803064061570": false,
+		"978030640615X":  false,
+		"":               false,
+	} {
+		if got := validISBN13(s); got != want {
+			t.Errorf("validISBN13(%q) => %v; want %v", s, got, want)
+		}
+	}
+}